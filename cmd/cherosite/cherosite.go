@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/BurntSushi/toml"
-	"github.com/gorilla/sessions"
 	pbApi "github.com/luisguve/cheroproto-go/cheroapi"
 	pbUsers "github.com/luisguve/cheroproto-go/userapi"
 	app "github.com/luisguve/cherosite/internal/app/cherosite"
 	"github.com/luisguve/cherosite/internal/pkg/livedata"
+	"github.com/luisguve/cherosite/internal/pkg/logging"
+	"github.com/luisguve/cherosite/internal/pkg/pagination"
 	"github.com/luisguve/cherosite/internal/pkg/router"
 	"github.com/luisguve/cherosite/internal/pkg/templates"
 	"google.golang.org/grpc"
@@ -19,21 +26,178 @@ import (
 type httpConfig struct {
 	BindAddress string `toml:"bind_address"`
 	Port        string
+	// DrainPeriod is the time given to the requests in flight and the live
+	// notifications to finish on shutdown, e.g. "20s". It defaults to
+	// defaultDrainPeriod.
+	DrainPeriod duration `toml:"drain_period"`
+	// TLS enables serving over TLS if set.
+	TLS *tlsConfig `toml:"tls"`
 }
 
+// tlsConfig holds the settings to serve over TLS.
+type tlsConfig struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// MinVersion is either "1.2" or "1.3". It defaults to "1.2".
+	MinVersion string `toml:"min_version"`
+	// RedirectPort is the port of a plain HTTP listener redirecting to HTTPS.
+	// No listener is started if it is empty.
+	RedirectPort string `toml:"redirect_port"`
+}
+
+// tlsVersions maps the TLS versions that can be set in min_version to their
+// values in crypto/tls.
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+const defaultDrainPeriod = 20 * time.Second
+
 type grpcConfig struct {
 	BindAddress string `toml:"bind_address"`
+	// Timeout is the deadline for the requests to the service, e.g. "10s". It
+	// defaults to defaultTimeout.
+	Timeout duration `toml:"timeout"`
+	// TLS enables connecting to the service over TLS if set.
+	TLS       *grpcTLSConfig   `toml:"tls"`
+	Keepalive *keepaliveConfig `toml:"keepalive"`
 }
 
 type sectionConfig struct {
-	BindAddress string `toml:"bind_address"`
-	Id          string `toml:"id"`
-	Name        string `toml:"name"`
+	BindAddress string           `toml:"bind_address"`
+	Id          string           `toml:"id"`
+	Name        string           `toml:"name"`
+	Timeout     duration         `toml:"timeout"`
+	TLS         *grpcTLSConfig   `toml:"tls"`
+	Keepalive   *keepaliveConfig `toml:"keepalive"`
+}
+
+// defaultTimeout is the deadline for the requests to the services that do not
+// set a timeout. It is shorter than the write timeout of the server, so that
+// slow services are replied as UPSTREAM_TIMEOUT rather than dropping the
+// connection.
+const defaultTimeout = 10 * time.Second
+
+// timeoutOrDefault returns d, or defaultTimeout if d is not set.
+func timeoutOrDefault(d duration) time.Duration {
+	if d.Duration == 0 {
+		return defaultTimeout
+	}
+	return d.Duration
+}
+
+// seenConfig holds the settings of the store of the contents already seen by
+// every session.
+type seenConfig struct {
+	// Backend is either "memory" or "file". It defaults to "memory".
+	Backend string `toml:"backend"`
+	// Dir is the folder where the file backend keeps the entries.
+	Dir string `toml:"dir"`
+	// Capacity is the maximum number of sessions kept by the memory backend.
+	// It defaults to pagination.DefaultSeenCapacity.
+	Capacity int `toml:"capacity"`
+	// TTL is the time an entry is kept without being updated, e.g. "24h". It
+	// defaults to pagination.DefaultSeenTTL.
+	TTL duration `toml:"ttl"`
+	// MaxIds, MaxContexts and MaxAge bound the ids kept per session; see
+	// pagination.Limits. Each of them defaults to its value in
+	// pagination.DefaultLimits.
+	MaxIds      int      `toml:"max_ids"`
+	MaxContexts int      `toml:"max_contexts"`
+	MaxAge      duration `toml:"max_age"`
+}
+
+func (s seenConfig) preventDefault() error {
+	switch s.Backend {
+	case "", "memory":
+	case "file":
+		if s.Dir == "" {
+			return fmt.Errorf("Missing seen store dir.")
+		}
+	default:
+		return fmt.Errorf("Unknown seen store backend %q.", s.Backend)
+	}
+	// Zero values take the defaults.
+	if s.Capacity < 0 || s.MaxIds < 0 || s.MaxContexts < 0 {
+		return fmt.Errorf("Seen store capacity, max ids and max contexts must not be negative.")
+	}
+	if s.TTL.Duration < 0 || s.MaxAge.Duration < 0 {
+		return fmt.Errorf("Seen store ttl and max age must not be negative.")
+	}
+	return nil
+}
+
+// limits returns the limits of the ids kept per session set by s.
+func (s seenConfig) limits() *pagination.Limits {
+	l := pagination.DefaultLimits
+	if s.MaxIds != 0 {
+		l.MaxIds = s.MaxIds
+	}
+	if s.MaxContexts != 0 {
+		l.MaxContexts = s.MaxContexts
+	}
+	if s.MaxAge.Duration != 0 {
+		l.MaxAge = s.MaxAge.Duration
+	}
+	return &l
+}
+
+// seenStore returns the store set up by s. If it is a file store, the expired
+// entries are purged periodically.
+func (s seenConfig) seenStore(logger *logging.Logger) (pagination.SeenStore, error) {
+	ttl := s.TTL.Duration
+	if ttl == 0 {
+		ttl = pagination.DefaultSeenTTL
+	}
+	switch s.Backend {
+	case "", "memory":
+		capacity := s.Capacity
+		if capacity == 0 {
+			capacity = pagination.DefaultSeenCapacity
+		}
+		return pagination.NewMemorySeenStore(capacity, ttl), nil
+	case "file":
+		if s.Dir == "" {
+			return nil, fmt.Errorf("Missing seen store dir.")
+		}
+		store, err := pagination.NewFileSeenStore(s.Dir, ttl)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			for range time.Tick(ttl) {
+				if err := store.Purge(); err != nil {
+					logger.Error("Could not purge seen store", "err", err)
+				}
+			}
+		}()
+		return store, nil
+	}
+	return nil, fmt.Errorf("Unknown seen store backend %q.", s.Backend)
 }
 
-type sessConfig struct {
-	Dir string `toml:"sess_dir"`
-	Key string `toml:"sess_secret_key"`
+// apiConfig holds the settings of the API served under /api/v1.
+type apiConfig struct {
+	// TokenKey is the key used to sign the bearer tokens. It defaults to the
+	// first session secret key.
+	TokenKey string `toml:"token_secret_key"`
+	// TokenLifetime is the time a token is valid for, e.g. "720h". It defaults
+	// to 30 days.
+	TokenLifetime duration `toml:"token_lifetime"`
+}
+
+// duration is a time.Duration that can be decoded from a toml string such as
+// "30s" or "2h45m".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
 }
 
 type cherositeConfig struct {
@@ -46,6 +210,36 @@ type cherositeConfig struct {
 	HttpConf       httpConfig            `toml:"http_config"`
 	Patillavatars  []string              `toml:"patillavatars"`
 	SessEnv        sessConfig            `toml:"session_variables"`
+	Seen           seenConfig            `toml:"seen_store"`
+	API            apiConfig             `toml:"api"`
+	RateLimits     rateLimitsConfig      `toml:"rate_limits"`
+	LiveNotifs     liveNotifsConfig      `toml:"live_notifs"`
+	Metrics        metricsConfig         `toml:"metrics"`
+	// HealthCheck enables the gRPC health checking protocol at "/readyz".
+	HealthCheck bool      `toml:"grpc_health_check"`
+	Log         logConfig `toml:"log"`
+}
+
+// logConfig holds the settings of the logger.
+type logConfig struct {
+	// Level is the minimum level of the entries written: "debug", "info",
+	// "warn" or "error". It defaults to "info".
+	Level string `toml:"level"`
+	// Format is either "text" or "json". It defaults to "text".
+	Format string `toml:"format"`
+}
+
+// logger returns a logger that writes to the standard error with the settings
+// of l.
+func (l logConfig) logger() (*logging.Logger, error) {
+	level := logging.LevelInfo
+	if l.Level != "" {
+		var err error
+		if level, err = logging.ParseLevel(l.Level); err != nil {
+			return nil, err
+		}
+	}
+	return logging.New(os.Stderr, level, l.Format)
 }
 
 func main() {
@@ -67,67 +261,192 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Create session store.
-	sessDir := config.SessEnv.Dir
-	sessKey := []byte(config.SessEnv.Key)
-	store := sessions.NewFilesystemStore(sessDir, sessKey)
-	// Set no limit on length of sessions.
-	store.MaxLength(0)
+	// Setup the logger of the site.
+	logger, err := config.Log.logger()
+	if err != nil {
+		log.Fatal(err)
+	}
+	logging.SetDefault(logger)
+
+	// Create session store and the registry of the sessions of the logged in
+	// users. The cookies are sent only over HTTPS if it is enabled.
+	store, registry, err := config.SessEnv.store(config.HttpConf.TLS != nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create the store of the contents seen in every session.
+	seen, err := config.Seen.seenStore(logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Connections with the gRPC services, closed on shutdown.
+	var conns []*grpc.ClientConn
 
 	// Establish connection with users gRPC service.
-	addr := config.ServicesConf["users"].BindAddress
-	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	usersConf := config.ServicesConf["users"]
+	opts, err := dialOptions("users", usersConf.TLS, usersConf.Keepalive)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer conn.Close()
+	conn, err := grpc.Dial(usersConf.BindAddress, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conns = append(conns, conn)
 
+	usersConn := conn
 	usersClient := pbUsers.NewCrudUsersClient(conn)
 
 	// Create and start hub
-	hub := livedata.NewHub(usersClient)
+	usersTimeout := timeoutOrDefault(usersConf.Timeout)
+	hubOpts := config.LiveNotifs.hubOptions(logger)
+	hub := livedata.NewHub(usersClient, usersTimeout, logger, hubOpts)
 	go hub.Run()
 
 	// Establish connection with general gRPC service.
-	addr = config.ServicesConf["general"].BindAddress
-	conn, err = grpc.Dial(addr, grpc.WithInsecure())
+	generalConf := config.ServicesConf["general"]
+	opts, err = dialOptions("general", generalConf.TLS, generalConf.Keepalive)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer conn.Close()
+	conn, err = grpc.Dial(generalConf.BindAddress, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conns = append(conns, conn)
 
+	generalConn := conn
 	generalClient := pbApi.NewCrudGeneralClient(conn)
 
 	// Establish connection with section gRPC services.
 	var sections []router.Section
 
 	for _, s := range config.Sections {
-		conn, err = grpc.Dial(s.BindAddress, grpc.WithInsecure())
+		opts, err = dialOptions("section_"+s.Id, s.TLS, s.Keepalive)
+		if err != nil {
+			log.Fatal(err)
+		}
+		conn, err = grpc.Dial(s.BindAddress, opts...)
 		if err != nil {
 			log.Fatal("Could not setup dial:", err)
 		}
-		defer conn.Close()
+		conns = append(conns, conn)
 
 		sectionClient := pbApi.NewCrudCheropatillaClient(conn)
 		section := router.Section{
-			Client: sectionClient,
-			Id:     s.Id,
-			Name:   s.Name,
+			Client:  sectionClient,
+			Id:      s.Id,
+			Name:    s.Name,
+			Timeout: timeoutOrDefault(s.Timeout),
+			Conn:    conn,
 		}
 		sections = append(sections, section)
 	}
 
 	// Setup a new templates engine.
-	tpl := templates.Setup(":" + config.HttpConf.Port, config.InternalTplDir, config.PublicTplDir)
+	tpl := templates.Setup(":"+config.HttpConf.Port, config.InternalTplDir, config.PublicTplDir,
+		logger)
 
 	// Setup router and routes.
-	router := router.New(tpl, usersClient, generalClient, sections, store, hub, config.Patillavatars)
+	tokenKey := config.API.TokenKey
+	if tokenKey == "" {
+		tokenKey = config.SessEnv.Keys[0]
+	}
+	tokenLifetime := config.API.TokenLifetime.Duration
+	if tokenLifetime == 0 {
+		tokenLifetime = 30 * 24 * time.Hour
+	}
+	routerOpts := router.Options{
+		TokenKey:       []byte(tokenKey),
+		TokenLifetime:  tokenLifetime,
+		UsersTimeout:   usersTimeout,
+		GeneralTimeout: timeoutOrDefault(generalConf.Timeout),
+		UsersConn:      usersConn,
+		GeneralConn:    generalConn,
+		HealthCheck:    config.HealthCheck,
+		Logger:         logger,
+		Seen:           seen,
+		DiscardLimits:  config.Seen.limits(),
+		Registry:       registry,
+		// Sessions of the logged in users.
+		SessionLifetime:    config.SessEnv.lifetime(),
+		SessionIdleTimeout: config.SessEnv.IdleTimeout.Duration,
+		// Rate limits of the routes.
+		RateLimits:        config.RateLimits.limits(),
+		LoginLockout:      config.RateLimits.loginLockout(),
+		TrustForwardedFor: config.RateLimits.TrustForwardedFor,
+		// Live connections.
+		AllowedOrigins:       config.LiveNotifs.AllowedOrigins,
+		MaxLiveConns:         config.LiveNotifs.MaxConnsPerUser,
+		SessionCheckInterval: config.LiveNotifs.SessionCheck.Duration,
+		// Clients allowed to get the metrics.
+		Metrics: config.Metrics.access(),
+	}
+	router := router.New(tpl, usersClient, generalClient, sections, store, hub,
+		config.Patillavatars, routerOpts)
 	router.SetupRoutes(config.UploadDir, config.StaticDir)
 
 	// Start app.
-	addr = config.HttpConf.BindAddress + ":" + config.HttpConf.Port
-	a := app.New(router, addr)
-	log.Fatal(a.Run())
+	addr := config.HttpConf.BindAddress + ":" + config.HttpConf.Port
+	var a *app.App
+	if t := config.HttpConf.TLS; t != nil {
+		tlsConf := app.TLSConfig{
+			CertFile:   t.CertFile,
+			KeyFile:    t.KeyFile,
+			MinVersion: tlsVersions[t.MinVersion],
+		}
+		if t.RedirectPort != "" {
+			tlsConf.RedirectAddr = config.HttpConf.BindAddress + ":" + t.RedirectPort
+		}
+		a = app.NewTLS(router, addr, tlsConf)
+	} else {
+		a = app.New(router, addr)
+	}
+	if config.Metrics.BindAddress != "" {
+		a.ServeMetrics(config.Metrics.BindAddress, config.Metrics.handler())
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- a.Run()
+	}()
+
+	// Wait for a signal to shut down.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-errc:
+		logger.Error("Server stopped", "err", err)
+	case sig := <-stop:
+		logger.Info("Shutting down", "signal", sig)
+	}
+	signal.Stop(stop)
+
+	drain := config.HttpConf.DrainPeriod.Duration
+	if drain == 0 {
+		drain = defaultDrainPeriod
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	// Stop accepting requests and wait for the ones in flight.
+	if err := a.Shutdown(ctx); err != nil {
+		logger.Error("Could not drain requests", "err", err)
+	}
+	// Wait for the pending notifications and close the websocket connections.
+	if err := router.Shutdown(ctx); err != nil {
+		logger.Error("Could not close live connections", "err", err)
+	}
+	if err := hubOpts.Bus.Close(); err != nil {
+		logger.Error("Could not close live notifications bus", "err", err)
+	}
+	for _, conn := range conns {
+		if err := conn.Close(); err != nil {
+			logger.Error("Could not close gRPC connection", "target", conn.Target(),
+				"err", err)
+		}
+	}
+	logger.Info("Shut down")
 }
 
 func (c cherositeConfig) preventDefault() error {
@@ -168,12 +487,30 @@ func (c cherositeConfig) preventDefault() error {
 			return err
 		}
 	}
+	if err := c.SessEnv.preventDefault(); err != nil {
+		return err
+	}
+	if err := c.Seen.preventDefault(); err != nil {
+		return err
+	}
+	if err := c.RateLimits.preventDefault(); err != nil {
+		return err
+	}
+	if err := c.LiveNotifs.preventDefault(); err != nil {
+		return err
+	}
+	if err := c.Metrics.preventDefault(); err != nil {
+		return err
+	}
 	if err := c.HttpConf.preventDefault(); err != nil {
 		return err
 	}
 	if len(c.Patillavatars) == 0 {
 		return fmt.Errorf("Missing default patillavatars.")
 	}
+	if c.API.TokenLifetime.Duration < 0 {
+		return fmt.Errorf("API token lifetime must not be negative.")
+	}
 	return nil
 }
 
@@ -187,7 +524,10 @@ func (s sectionConfig) preventDefault() error {
 	if s.Name == "" {
 		return fmt.Errorf("Missing name in one or more sections.")
 	}
-	return nil
+	if s.Timeout.Duration < 0 {
+		return fmt.Errorf("Timeout of section %s must not be negative.", s.Id)
+	}
+	return transportPreventDefault("section "+s.Id, s.TLS, s.Keepalive)
 }
 
 func (h httpConfig) preventDefault() error {
@@ -197,22 +537,37 @@ func (h httpConfig) preventDefault() error {
 	if h.Port == "" {
 		return fmt.Errorf("Missing http port.")
 	}
+	if h.DrainPeriod.Duration < 0 {
+		return fmt.Errorf("Drain period must not be negative.")
+	}
+	if h.TLS != nil {
+		return h.TLS.preventDefault(h.Port)
+	}
 	return nil
 }
 
-func (g grpcConfig) preventDefault(srvName string) error {
-	if g.BindAddress == "" {
-		return fmt.Errorf("Missing %s service bind address.", srvName)
+func (t tlsConfig) preventDefault(port string) error {
+	if t.CertFile == "" {
+		return fmt.Errorf("Missing TLS certificate file.")
+	}
+	if t.KeyFile == "" {
+		return fmt.Errorf("Missing TLS key file.")
+	}
+	if _, ok := tlsVersions[t.MinVersion]; !ok {
+		return fmt.Errorf("Unsupported TLS min version %q.", t.MinVersion)
+	}
+	if t.RedirectPort == port {
+		return fmt.Errorf("TLS redirect port must differ from http port.")
 	}
 	return nil
 }
 
-func (s sessConfig) preventDefault() error {
-	if s.Dir == "" {
-		return fmt.Errorf("Missing session dir.")
+func (g grpcConfig) preventDefault(srvName string) error {
+	if g.BindAddress == "" {
+		return fmt.Errorf("Missing %s service bind address.", srvName)
 	}
-	if s.Key == "" {
-		return fmt.Errorf("Missing session secret key.")
+	if g.Timeout.Duration < 0 {
+		return fmt.Errorf("Timeout of %s service must not be negative.", srvName)
 	}
-	return nil
+	return transportPreventDefault(srvName+" service", g.TLS, g.Keepalive)
 }
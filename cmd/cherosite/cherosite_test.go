@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/luisguve/cherosite/internal/pkg/pagination"
+)
+
+func TestSeenConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		toml    string
+		wantErr bool
+	}{
+		{"defaults", ``, false},
+		{"zero values", `capacity = 0
+ttl = "0s"
+max_ids = 0
+max_contexts = 0`, false},
+		{"file backend", `backend = "file"
+dir = "/tmp/seen"`, false},
+		{"file backend without dir", `backend = "file"`, true},
+		{"unknown backend", `backend = "disk"`, true},
+		{"negative capacity", `capacity = -1`, true},
+		{"negative ttl", `ttl = "-1h"`, true},
+		{"negative max ids", `max_ids = -5`, true},
+		{"negative max contexts", `max_contexts = -5`, true},
+		{"negative max age", `max_age = "-6h"`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s seenConfig
+			if _, err := toml.Decode(tt.toml, &s); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			err := s.preventDefault()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSeenConfigDefaults(t *testing.T) {
+	var s seenConfig
+	if _, err := toml.Decode(`max_ids = 0
+max_contexts = 7`, &s); err != nil {
+		t.Fatal(err)
+	}
+	l := s.limits()
+	if l.MaxIds != pagination.DefaultLimits.MaxIds {
+		t.Errorf("MaxIds = %d, want the default %d", l.MaxIds, pagination.DefaultLimits.MaxIds)
+	}
+	if l.MaxContexts != 7 {
+		t.Errorf("MaxContexts = %d, want 7", l.MaxContexts)
+	}
+	if l.MaxAge != pagination.DefaultLimits.MaxAge {
+		t.Errorf("MaxAge = %v, want the default %v", l.MaxAge, pagination.DefaultLimits.MaxAge)
+	}
+
+	store, err := s.seenStore(nil)
+	if err != nil {
+		t.Fatalf("seenStore: %v", err)
+	}
+	// An entry of the store with the default ttl and capacity outlives its
+	// update.
+	if err := store.Update("k", func(d *pagination.DiscardIds) {
+		d.Touch(pagination.KindGeneralThreads, "")
+		d.GeneralThreads["s"] = []string{"t1"}
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	d, err := store.Get("k")
+	if err != nil || d == nil || len(d.GeneralThreads["s"]) != 1 {
+		t.Fatalf("Get = %v, %v; want the ids of the update", d, err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/luisguve/cherosite/internal/pkg/livedata"
+	"github.com/luisguve/cherosite/internal/pkg/logging"
+)
+
+// liveNotifsConfig holds the settings of the live notifications.
+type liveNotifsConfig struct {
+	// QueueSize is the number of notifications queued per connection. It
+	// defaults to livedata.DefaultQueueSize.
+	QueueSize int `toml:"queue_size"`
+	// QueuePolicy is what to do with a notification for a connection whose
+	// queue is full: "disconnect", "drop_oldest" or "coalesce". It defaults to
+	// "disconnect".
+	QueuePolicy string `toml:"queue_policy"`
+	// Bus carries the notifications between the instances of the site:
+	// "memory", for a single instance, or "redis". It defaults to "memory".
+	Bus string `toml:"bus"`
+	// Redis holds the settings of the redis bus; its prefix is not used.
+	Redis redisConfig `toml:"redis"`
+	// Channel is the channel of the redis bus. It defaults to
+	// livedata.DefaultRedisChannel.
+	Channel string `toml:"channel"`
+	// AllowedOrigins are the origins of the pages other than those of the site
+	// that may open live connections, e.g. "https://example.com".
+	AllowedOrigins []string `toml:"allowed_origins"`
+	// MaxConnsPerUser is the number of live connections a user may open at
+	// once on an instance. It defaults to router.DefaultMaxLiveConns; -1
+	// disables the limit.
+	MaxConnsPerUser int `toml:"max_conns_per_user"`
+	// SessionCheck is the time between the checks of the session of every
+	// websocket, e.g. "1m". It defaults to router.DefaultSessionCheckInterval.
+	SessionCheck duration `toml:"session_check"`
+}
+
+// queuePolicies maps the values that can be set in queue_policy to their
+// values in livedata.
+var queuePolicies = map[string]livedata.QueuePolicy{
+	"":            livedata.Disconnect,
+	"disconnect":  livedata.Disconnect,
+	"drop_oldest": livedata.DropOldest,
+	"coalesce":    livedata.Coalesce,
+}
+
+// hubOptions returns the options of the hub set by l. The bus of the options
+// must be closed once the hub is shut down.
+func (l liveNotifsConfig) hubOptions(log *logging.Logger) livedata.Options {
+	var bus livedata.Bus
+	switch l.Bus {
+	case "redis":
+		bus = livedata.NewRedisBus(livedata.RedisOptions{
+			Addr:     l.Redis.Address,
+			Password: l.Redis.Password,
+			Channel:  l.Channel,
+		}, log)
+	default:
+		bus = livedata.NewMemoryBus()
+	}
+	return livedata.Options{
+		QueueSize:   l.QueueSize,
+		QueuePolicy: queuePolicies[l.QueuePolicy],
+		Bus:         bus,
+	}
+}
+
+func (l liveNotifsConfig) preventDefault() error {
+	if l.QueueSize < 0 {
+		return fmt.Errorf("Live notifications queue size must not be negative.")
+	}
+	if _, ok := queuePolicies[l.QueuePolicy]; !ok {
+		return fmt.Errorf("Unknown live notifications queue policy %q.", l.QueuePolicy)
+	}
+	if l.SessionCheck.Duration < 0 {
+		return fmt.Errorf("Live notifications session check must not be negative.")
+	}
+	for _, origin := range l.AllowedOrigins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("Invalid live notifications allowed origin %q.", origin)
+		}
+	}
+	switch l.Bus {
+	case "", "memory":
+	case "redis":
+		if l.Redis.Address == "" {
+			return fmt.Errorf("Missing live notifications redis address.")
+		}
+		if l.Redis.DB != 0 {
+			// Pub/sub channels are not scoped to a database.
+			return fmt.Errorf("Live notifications redis db is not supported; set channel instead.")
+		}
+	default:
+		return fmt.Errorf("Unknown live notifications bus %q.", l.Bus)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/luisguve/cherosite/internal/pkg/metrics"
+	"github.com/luisguve/cherosite/internal/pkg/router"
+)
+
+// metricsConfig holds the settings of the clients that may get the metrics.
+type metricsConfig struct {
+	// BindAddress is the address of a separate listener that serves only the
+	// metrics at "/metrics", e.g. "127.0.0.1:9090". If it is set, the metrics
+	// are not served by the site.
+	BindAddress string `toml:"bind_address"`
+	// AllowedIPs are the IP addresses or networks, e.g. "10.0.0.0/8", of the
+	// clients that may get the metrics from the site. Only the clients on the
+	// loopback interface may if it is empty.
+	AllowedIPs []string `toml:"allowed_ips"`
+	// Username and Password require basic authentication to get the metrics,
+	// either from the site or from the separate listener.
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+}
+
+func (m metricsConfig) preventDefault() error {
+	if _, err := m.nets(); err != nil {
+		return err
+	}
+	if (m.Username == "") != (m.Password == "") {
+		return fmt.Errorf("Both metrics username and password must be set.")
+	}
+	return nil
+}
+
+// nets returns the networks of the allowed IPs; a single address is a network
+// of its own.
+func (m metricsConfig) nets() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range m.AllowedIPs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid metrics allowed IP %q.", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid metrics allowed network %q.", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// access returns the clients that may get the metrics from the site, or nil if
+// they are served on a separate listener.
+func (m metricsConfig) access() *router.MetricsAccess {
+	if m.BindAddress != "" {
+		return nil
+	}
+	// The networks were checked by preventDefault.
+	nets, _ := m.nets()
+	return &router.MetricsAccess{
+		Nets:     nets,
+		Username: m.Username,
+		Password: m.Password,
+	}
+}
+
+// handler returns the handler of the metrics on the separate listener.
+func (m metricsConfig) handler() http.Handler {
+	if m.Username != "" {
+		return metrics.BasicAuth(metrics.Handler(), m.Username, m.Password)
+	}
+	return metrics.Handler()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/luisguve/cherosite/internal/pkg/ratelimit"
+	"github.com/luisguve/cherosite/internal/pkg/router"
+)
+
+// rateLimitsConfig holds the rate limits of the classes of routes and the
+// lockout of the logins.
+type rateLimitsConfig struct {
+	// TrustForwardedFor takes the IP address of the clients from the header
+	// X-Forwarded-For. Set it only if the site is served behind a proxy that
+	// sets it.
+	TrustForwardedFor bool `toml:"trust_forwarded_for"`
+	// Auth, Recycle, Vote and Write are the rate limits of the classes of
+	// routes; see router.ClassAuth and the rest. Every class that is not set
+	// keeps its limits in router.DefaultRateLimits.
+	Auth    *classLimitConfig `toml:"auth"`
+	Recycle *classLimitConfig `toml:"recycle"`
+	Vote    *classLimitConfig `toml:"vote"`
+	Write   *classLimitConfig `toml:"write"`
+	// LoginLockout defaults to router.DefaultLoginLockout.
+	LoginLockout *lockoutConfig `toml:"login_lockout"`
+}
+
+// classLimitConfig holds the rate limits of a class of routes by IP address and
+// by user. The requests are not limited by IP address or by user if the
+// respective limit is not set.
+type classLimitConfig struct {
+	IP   *policyConfig `toml:"ip"`
+	User *policyConfig `toml:"user"`
+}
+
+// policyConfig allows a number of requests per period of time, e.g. 60 per
+// "1m", in bursts of up to Burst requests. Burst defaults to the number of
+// requests.
+type policyConfig struct {
+	Requests int      `toml:"requests"`
+	Per      duration `toml:"per"`
+	Burst    int      `toml:"burst"`
+}
+
+// lockoutConfig locks out the logins of a username for Duration after
+// MaxFailures failures within Window. A MaxFailures of zero disables it.
+type lockoutConfig struct {
+	MaxFailures int      `toml:"max_failures"`
+	Window      duration `toml:"window"`
+	Duration    duration `toml:"duration"`
+}
+
+// limits returns the rate limits of the classes of routes set by c, along with
+// the defaults of the classes it does not set.
+func (c rateLimitsConfig) limits() map[string]router.RateLimit {
+	limits := make(map[string]router.RateLimit, len(router.DefaultRateLimits))
+	for class, limit := range router.DefaultRateLimits {
+		limits[class] = limit
+	}
+	for class, l := range c.classes() {
+		if l != nil {
+			limits[class] = router.RateLimit{
+				PerIP:   l.IP.policy(),
+				PerUser: l.User.policy(),
+			}
+		}
+	}
+	return limits
+}
+
+// loginLockout returns the lockout policy of the logins set by c.
+func (c rateLimitsConfig) loginLockout() *ratelimit.LockoutPolicy {
+	if c.LoginLockout == nil {
+		return &router.DefaultLoginLockout
+	}
+	return &ratelimit.LockoutPolicy{
+		MaxFailures: c.LoginLockout.MaxFailures,
+		Window:      c.LoginLockout.Window.Duration,
+		Duration:    c.LoginLockout.Duration.Duration,
+	}
+}
+
+func (c rateLimitsConfig) classes() map[string]*classLimitConfig {
+	return map[string]*classLimitConfig{
+		router.ClassAuth:    c.Auth,
+		router.ClassRecycle: c.Recycle,
+		router.ClassVote:    c.Vote,
+		router.ClassWrite:   c.Write,
+	}
+}
+
+// policy returns the policy set by p, which sets no limit if p is nil.
+func (p *policyConfig) policy() ratelimit.Policy {
+	if p == nil {
+		return ratelimit.Policy{}
+	}
+	burst := p.Burst
+	if burst == 0 {
+		burst = p.Requests
+	}
+	return ratelimit.Policy{
+		Rate:  float64(p.Requests) / p.Per.Seconds(),
+		Burst: burst,
+	}
+}
+
+func (c rateLimitsConfig) preventDefault() error {
+	for class, l := range c.classes() {
+		if l == nil {
+			continue
+		}
+		for _, p := range []*policyConfig{l.IP, l.User} {
+			if p == nil {
+				continue
+			}
+			if p.Requests <= 0 || p.Per.Duration <= 0 {
+				return fmt.Errorf("Rate limits of %s routes must set positive requests and per.", class)
+			}
+			if p.Burst < 0 {
+				return fmt.Errorf("Rate limit burst of %s routes must not be negative.", class)
+			}
+		}
+	}
+	if l := c.LoginLockout; l != nil && l.MaxFailures > 0 {
+		if l.Window.Duration <= 0 || l.Duration.Duration <= 0 {
+			return fmt.Errorf("Login lockout window and duration must be positive.")
+		}
+	}
+	return nil
+}
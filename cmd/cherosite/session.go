@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/luisguve/cherosite/internal/pkg/router"
+	"github.com/luisguve/cherosite/internal/pkg/sessionstore"
+)
+
+// sessConfig holds the settings of the session store.
+type sessConfig struct {
+	// Backend is where the sessions are kept: "filesystem", "cookie", "memory"
+	// or "redis". It defaults to "filesystem". Only the cookie and redis
+	// backends can be shared by several instances of the site, the former as
+	// long as they share sess_dir, where the registry of the sessions is kept;
+	// the values of a cookie session must fit in 4KB.
+	Backend string `toml:"backend"`
+	// Dir is the folder where the filesystem backend keeps the sessions. The
+	// filesystem and cookie backends keep the registry of the sessions of the
+	// logged in users in its subfolder "registry".
+	Dir string `toml:"sess_dir"`
+	// Keys are the keys used to sign the cookies.
+	Keys secretKeys `toml:"sess_secret_key"`
+	// Redis holds the settings of the redis backend.
+	Redis redisConfig `toml:"redis"`
+	// Lifetime is the time a user stays logged in after the login, e.g.
+	// "720h". It defaults to router.DefaultSessionLifetime.
+	Lifetime duration `toml:"lifetime"`
+	// IdleTimeout is the time a user stays logged in a session that is not
+	// used, e.g. "168h". It defaults to router.DefaultSessionIdleTimeout; "-1s"
+	// disables it.
+	IdleTimeout duration     `toml:"idle_timeout"`
+	Cookie      cookieConfig `toml:"cookie"`
+}
+
+// cookieConfig holds the attributes of the session cookie.
+type cookieConfig struct {
+	Domain string `toml:"domain"`
+	// Path defaults to "/".
+	Path string `toml:"path"`
+	// HttpOnly hides the cookie from the scripts of the pages. It defaults to
+	// true.
+	HttpOnly *bool `toml:"http_only"`
+	// Secure sends the cookie only over HTTPS. It defaults to true if the site
+	// is served over TLS.
+	Secure *bool `toml:"secure"`
+	// SameSite is either "lax", "strict" or "none". It defaults to "lax".
+	SameSite string `toml:"same_site"`
+}
+
+// sameSiteModes maps the values that can be set in same_site to their values
+// in net/http.
+var sameSiteModes = map[string]http.SameSite{
+	"":       http.SameSiteLaxMode,
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// redisConfig holds the settings of a server that speaks the Redis protocol.
+type redisConfig struct {
+	Address  string `toml:"address"`
+	Password string `toml:"password"`
+	DB       int    `toml:"db"`
+	// Prefix is added to the session ids to make the keys. It defaults to
+	// "cherosite:session:".
+	Prefix string `toml:"prefix"`
+}
+
+// secretKeys holds the secret keys of the sessions. It can be decoded from
+// either a toml string or an array of strings. The first key signs the cookies
+// and every key is tried to verify them, so a key is rotated by adding the new
+// one first and removing the old one once its cookies have expired.
+type secretKeys []string
+
+func (k *secretKeys) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		*k = secretKeys{v}
+		return nil
+	case []interface{}:
+		keys := make(secretKeys, 0, len(v))
+		for _, key := range v {
+			s, ok := key.(string)
+			if !ok {
+				return fmt.Errorf("Session secret keys must be strings.")
+			}
+			keys = append(keys, s)
+		}
+		*k = keys
+		return nil
+	}
+	return fmt.Errorf("Session secret key must be a string or an array of strings.")
+}
+
+// pairs returns the keys as the hash key pairs expected by gorilla/sessions,
+// without block keys.
+func (k secretKeys) pairs() [][]byte {
+	pairs := make([][]byte, 0, 2*len(k))
+	for _, key := range k {
+		pairs = append(pairs, []byte(key), nil)
+	}
+	return pairs
+}
+
+// lifetime returns the absolute lifetime of the sessions set by s.
+func (s sessConfig) lifetime() time.Duration {
+	if s.Lifetime.Duration == 0 {
+		return router.DefaultSessionLifetime
+	}
+	return s.Lifetime.Duration
+}
+
+// cookieOptions returns the options of the session cookie set by s. The cookie
+// lasts as long as the sessions, and it is sent only over HTTPS if tls is set,
+// unless the secure attribute is set.
+func (s sessConfig) cookieOptions(tls bool) *sessions.Options {
+	opts := &sessions.Options{
+		Domain:   s.Cookie.Domain,
+		Path:     s.Cookie.Path,
+		MaxAge:   int(s.lifetime().Seconds()),
+		HttpOnly: true,
+		Secure:   tls,
+		SameSite: sameSiteModes[s.Cookie.SameSite],
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if s.Cookie.HttpOnly != nil {
+		opts.HttpOnly = *s.Cookie.HttpOnly
+	}
+	if s.Cookie.Secure != nil {
+		opts.Secure = *s.Cookie.Secure
+	}
+	return opts
+}
+
+// store returns the session store and the registry of the sessions of the
+// logged in users set up by s. The registry is kept in the backend of the
+// sessions if they are kept on the server, so that it is shared along with
+// them, or in sess_dir if the values of the sessions are kept in the cookies.
+// See cookieOptions for tls.
+func (s sessConfig) store(tls bool) (sessions.Store, sessionstore.Registry, error) {
+	pairs := s.Keys.pairs()
+	opts := s.cookieOptions(tls)
+	switch s.Backend {
+	case "", "filesystem", "cookie":
+		backend, err := sessionstore.NewFileBackend(filepath.Join(s.Dir, "registry"))
+		if err != nil {
+			return nil, nil, err
+		}
+		registry := sessionstore.NewRegistry(backend)
+		if s.Backend == "cookie" {
+			store := sessions.NewCookieStore(pairs...)
+			store.Options = opts
+			store.MaxAge(opts.MaxAge)
+			return store, registry, nil
+		}
+		store := sessions.NewFilesystemStore(s.Dir, pairs...)
+		store.Options = opts
+		store.MaxAge(opts.MaxAge)
+		return store, registry, nil
+	case "memory":
+		backend := sessionstore.NewMemoryBackend()
+		store := sessionstore.New(backend, pairs...)
+		store.Options = opts
+		store.MaxAge(opts.MaxAge)
+		return store, sessionstore.NewRegistry(backend), nil
+	case "redis":
+		prefix := s.Redis.Prefix
+		if prefix == "" {
+			prefix = "cherosite:session:"
+		}
+		backend := sessionstore.NewRedisBackend(sessionstore.RedisOptions{
+			Addr:     s.Redis.Address,
+			Password: s.Redis.Password,
+			DB:       s.Redis.DB,
+			Prefix:   prefix,
+		})
+		store := sessionstore.New(backend, pairs...)
+		store.Options = opts
+		store.MaxAge(opts.MaxAge)
+		return store, sessionstore.NewRegistry(backend), nil
+	}
+	return nil, nil, fmt.Errorf("Unknown session backend %q.", s.Backend)
+}
+
+func (s sessConfig) preventDefault() error {
+	if len(s.Keys) == 0 {
+		return fmt.Errorf("Missing session secret key.")
+	}
+	for _, key := range s.Keys {
+		if key == "" {
+			return fmt.Errorf("Session secret keys must not be empty.")
+		}
+	}
+	if s.Lifetime.Duration < 0 {
+		return fmt.Errorf("Session lifetime must not be negative.")
+	}
+	if _, ok := sameSiteModes[s.Cookie.SameSite]; !ok {
+		return fmt.Errorf("Unsupported session cookie same_site %q.", s.Cookie.SameSite)
+	}
+	switch s.Backend {
+	case "", "filesystem", "cookie":
+		// The registry of the sessions is kept in sess_dir.
+		if s.Dir == "" {
+			return fmt.Errorf("Missing session dir.")
+		}
+	case "memory":
+	case "redis":
+		if s.Redis.Address == "" {
+			return fmt.Errorf("Missing session redis address.")
+		}
+	default:
+		return fmt.Errorf("Unknown session backend %q.", s.Backend)
+	}
+	return nil
+}
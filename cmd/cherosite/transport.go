@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/luisguve/cherosite/internal/pkg/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+)
+
+// grpcTLSConfig holds the settings to connect to a gRPC service over TLS.
+type grpcTLSConfig struct {
+	// CAFile is the PEM bundle of the certificate authorities trusted to sign
+	// the certificate of the service. The system pool is used if it is empty.
+	CAFile string `toml:"ca_file"`
+	// CertFile and KeyFile are the client certificate and key presented to the
+	// service for mutual TLS. Both or none must be set.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// ServerName overrides the name expected in the certificate of the service,
+	// which defaults to the host in the bind address.
+	ServerName string `toml:"server_name"`
+}
+
+// keepaliveConfig holds the keepalive parameters of a connection to a gRPC
+// service.
+type keepaliveConfig struct {
+	// Time is the time after which the connection is pinged if there is no
+	// activity, e.g. "30s".
+	Time duration `toml:"time"`
+	// Timeout is the time waited for a ping to be answered before closing the
+	// connection.
+	Timeout duration `toml:"timeout"`
+	// PermitWithoutStream enables pings even if there are no active requests.
+	PermitWithoutStream bool `toml:"permit_without_stream"`
+}
+
+func (t grpcTLSConfig) preventDefault(srvName string) error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("Both cert file and key file of %s must be set for mutual TLS.", srvName)
+	}
+	return nil
+}
+
+func (k keepaliveConfig) preventDefault(srvName string) error {
+	if k.Time.Duration < 0 || k.Timeout.Duration < 0 {
+		return fmt.Errorf("Keepalive parameters of %s must not be negative.", srvName)
+	}
+	return nil
+}
+
+// transportPreventDefault checks the transport settings of the connection to
+// the service named srvName, if any.
+func transportPreventDefault(srvName string, t *grpcTLSConfig, k *keepaliveConfig) error {
+	if t != nil {
+		if err := t.preventDefault(srvName); err != nil {
+			return err
+		}
+	}
+	if k != nil {
+		return k.preventDefault(srvName)
+	}
+	return nil
+}
+
+// dialOptions returns the options to dial the gRPC service named backend with
+// the given transport settings. The connection is insecure if t is nil, and the
+// default keepalive parameters of grpc are used if k is nil. The calls to the
+// service are recorded in the metrics under the name of the backend.
+func dialOptions(backend string, t *grpcTLSConfig, k *keepaliveConfig) ([]grpc.DialOption, error) {
+	opts := []grpc.DialOption{
+		grpc.WithUnaryInterceptor(metrics.UnaryClientInterceptor(backend)),
+		grpc.WithStreamInterceptor(metrics.StreamClientInterceptor(backend)),
+	}
+	if t == nil {
+		opts = append(opts, grpc.WithInsecure())
+	} else {
+		tlsConf, err := t.clientConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConf)))
+	}
+	if k != nil {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                k.Time.Duration,
+			Timeout:             k.Timeout.Duration,
+			PermitWithoutStream: k.PermitWithoutStream,
+		}))
+	}
+	return opts, nil
+}
+
+// clientConfig loads the certificates and returns the TLS configuration of the
+// connection.
+func (t grpcTLSConfig) clientConfig() (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		ServerName: t.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA file %s.", t.CAFile)
+		}
+		tlsConf.RootCAs = pool
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client certificate: %v", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPKI holds the files of a self-signed CA and of a server and a client
+// certificate signed by it.
+type testPKI struct {
+	caFile                string
+	serverCert, serverKey string
+	clientCert, clientKey string
+}
+
+const testServerName = "sections.cherosite.test"
+
+func newTestPKI(t *testing.T) testPKI {
+	t.Helper()
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cherosite test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTpl, caTpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki := testPKI{caFile: filepath.Join(dir, "ca.pem")}
+	writePEM(t, pki.caFile, "CERTIFICATE", caDER)
+
+	leaf := func(name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certFile := filepath.Join(dir, name+".pem")
+		keyFile := filepath.Join(dir, name+".key")
+		writePEM(t, certFile, "CERTIFICATE", der)
+		writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+		return certFile, keyFile
+	}
+	pki.serverCert, pki.serverKey = leaf(testServerName, 2, x509.ExtKeyUsageServerAuth)
+	pki.clientCert, pki.clientKey = leaf("cherosite", 3, x509.ExtKeyUsageClientAuth)
+	return pki
+}
+
+func writePEM(t *testing.T, file, kind string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveTLS accepts TLS connections on a local address with the server
+// certificate, requiring a client certificate signed by the CA, and returns
+// the address.
+func serveTLS(t *testing.T, pki testPKI) string {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(pki.serverCert, pki.serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := ioutil.ReadFile(pki.caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// Keep the connection open until the client closes it.
+				if err := conn.(*tls.Conn).Handshake(); err == nil {
+					io.Copy(ioutil.Discard, conn)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// handshake dials addr with the TLS configuration and completes the handshake.
+func handshake(addr string, conf *tls.Config) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, conf)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// The server verifies the client certificate after the client finishes its
+	// side of the handshake, and reports failures on the next read.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	return err
+}
+
+func TestClientConfigMutualTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := serveTLS(t, pki)
+
+	conf := grpcTLSConfig{
+		CAFile:     pki.caFile,
+		CertFile:   pki.clientCert,
+		KeyFile:    pki.clientKey,
+		ServerName: testServerName,
+	}
+	tlsConf, err := conf.clientConfig()
+	if err != nil {
+		t.Fatalf("clientConfig: %v", err)
+	}
+	if tlsConf.ServerName != testServerName {
+		t.Errorf("ServerName = %q, want %q", tlsConf.ServerName, testServerName)
+	}
+	if tlsConf.RootCAs == nil || len(tlsConf.Certificates) != 1 {
+		t.Fatalf("CA pool or client certificate not loaded")
+	}
+	if err := handshake(addr, tlsConf); err != nil {
+		t.Errorf("handshake with server_name and client certificate: %v", err)
+	}
+
+	// The certificate of the service does not match the wrong name.
+	wrongName := conf
+	wrongName.ServerName = "other.cherosite.test"
+	tlsConf, err = wrongName.clientConfig()
+	if err != nil {
+		t.Fatalf("clientConfig: %v", err)
+	}
+	if err := handshake(addr, tlsConf); err == nil {
+		t.Error("handshake with the wrong server_name succeeded")
+	}
+
+	// The service requires the client certificate.
+	noCert := conf
+	noCert.CertFile, noCert.KeyFile = "", ""
+	tlsConf, err = noCert.clientConfig()
+	if err != nil {
+		t.Fatalf("clientConfig: %v", err)
+	}
+	if err := handshake(addr, tlsConf); err == nil {
+		t.Error("handshake without client certificate succeeded")
+	}
+}
+
+func TestClientConfigErrors(t *testing.T) {
+	pki := newTestPKI(t)
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	if err := ioutil.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	tests := []struct {
+		name string
+		conf grpcTLSConfig
+	}{
+		{"missing CA file", grpcTLSConfig{CAFile: missing}},
+		{"invalid CA file", grpcTLSConfig{CAFile: garbage}},
+		{"missing cert file", grpcTLSConfig{CertFile: missing, KeyFile: pki.clientKey}},
+		{"missing key file", grpcTLSConfig{CertFile: pki.clientCert, KeyFile: missing}},
+		{"invalid key file", grpcTLSConfig{CertFile: pki.clientCert, KeyFile: garbage}},
+		{"key of another certificate", grpcTLSConfig{CertFile: pki.clientCert, KeyFile: pki.serverKey}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.conf.clientConfig(); err == nil {
+				t.Error("clientConfig succeeded")
+			}
+			// dialOptions must fail rather than fall back to an insecure
+			// connection.
+			if opts, err := dialOptions("sections", &tt.conf, nil); err == nil {
+				t.Errorf("dialOptions succeeded with %d options", len(opts))
+			}
+		})
+	}
+}
+
+func TestTransportPreventDefault(t *testing.T) {
+	tests := []struct {
+		name    string
+		tls     *grpcTLSConfig
+		ka      *keepaliveConfig
+		wantErr bool
+	}{
+		{"none", nil, nil, false},
+		{"CA only", &grpcTLSConfig{CAFile: "ca.pem"}, nil, false},
+		{"cert and key", &grpcTLSConfig{CertFile: "c.pem", KeyFile: "c.key"}, nil, false},
+		{"cert without key", &grpcTLSConfig{CertFile: "c.pem"}, nil, true},
+		{"key without cert", &grpcTLSConfig{KeyFile: "c.key"}, nil, true},
+		{"negative keepalive", nil, &keepaliveConfig{Time: duration{-time.Second}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := transportPreventDefault("sections", tt.tls, tt.ka)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
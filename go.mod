@@ -6,8 +6,10 @@ require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/golang/protobuf v1.4.2
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/securecookie v1.1.1
 	github.com/gorilla/sessions v1.2.1
 	github.com/gorilla/websocket v1.4.2
 	github.com/luisguve/cheroproto-go v0.0.0-20200904212122-403adca09ee8
+	github.com/prometheus/client_golang v1.12.2
 	google.golang.org/grpc v1.32.0
 )
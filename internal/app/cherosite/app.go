@@ -1,14 +1,94 @@
 package cherosite
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"net"
 	"net/http"
 	"time"
+
+	"github.com/luisguve/cherosite/internal/pkg/logging"
 )
 
+// TLSConfig holds the settings to serve over TLS.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// MinVersion is the minimum TLS version accepted, e.g. tls.VersionTLS12.
+	MinVersion uint16
+	// RedirectAddr is the address of a plain HTTP listener that redirects every
+	// request to HTTPS. No listener is started if it is empty.
+	RedirectAddr string
+}
+
+// ServeMetrics makes the App serve h, the handler of the metrics, on a separate
+// plain HTTP listener at addr, e.g. a private address.
+func (a *App) ServeMetrics(addr string, h http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", h)
+	a.metrics = &http.Server{
+		Handler:      mux,
+		Addr:         addr,
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+}
+
+// Run listens and serves until the server is shut down, in which case it returns
+// nil. If TLS is enabled, it serves HTTPS, with HTTP/2 support, and the redirect
+// listener if any. The metrics listener, if any, is served as well.
 func (a *App) Run() error {
-	log.Printf("Running. Open %s in the browser.\n", a.srv.Addr)
-	return a.srv.ListenAndServe()
+	errc := make(chan error, 3)
+	servers := 1
+	if a.metrics != nil {
+		servers++
+		go func() {
+			logging.Default().Info("Serving metrics", "url", "http://"+a.metrics.Addr+"/metrics")
+			errc <- ignoreClosed(a.metrics.ListenAndServe())
+		}()
+	}
+	if a.tls == nil {
+		go func() {
+			logging.Default().Info("Running", "url", "http://"+a.srv.Addr)
+			errc <- ignoreClosed(a.srv.ListenAndServe())
+		}()
+	} else {
+		if a.redirect != nil {
+			servers++
+			go func() {
+				logging.Default().Info("Redirecting HTTP requests to HTTPS", "addr", a.redirect.Addr)
+				errc <- ignoreClosed(a.redirect.ListenAndServe())
+			}()
+		}
+		go func() {
+			logging.Default().Info("Running", "url", "https://"+a.srv.Addr)
+			errc <- ignoreClosed(a.srv.ListenAndServeTLS(a.tls.CertFile, a.tls.KeyFile))
+		}()
+	}
+	// Either all of them return nil on shutdown or one of them failed.
+	for i := 0; i < servers; i++ {
+		if err := <-errc; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown stops accepting new connections and waits for the requests in flight
+// to be replied or for ctx to be done, whichever happens first. Hijacked
+// connections, such as websockets, are not waited for.
+func (a *App) Shutdown(ctx context.Context) error {
+	if a.redirect != nil {
+		if err := a.redirect.Shutdown(ctx); err != nil {
+			logging.Default().Error("Could not shut down redirect listener", "err", err)
+		}
+	}
+	if a.metrics != nil {
+		if err := a.metrics.Shutdown(ctx); err != nil {
+			logging.Default().Error("Could not shut down metrics listener", "err", err)
+		}
+	}
+	return a.srv.Shutdown(ctx)
 }
 
 func New(h http.Handler, bindAddr string) *App {
@@ -23,6 +103,61 @@ func New(h http.Handler, bindAddr string) *App {
 	}
 }
 
+// NewTLS returns an App that serves h over TLS on bindAddr with the given
+// settings.
+func NewTLS(h http.Handler, bindAddr string, conf TLSConfig) *App {
+	a := New(h, bindAddr)
+	a.tls = &conf
+	a.srv.TLSConfig = &tls.Config{
+		MinVersion: conf.MinVersion,
+	}
+	if conf.RedirectAddr != "" {
+		_, port, err := net.SplitHostPort(bindAddr)
+		if err != nil {
+			panic(err)
+		}
+		a.redirect = &http.Server{
+			Handler:      redirectToHTTPS(port),
+			Addr:         conf.RedirectAddr,
+			WriteTimeout: 5 * time.Second,
+			ReadTimeout:  5 * time.Second,
+		}
+	}
+	return a
+}
+
+// redirectToHTTPS returns a handler that permanently redirects requests to the
+// same host and URI on the given HTTPS port.
+func redirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			// The Host header has no port.
+			host = req.Host
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		url := "https://" + host + req.URL.RequestURI()
+		http.Redirect(w, req, url, http.StatusMovedPermanently)
+	})
+}
+
+// ignoreClosed returns nil if err is the error returned by the Listen methods of
+// a server after being shut down.
+func ignoreClosed(err error) error {
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
 type App struct {
 	srv *http.Server
+	// tls is nil if the App serves plain HTTP.
+	tls *TLSConfig
+	// redirect is the plain HTTP server that redirects to HTTPS, if any.
+	redirect *http.Server
+	// metrics is the plain HTTP server of the metrics, if any.
+	metrics *http.Server
 }
@@ -0,0 +1,157 @@
+package livedata
+
+import (
+	"errors"
+	"sync"
+
+	pbDataFormat "github.com/luisguve/cheroproto-go/dataformat"
+	"github.com/luisguve/cherosite/internal/pkg/metrics"
+)
+
+// Bus carries the messages of the hubs of every instance of the site to all of
+// them, so that the notifications, the acks and the events reach the
+// connections of a user regardless of the instance that holds them. A hub
+// publishes every message to its bus and delivers the ones it receives from
+// it, its own messages included.
+type Bus interface {
+	// Publish sends the message to every subscriber of the bus.
+	Publish(msg *Message) error
+	// Subscribe returns a channel that receives the messages published from
+	// then on, until the bus is closed.
+	Subscribe() <-chan *Message
+	// Close stops the delivery of the messages and releases the resources of
+	// the bus.
+	Close() error
+}
+
+// ErrBusClosed is returned by the buses that are published to after Close.
+var ErrBusClosed = errors.New("livedata: bus closed")
+
+// Message is a message carried by a Bus: either a notification for a user, an
+// ack for every connection of a user, an event of a topic or the kick of
+// connections of a user.
+type Message struct {
+	UserId string              `json:"user_id,omitempty"`
+	Notif  *pbDataFormat.Notif `json:"notif,omitempty"`
+	Ack    *Ack                `json:"ack,omitempty"`
+	Event  *Event              `json:"event,omitempty"`
+	Kick   *Kick               `json:"kick,omitempty"`
+	// Skip is the Skip of the event, which is not encoded along with it.
+	Skip string `json:"skip,omitempty"`
+}
+
+// Kick closes the connections of a user opened with Session, or all of them if
+// it is empty; see Hub.Kick.
+type Kick struct {
+	Session string `json:"session,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// subscriberQueueSize is the number of messages queued per subscriber of a bus.
+const subscriberQueueSize = 64
+
+// fanout sends the messages received by a bus to its subscribers.
+type fanout struct {
+	mu   sync.Mutex
+	subs []chan *Message
+	done chan struct{}
+	once sync.Once
+}
+
+func newFanout() *fanout {
+	return &fanout{done: make(chan struct{})}
+}
+
+func (f *fanout) subscribe() <-chan *Message {
+	sub := make(chan *Message, subscriberQueueSize)
+	f.mu.Lock()
+	f.subs = append(f.subs, sub)
+	f.mu.Unlock()
+	return sub
+}
+
+// send sends the message to every subscriber, waiting for the ones whose queue
+// is full, unless the bus is closed.
+func (f *fanout) send(msg *Message) error {
+	f.mu.Lock()
+	subs := f.subs
+	f.mu.Unlock()
+	for _, sub := range subs {
+		select {
+		case sub <- msg:
+		case <-f.done:
+			return ErrBusClosed
+		}
+	}
+	return nil
+}
+
+func (f *fanout) close() {
+	f.once.Do(func() {
+		close(f.done)
+	})
+}
+
+// MemoryBus is a Bus within a process. It is the bus of the hubs that set
+// none, which is enough for a single instance of the site.
+type MemoryBus struct {
+	f *fanout
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{f: newFanout()}
+}
+
+func (b *MemoryBus) Publish(msg *Message) error {
+	return b.f.send(msg)
+}
+
+func (b *MemoryBus) Subscribe() <-chan *Message {
+	return b.f.subscribe()
+}
+
+func (b *MemoryBus) Close() error {
+	b.f.close()
+	return nil
+}
+
+// send publishes the message to the bus of the hub, unless the hub is shutting
+// down.
+func (h *Hub) send(msg *Message) {
+	select {
+	case <-h.quit:
+		return
+	default:
+	}
+	if err := h.bus.Publish(msg); err != nil {
+		metrics.BusErrors.Inc()
+		h.log.Error("Could not publish to the live notifications bus", "user", msg.UserId,
+			"err", err)
+	}
+}
+
+// receive delivers a message of the bus to the connections it is for. It must
+// only be called by Run.
+func (h *Hub) receive(msg *Message) {
+	switch {
+	case msg.Notif != nil:
+		h.notify(msg.UserId)
+		for user := range h.onlineUsers[msg.UserId] {
+			h.enqueue(user, msg.Notif)
+		}
+	case msg.Ack != nil:
+		h.deliver(result{user: &User{Id: msg.UserId}, sync: true, ack: *msg.Ack})
+	case msg.Event != nil:
+		event := *msg.Event
+		event.Skip = msg.Skip
+		h.publish(&event)
+	case msg.Kick != nil:
+		for user := range h.onlineUsers[msg.UserId] {
+			if msg.Kick.Session == "" || user.Session == msg.Kick.Session {
+				user.closeReason = msg.Kick.Reason
+				metrics.KickedConns.Inc()
+				h.remove(user)
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package livedata
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/luisguve/cherosite/internal/pkg/resp/resptest"
+)
+
+// newTestBuses returns the buses of two instances of the site: either a single
+// MemoryBus shared by both, or a RedisBus for each one on the same channel of a
+// fake server.
+func newTestBuses(t *testing.T, kind string) (Bus, Bus) {
+	t.Helper()
+	if kind == "memory" {
+		bus := NewMemoryBus()
+		t.Cleanup(func() { bus.Close() })
+		return bus, bus
+	}
+	s, err := resptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	opts := RedisOptions{Addr: s.Addr, Timeout: time.Second}
+	a := NewRedisBus(opts, nil)
+	b := NewRedisBus(opts, nil)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	// The buses subscribe in the background.
+	deadline := time.Now().Add(testWait)
+	for s.Subscribers(DefaultRedisChannel) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("buses not subscribed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return a, b
+}
+
+func TestHubsShareBus(t *testing.T) {
+	for _, kind := range []string{"memory", "redis"} {
+		t.Run(kind, func(t *testing.T) {
+			busA, busB := newTestBuses(t, kind)
+			a := newTestHub(t, Options{Bus: busA})
+			b := newTestHub(t, Options{Bus: busB})
+			onA := a.connect("u1", true)
+			onB := b.connect("u1", true)
+			otherOnB := b.connect("u2", true)
+			flushBoth := func() {
+				a.flush(t)
+				b.flush(t)
+			}
+
+			// Notifications reach the connections of the user on both.
+			a.Broadcast("u1", notif("n1", 1))
+			b.Broadcast("u1", notif("n2", 2))
+			flushBoth()
+			for _, c := range []*testConn{onA, onB} {
+				got := c.expect(t, 2)
+				if got[0].Id != "n1" || got[1].Id != "n2" {
+					t.Errorf("notifications = %s, %s; want n1, n2", got[0].Id, got[1].Id)
+				}
+			}
+			otherOnB.none(t)
+
+			// So do the acks synced across the connections.
+			b.Acknowledge("u1", Ack{For: TypeClear, Ok: true})
+			flushBoth()
+			for _, c := range []*testConn{onA, onB} {
+				if ack := c.expectAck(t); ack.For != TypeClear || !ack.Ok {
+					t.Errorf("ack = %+v", ack)
+				}
+			}
+
+			// And the events of the topics.
+			topic := SectionTopic("s")
+			a.requests <- request{user: onA.User, msg: clientMessage{Type: TypeSubscribe, Topic: topic}}
+			onA.expectAck(t)
+			b.Publish(&Event{Topic: topic, Name: "counters"})
+			select {
+			case event := <-onA.events:
+				if event.Topic != topic || event.Name != "counters" {
+					t.Errorf("event = %+v", event)
+				}
+			case <-time.After(testWait):
+				t.Fatal("event of the other hub not delivered")
+			}
+
+			// Kicks close the connections on the other hub.
+			a.Kick("u2", "", "logged out")
+			flushBoth()
+			if !otherOnB.closed() || otherOnB.User.closeReason != "logged out" {
+				t.Error("connection on the other hub not kicked")
+			}
+			if onA.closed() || onB.closed() {
+				t.Error("connections of another user kicked")
+			}
+		})
+	}
+}
+
+func TestRedisBusConcurrentPublish(t *testing.T) {
+	busA, busB := newTestBuses(t, "redis")
+	sub := busB.Subscribe()
+	const publishers, each = 8, 20
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				msg := &Message{UserId: fmt.Sprint("u", p), Notif: notif("n", i)}
+				if err := busA.Publish(msg); err != nil {
+					t.Errorf("Publish: %v", err)
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	next := make([]int, publishers)
+	for n := 0; n < publishers*each; n++ {
+		select {
+		case msg := <-sub:
+			var p int
+			fmt.Sscanf(msg.UserId, "u%d", &p)
+			// The messages of every publisher keep their order.
+			if msg.Notif.Message != fmt.Sprint(next[p]) {
+				t.Errorf("message %s of %s, want %d", msg.Notif.Message, msg.UserId, next[p])
+			}
+			next[p]++
+		case <-time.After(testWait):
+			t.Fatalf("received %d of %d messages", n, publishers*each)
+		}
+	}
+	redis := busA.(*RedisBus)
+	redis.mu.Lock()
+	idle := len(redis.pubs)
+	redis.mu.Unlock()
+	if idle == 0 || idle > busMaxIdle {
+		t.Errorf("%d idle connections, want 1 to %d", idle, busMaxIdle)
+	}
+
+	busA.Close()
+	if err := busA.Publish(&Message{UserId: "u1"}); err != ErrBusClosed {
+		t.Errorf("Publish after Close = %v, want %v", err, ErrBusClosed)
+	}
+}
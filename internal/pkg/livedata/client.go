@@ -2,8 +2,6 @@ package livedata
 
 import (
 	"encoding/json"
-	"log"
-	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,10 +14,28 @@ type Client struct {
 	User *User
 }
 
+// User is a connection of a user to the hub. A user connected from several
+// devices has a User for every one of them.
 type User struct {
-	Id        string
+	Id string
+	// Session is the id of the session the connection was opened with, so that
+	// the connection is closed along with the session; see Hub.Kick.
+	Session   string
 	SendNotif chan *pbDataFormat.Notif
-	SendOk    chan bool
+	SendAck   chan Ack
+	SendEvent chan *Event
+	// topics are the topics the connection is subscribed to. It is only
+	// accessed by Run.
+	topics map[string]bool
+	// done is closed once the connection is unregistered, and closeReason is
+	// set before if the hub kicked it.
+	done        chan struct{}
+	closeReason string
+}
+
+// Done returns a channel that is closed once the connection is unregistered.
+func (u *User) Done() <-chan struct{} {
+	return u.done
 }
 
 const (
@@ -33,7 +49,10 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 8
+	maxMessageSize = 4096
+
+	// Number of acks queued per connection.
+	ackQueueSize = 8
 
 	// Maximum buffer size for read
 	ReadBufferSize = 1024
@@ -42,9 +61,11 @@ const (
 	WriteBufferSize = 1024
 )
 
+// ReadPump reads the messages of the client and passes them to the hub until the
+// connection is closed. See the protocol at TypeNotif.
 func (c *Client) ReadPump() {
 	defer func() {
-		c.Hub.Unregister <- c.User.Id
+		c.Hub.Unregister <- c.User
 		c.Conn.Close()
 	}()
 
@@ -56,99 +77,116 @@ func (c *Client) ReadPump() {
 	})
 
 	for {
-		_, _, err := c.Conn.ReadMessage()
+		_, data, err := c.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v\n", err)
+				c.Hub.log.Error("Websocket error", "user", c.User.Id, "err", err)
 			}
 			break
 		}
-		c.Hub.ReadAllFromUser <- c.User.Id
+		var msg clientMessage
+		if err = json.Unmarshal(data, &msg); err != nil {
+			// It is replied as an invalid message.
+			msg = clientMessage{}
+		}
+		c.Hub.requests <- request{user: c.User, msg: msg}
+	}
+}
+
+// Resume replays the notifications of the user after since to the client, as
+// a resume_since message would. The client must be registered.
+func (c *Client) Resume(since time.Time) {
+	c.Hub.requests <- request{
+		user: c.User,
+		msg:  clientMessage{Type: TypeResumeSince, Since: since},
 	}
 }
 
+// Subscribe subscribes the client to the events of the given topic, as a
+// subscribe message would. The client must be registered.
+func (c *Client) Subscribe(topic string) {
+	c.Hub.requests <- request{
+		user: c.User,
+		msg:  clientMessage{Type: TypeSubscribe, Topic: topic},
+	}
+}
+
+// WritePump writes the notifications, acks and events queued for the client,
+// and the pings, until the hub unregisters it.
 func (c *Client) WritePump() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.Conn.Close()
+		c.Hub.pumps.Done()
 	}()
+	acks, events := c.User.SendAck, c.User.SendEvent
 	for {
 		select {
 		case notif, ok := <-c.User.SendNotif:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+				c.Conn.WriteMessage(websocket.CloseMessage, c.Hub.closeMessage(c.User))
 				return
 			}
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				log.Printf("error: %v\n", err)
+			notifs := append([]*pbDataFormat.Notif{notif}, drain(c.User.SendNotif)...)
+			if err := c.writeNotifs(notifs); err != nil {
+				c.Hub.log.Error("Websocket error", "user", c.User.Id, "err", err)
 				return
 			}
-			notifJSON, err := json.Marshal(notif)
-			if err != nil {
-				log.Printf("error: %v\n", err)
-				return
+		case ack, ok := <-acks:
+			if !ok {
+				// The hub closed the channel; SendNotif is closed as well.
+				acks = nil
+				continue
 			}
-			w.Write(notifJSON)
-			if len(c.User.SendNotif) >= 1 {
-				notifsJSON := mergeNotifs(c.User.SendNotif)
-				for _, notifJSON = range notifsJSON {
-					w.Write(notifJSON)
-				}
+			// The notifications replayed for a request are queued before
+			// its ack, so they are written first.
+			if err := c.writeNotifs(drain(c.User.SendNotif)); err != nil {
+				c.Hub.log.Error("Websocket error", "user", c.User.Id, "err", err)
+				return
 			}
-			if err = w.Close(); err != nil {
-				log.Printf("Error: %v\n", err)
+			if err := c.writeJSON(ackMessage{Type: TypeAck, Ack: ack}); err != nil {
+				c.Hub.log.Error("Websocket error", "user", c.User.Id, "err", err)
 				return
 			}
-		case ok := <-c.User.SendOk:
-			result := strconv.FormatBool(ok)
-			msg := []byte(`{"ok":"` + result + `"}`)
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.Conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-				log.Printf("Error: %v\n", err)
+		case event, ok := <-events:
+			if !ok {
+				// The hub closed the channel; SendNotif is closed as well.
+				events = nil
+				continue
+			}
+			if err := c.writeJSON(eventMessage{Type: TypeEvent, Event: event}); err != nil {
+				c.Hub.log.Error("Websocket error", "user", c.User.Id, "err", err)
+				return
 			}
 		case <-ticker.C:
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.Conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
-				log.Printf("Error: %v\n", err)
+				c.Hub.log.Error("Websocket error", "user", c.User.Id, "err", err)
 			}
 		}
 	}
 }
 
-// mergeNotifs receives notifications from the buffered channel and discards all
-// the notifications (type *pbDataFormat.Notif) with the same ID but the last
-// notification, then marshals the resulting notifications into JSON []byte, using
-// Marshal from encoding/json and returns a []byte for each notification.
-func mergeNotifs(receive chan *pbDataFormat.Notif) (notifsJSON [][]byte) {
-	n := len(receive)
-	notifs := []*pbDataFormat.Notif{}
-	// fill notifs slice
-	for i := 0; i < n; i++ {
-		notifs = append(notifs, <-receive)
-	}
-	// merged will contain only the last duplicate notif, if there are duplicates
-	merged := make(map[string]*pbDataFormat.Notif)
-	for _, notif := range notifs {
-		merged[notif.Id] = notif
-	}
-	// empty notifs slice
-	notifs = []*pbDataFormat.Notif{}
-	// fill again notifs slice
-	for _, notif := range merged {
-		notifs = append(notifs, notif)
-	}
-	// marshal into JSON and fill slice of JSON notifs
-	for _, notif := range notifs {
-		notifJSON, err := json.Marshal(notif)
-		if err != nil {
-			log.Printf("Could not marshal notif: %v\n", err)
-			continue
+// writeNotifs discards all the notifications with the same ID but the last
+// notification and writes the rest, every one of them in its own message.
+func (c *Client) writeNotifs(notifs []*pbDataFormat.Notif) error {
+	for _, notif := range coalesce(notifs) {
+		if err := c.writeJSON(notifMessage{Type: TypeNotif, Notif: notif}); err != nil {
+			return err
 		}
-		notifsJSON = append(notifsJSON, notifJSON)
 	}
-	return
+	return nil
+}
+
+// writeJSON writes v to the client as a JSON text message.
+func (c *Client) writeJSON(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.Conn.WriteMessage(websocket.TextMessage, msg)
 }
@@ -2,82 +2,308 @@ package livedata
 
 import (
 	"context"
-	"log"
+	"sync"
+	"time"
 
+	"github.com/gorilla/websocket"
 	pbUsers "github.com/luisguve/cheroproto-go/userapi"
 	pbDataFormat "github.com/luisguve/cheroproto-go/dataformat"
+	"github.com/luisguve/cherosite/internal/pkg/logging"
+	"github.com/luisguve/cherosite/internal/pkg/metrics"
 )
 
 // Hub maintains the set of active users and is responsible for broadcasting
 // notifications to the users they are intended for and for marking the
-// notifications as read when  users ask so.
+// notifications as read when  users ask so. A user may be connected from
+// several devices or tabs at once, each of them registered as a separate *User
+// with the same id. Connections may also subscribe to the events of the threads
+// and sections being viewed; see TypeEvent.
 type Hub struct {
-	// onlineUsers is the collection of users that are currently active.
-	onlineUsers map[string]*User
+	// onlineUsers is the collection of users that are currently active, by id,
+	// along with the connections of every one of them.
+	onlineUsers map[string]map[*User]bool
 
-	// Register is a channel for registering users in the onlineUsers collection.
+	// Register is a channel for registering the connection of a user in the
+	// onlineUsers collection.
 	Register chan *User
 
-	// Unregister is a channel for unregistering users in the onlineUsers collection.
-	Unregister chan string
+	// Unregister is a channel for unregistering the connection of a user in the
+	// onlineUsers collection. The rest of the connections of the user remain
+	// registered.
+	Unregister chan *User
 
-	// ReadAllFromUser is a channel that marks all the notifications of the given
-	// user as read.
-	ReadAllFromUser chan string
+	// bus carries the notifications, the acks of the requests synced across the
+	// connections of a user and the events of the topics, so that they reach
+	// the hubs of every instance of the site; messages receives them to be
+	// delivered by Run, the only goroutine that accesses onlineUsers.
+	bus      Bus
+	messages <-chan *Message
+
+	// requests receives the messages of the clients, which are handled in their
+	// own goroutines, and results receives their results to be sent by Run.
+	requests chan request
+	results  chan result
+
+	// topics is the collection of the connections subscribed to every topic.
+	topics map[string]map[*User]bool
 
 	// Client to perform user-related crud operations, mostly involving notification
 	// management.
 	usersClient pbUsers.CrudUsersClient
+
+	// timeout is the deadline for the requests to the users service.
+	timeout time.Duration
+
+	log *logging.Logger
+
+	// queueSize and policy are the size of the queue of notifications of every
+	// connection and what to do when it is full.
+	queueSize int
+	policy    QueuePolicy
+
+	// notified holds the last time the hub received a notification for every
+	// user within resumeWindow, and started the time the hub started keeping
+	// it; see upToDate. Only Run accesses them.
+	notified map[string]time.Time
+	started  time.Time
+	pruned   time.Time
+
+	// quit is closed when the hub is shutting down.
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	// pumps counts the write pumps of the registered users that have not
+	// returned yet.
+	pumps pumpGroup
+}
+
+// pumpGroup counts the write pumps that have not returned yet. Unlike a
+// sync.WaitGroup, pumps may be added while it is waited for, as the ones of the
+// users registered during Shutdown are.
+type pumpGroup struct {
+	mu sync.Mutex
+	n  int
+	// idle is closed while n is zero.
+	idle chan struct{}
+}
+
+func (g *pumpGroup) Add(delta int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.n == 0 && delta > 0 {
+		g.idle = make(chan struct{})
+	}
+	g.n += delta
+	switch {
+	case g.n < 0:
+		panic("livedata: negative pump count")
+	case g.n == 0 && g.idle != nil:
+		close(g.idle)
+	}
+}
+
+func (g *pumpGroup) Done() {
+	g.Add(-1)
+}
+
+// Wait returns a channel that is closed once no pump is running.
+func (g *pumpGroup) Wait() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.idle == nil {
+		g.idle = make(chan struct{})
+		close(g.idle)
+	}
+	return g.idle
 }
 
-func NewHub(client pbUsers.CrudUsersClient) *Hub {
+func NewHub(client pbUsers.CrudUsersClient, timeout time.Duration, log *logging.Logger,
+	opts Options) *Hub {
+	if log == nil {
+		log = logging.Default()
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.Bus == nil {
+		opts.Bus = NewMemoryBus()
+	}
 	return &Hub{
-		onlineUsers:     make(map[string]*User),
-		Register:        make(chan *User),
-		Unregister:      make(chan string),
-		ReadAllFromUser: make(chan string),
-		usersClient:     client,
+		onlineUsers: make(map[string]map[*User]bool),
+		Register:    make(chan *User),
+		Unregister:  make(chan *User),
+		bus:         opts.Bus,
+		messages:    opts.Bus.Subscribe(),
+		requests:    make(chan request),
+		results:     make(chan result),
+		topics:      make(map[string]map[*User]bool),
+		usersClient: client,
+		timeout:     timeout,
+		log:         log,
+		queueSize:   opts.QueueSize,
+		policy:      opts.QueuePolicy,
+		notified:    make(map[string]time.Time),
+		started:     time.Now(),
+		quit:        make(chan struct{}),
 	}
 }
 
 // Run continuously listens for user registering/unregistering messages
 func (h *Hub) Run() {
+	quit := h.quit
+	closed := false
 	for {
 		select {
+		case <-quit:
+			// Close the connections of every user; their write pumps send the
+			// close frames.
+			for _, conns := range h.onlineUsers {
+				for user := range conns {
+					h.remove(user)
+				}
+			}
+			closed = true
+			quit = nil
 		case user := <-h.Register:
-			h.onlineUsers[user.Id] = user
-		case userId := <-h.Unregister:
-			if user, ok := h.onlineUsers[userId]; ok {
-				delete(h.onlineUsers, userId)
+			h.pumps.Add(1)
+			if closed {
 				close(user.SendNotif)
-				close(user.SendOk)
+				close(user.SendAck)
+				close(user.SendEvent)
+				close(user.done)
+				continue
+			}
+			conns, ok := h.onlineUsers[user.Id]
+			if !ok {
+				conns = make(map[*User]bool)
+				h.onlineUsers[user.Id] = conns
 			}
-		case userId := <-h.ReadAllFromUser:
-			if user, ok := h.onlineUsers[userId]; ok {
-				go h.markAllAsRead(userId, user.SendOk)
+			conns[user] = true
+		case user := <-h.Unregister:
+			if h.onlineUsers[user.Id][user] {
+				h.remove(user)
 			}
+		case msg := <-h.messages:
+			h.receive(msg)
+		case req := <-h.requests:
+			if !h.onlineUsers[req.user.Id][req.user] {
+				break
+			}
+			switch {
+			case req.msg.Type == TypeSubscribe || req.msg.Type == TypeUnsubscribe:
+				h.subscribe(req)
+			case req.msg.Type == TypeResumeSince && h.upToDate(req.user.Id, req.msg.Since):
+				// There is nothing to replay.
+				h.deliver(result{user: req.user, ack: Ack{For: TypeResumeSince, Ok: true}})
+			default:
+				go h.handle(req)
+			}
+		case res := <-h.results:
+			h.deliver(res)
+		}
+		users := len(h.onlineUsers)
+		if _, ok := h.onlineUsers[""]; ok {
+			// The streams of anonymous users are not counted as a user.
+			users--
 		}
+		metrics.OnlineUsers.Set(float64(users))
+		metrics.OnlineConns.Set(float64(h.conns()))
 	}
 }
 
-func (h *Hub) Broadcast(userId string, notif *pbDataFormat.Notif) {
-	// Check whether the user is online.
-	if user, ok := h.onlineUsers[userId]; ok {
-		select {
-		case user.SendNotif <- notif:
-		default:
-			// The user connection is stuck or dead. Proceed to remove this user.
-			h.Unregister <- userId
-		}
+// remove unregisters the given connection of a user, unsubscribes it from its
+// topics and closes its channels. The user is removed from onlineUsers along
+// with its last connection.
+func (h *Hub) remove(user *User) {
+	conns := h.onlineUsers[user.Id]
+	delete(conns, user)
+	if len(conns) == 0 {
+		delete(h.onlineUsers, user.Id)
+	}
+	for topic := range user.topics {
+		h.unsubscribe(user, topic)
+	}
+	close(user.SendNotif)
+	close(user.SendAck)
+	close(user.SendEvent)
+	close(user.done)
+}
+
+// conns returns the number of registered connections.
+func (h *Hub) conns() int {
+	n := 0
+	for _, conns := range h.onlineUsers {
+		n += len(conns)
+	}
+	return n
+}
+
+// Shutdown closes the connections of every registered user with a going away
+// close frame and waits for the frames to be sent or for ctx to be done. Users
+// registered afterwards are disconnected right away.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.quitOnce.Do(func() {
+		close(h.quit)
+	})
+	select {
+	case <-h.pumps.Wait():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeMessage returns the payload of the close frame sent to the given
+// connection when the hub closes it.
+func (h *Hub) closeMessage(user *User) []byte {
+	select {
+	case <-h.quit:
+		return websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	default:
+	}
+	if user.closeReason != "" {
+		return websocket.FormatCloseMessage(websocket.ClosePolicyViolation, user.closeReason)
 	}
+	return []byte{}
+}
+
+// Kick closes the connections of the user opened with the given session, or
+// every connection of the user if session is empty, on every instance of the
+// site, e.g. because the user logged out. The websockets are closed with the
+// given reason.
+func (h *Hub) Kick(userId, session, reason string) {
+	h.send(&Message{UserId: userId, Kick: &Kick{Session: session, Reason: reason}})
 }
 
-func (h *Hub) markAllAsRead(userId string, sendOk chan bool) {
-	_, err := h.usersClient.MarkAllAsRead(context.Background(), &pbUsers.ReadNotifsRequest{UserId: userId})
-	if err != nil {
-		log.Println("Could not send request to mark all notifs as read: %v\n", err)
-		sendOk <- false
-	} else {
-		sendOk <- true
+// NewClient returns a client for the given connection of a user, with a queue
+// of notifications of the size set for the hub. The client must be registered
+// before its pumps are started.
+func (h *Hub) NewClient(conn *websocket.Conn, userId string) *Client {
+	return &Client{
+		Hub:  h,
+		Conn: conn,
+		User: &User{
+			Id:        userId,
+			SendNotif: make(chan *pbDataFormat.Notif, h.queueSize),
+			SendAck:   make(chan Ack, ackQueueSize),
+			SendEvent: make(chan *Event, eventQueueSize),
+			done:      make(chan struct{}),
+		},
 	}
 }
+
+// Acknowledge sends the ack of a request of the user made outside of the live
+// notifications, e.g. marking the notifications as read through "/readnotifs",
+// to every connection of the user, so that all of them show the same
+// notifications.
+func (h *Hub) Acknowledge(userId string, ack Ack) {
+	h.send(&Message{UserId: userId, Ack: &ack})
+}
+
+// Broadcast sends the notification to every connection of the user, if the
+// user is online on any instance of the site. It is safe to call from any
+// goroutine; it returns once the notification is published to the bus, or right
+// away if the hub is shutting down.
+func (h *Hub) Broadcast(userId string, notif *pbDataFormat.Notif) {
+	h.send(&Message{UserId: userId, Notif: notif})
+}
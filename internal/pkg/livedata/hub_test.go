@@ -0,0 +1,453 @@
+package livedata
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pbDataFormat "github.com/luisguve/cheroproto-go/dataformat"
+	pbUsers "github.com/luisguve/cheroproto-go/userapi"
+	"google.golang.org/grpc"
+)
+
+// testWait is the time the tests wait for the hub to deliver a message.
+const testWait = 5 * time.Second
+
+// testConn is a connection of a user registered in a hub, whose write pump is
+// stood in by pump.
+type testConn struct {
+	User   *User
+	notifs chan *pbDataFormat.Notif
+	acks   chan Ack
+	events chan *Event
+	// exited is closed once the pump returns.
+	exited chan struct{}
+}
+
+// testHub is a running hub along with a connection of its own, which tells
+// when the hub has delivered the messages sent before; see flush.
+type testHub struct {
+	*Hub
+	sentinel *testConn
+}
+
+func newTestHub(t *testing.T, opts Options) *testHub {
+	t.Helper()
+	return startTestHub(t, NewHub(nil, time.Second, nil, opts))
+}
+
+// startTestHub runs the hub, which must not be running.
+func startTestHub(t *testing.T, hub *Hub) *testHub {
+	t.Helper()
+	h := &testHub{Hub: hub}
+	go h.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testWait)
+		defer cancel()
+		h.Shutdown(ctx)
+	})
+	// The hubs sharing a bus get the notifications of each other's sentinels.
+	h.sentinel = h.connect(fmt.Sprintf("sentinel-%p", hub), true)
+	return h
+}
+
+// connect registers a connection of the user. Its pump receives everything
+// sent to it if drains is set, or nothing at all otherwise, as a client that is
+// stuck.
+func (h *testHub) connect(userId string, drains bool) *testConn {
+	c := &testConn{
+		User:   h.NewClient(nil, userId).User,
+		notifs: make(chan *pbDataFormat.Notif, 1024),
+		acks:   make(chan Ack, 64),
+		events: make(chan *Event, 64),
+		exited: make(chan struct{}),
+	}
+	h.Register <- c.User
+	go c.pump(h.Hub, drains)
+	return c
+}
+
+func (c *testConn) pump(h *Hub, drains bool) {
+	defer func() {
+		close(c.exited)
+		h.pumps.Done()
+	}()
+	if !drains {
+		<-c.User.Done()
+		return
+	}
+	acks, events := c.User.SendAck, c.User.SendEvent
+	for {
+		select {
+		case notif, ok := <-c.User.SendNotif:
+			if !ok {
+				return
+			}
+			c.notifs <- notif
+		case ack, ok := <-acks:
+			if !ok {
+				acks = nil
+				continue
+			}
+			c.acks <- ack
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			c.events <- event
+		}
+	}
+}
+
+// flush waits for the hub to deliver the messages sent so far, which the bus
+// passes to the hub in order, by sending one more to the sentinel.
+func (h *testHub) flush(t *testing.T) {
+	t.Helper()
+	h.Broadcast(h.sentinel.User.Id, &pbDataFormat.Notif{Id: "flush"})
+	h.sentinel.expect(t, 1)
+}
+
+// expect waits for n notifications and returns them.
+func (c *testConn) expect(t *testing.T, n int) []*pbDataFormat.Notif {
+	t.Helper()
+	notifs := make([]*pbDataFormat.Notif, 0, n)
+	for len(notifs) < n {
+		select {
+		case notif := <-c.notifs:
+			notifs = append(notifs, notif)
+		case <-time.After(testWait):
+			t.Fatalf("got %d notifications of %s, want %d", len(notifs), c.User.Id, n)
+		}
+	}
+	return notifs
+}
+
+// none checks that no notification nor ack was received.
+func (c *testConn) none(t *testing.T) {
+	t.Helper()
+	select {
+	case notif := <-c.notifs:
+		t.Errorf("unexpected notification %q for %s", notif.Id, c.User.Id)
+	case ack := <-c.acks:
+		t.Errorf("unexpected ack %v for %s", ack, c.User.Id)
+	default:
+	}
+}
+
+func (c *testConn) closed() bool {
+	select {
+	case <-c.User.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func notif(id string, i int) *pbDataFormat.Notif {
+	return &pbDataFormat.Notif{Id: id, Message: fmt.Sprint(i)}
+}
+
+func TestHubConnectionsOfAUser(t *testing.T) {
+	h := newTestHub(t, Options{})
+	var conns []*testConn
+	for i := 0; i < 5; i++ {
+		conns = append(conns, h.connect("u1", true))
+	}
+	other := h.connect("u2", true)
+
+	h.Broadcast("u1", notif("n1", 1))
+	h.flush(t)
+	for _, c := range conns {
+		if got := c.expect(t, 1); got[0].Id != "n1" {
+			t.Errorf("notification = %q, want n1", got[0].Id)
+		}
+	}
+	other.none(t)
+
+	// The rest of the connections of the user stay registered when one leaves.
+	h.Unregister <- conns[0].User
+	h.Acknowledge("u1", Ack{For: TypeMarkRead, Ok: true})
+	h.Broadcast("u1", notif("n2", 2))
+	h.flush(t)
+	if !conns[0].closed() {
+		t.Error("unregistered connection not closed")
+	}
+	for _, c := range conns[1:] {
+		select {
+		case ack := <-c.acks:
+			if ack.For != TypeMarkRead || !ack.Ok {
+				t.Errorf("ack = %+v", ack)
+			}
+		case <-time.After(testWait):
+			t.Fatal("ack not delivered to every connection")
+		}
+		c.expect(t, 1)
+	}
+	conns[0].none(t)
+	other.none(t)
+
+	// Kicks close the connections of the session only.
+	conns[1].User.Session = "s1"
+	h.Kick("u1", "s1", "logged out")
+	h.flush(t)
+	if !conns[1].closed() || conns[1].User.closeReason != "logged out" {
+		t.Error("connection of the session not kicked")
+	}
+	for _, c := range conns[2:] {
+		if c.closed() {
+			t.Error("connection of another session kicked")
+		}
+	}
+}
+
+func TestHubSlowConnections(t *testing.T) {
+	const queueSize = 4
+	tests := []struct {
+		name   string
+		policy QueuePolicy
+		// ids are the ids of the notifications broadcasted, in order.
+		ids []string
+		// want are the notifications left in the queue of the stuck
+		// connection, or nil if it must be disconnected.
+		want []*pbDataFormat.Notif
+	}{
+		{
+			name:   "disconnect",
+			policy: Disconnect,
+			ids:    []string{"a", "b", "c", "d", "e", "f"},
+		},
+		{
+			name:   "drop oldest",
+			policy: DropOldest,
+			ids:    []string{"a", "b", "c", "d", "e", "f"},
+			want:   []*pbDataFormat.Notif{notif("c", 2), notif("d", 3), notif("e", 4), notif("f", 5)},
+		},
+		{
+			name:   "coalesce",
+			policy: Coalesce,
+			ids:    []string{"a", "b", "a", "c", "b", "a", "d", "c"},
+			want:   []*pbDataFormat.Notif{notif("a", 5), notif("b", 4), notif("c", 7), notif("d", 6)},
+		},
+		{
+			name:   "coalesce too many",
+			policy: Coalesce,
+			ids:    []string{"a", "b", "c", "d", "a", "e", "f"},
+			want:   []*pbDataFormat.Notif{notif("c", 2), notif("d", 3), notif("e", 5), notif("f", 6)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHub(t, Options{QueueSize: queueSize, QueuePolicy: tt.policy})
+			fast := h.connect("u1", true)
+			stuck := h.connect("u1", false)
+			// The connections that keep up get every notification, whatever
+			// the rest do. The next notification is broadcasted once the last
+			// one is received, so that the queue of the fast connection never
+			// fills up.
+			for i, id := range tt.ids {
+				h.Broadcast("u1", notif(id, i))
+				if n := fast.expect(t, 1)[0]; n.Id != id || n.Message != fmt.Sprint(i) {
+					t.Errorf("notification %d = %s/%s, want %s/%d", i, n.Id, n.Message, id, i)
+				}
+			}
+			h.flush(t)
+			if fast.closed() {
+				t.Fatal("connection that keeps up closed")
+			}
+
+			if tt.want == nil {
+				select {
+				case <-stuck.exited:
+				case <-time.After(testWait):
+					t.Fatal("stuck connection not disconnected")
+				}
+				// The user is still online through the other connection.
+				h.Broadcast("u1", notif("z", 99))
+				h.flush(t)
+				fast.expect(t, 1)
+				return
+			}
+			if stuck.closed() {
+				t.Fatal("stuck connection disconnected")
+			}
+			queued := drain(stuck.User.SendNotif)
+			if len(queued) != len(tt.want) {
+				t.Fatalf("queued %d notifications, want %d", len(queued), len(tt.want))
+			}
+			for i, n := range queued {
+				if n.Id != tt.want[i].Id || n.Message != tt.want[i].Message {
+					t.Errorf("queued %d = %s/%s, want %s/%s", i, n.Id, n.Message,
+						tt.want[i].Id, tt.want[i].Message)
+				}
+			}
+		})
+	}
+}
+
+func TestHubShutdown(t *testing.T) {
+	h := NewHub(nil, time.Second, nil, Options{})
+	go h.Run()
+	var exited int32
+	const conns = 8
+	for i := 0; i < conns; i++ {
+		user := h.NewClient(nil, fmt.Sprint("u", i%3)).User
+		h.Register <- user
+		go func() {
+			// The write pump sends the close frame before it returns.
+			for range user.SendNotif {
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&exited, 1)
+			h.pumps.Done()
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testWait)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if n := atomic.LoadInt32(&exited); n != conns {
+		t.Errorf("Shutdown returned with %d of %d pumps exited", n, conns)
+	}
+
+	// The users registered afterwards are disconnected right away.
+	late := h.NewClient(nil, "u1").User
+	h.Register <- late
+	select {
+	case <-late.Done():
+	case <-time.After(testWait):
+		t.Error("connection registered after Shutdown not closed")
+	}
+	h.pumps.Done()
+	// Broadcasts after Shutdown return right away.
+	h.Broadcast("u1", notif("n", 0))
+}
+
+func TestHubShutdownTimeout(t *testing.T) {
+	h := NewHub(nil, time.Second, nil, Options{})
+	go h.Run()
+	// The pump of this connection never returns.
+	h.Register <- h.NewClient(nil, "u1").User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// expectAck waits for an ack and returns it.
+func (c *testConn) expectAck(t *testing.T) Ack {
+	t.Helper()
+	select {
+	case ack := <-c.acks:
+		return ack
+	case <-time.After(testWait):
+		t.Fatalf("no ack for %s", c.User.Id)
+	}
+	return Ack{}
+}
+
+// headerUsers is a users service that only serves the header data, with the
+// notifications of every user.
+type headerUsers struct {
+	pbUsers.CrudUsersClient
+	notifs []*pbDataFormat.Notif
+	calls  int32
+}
+
+func (u *headerUsers) GetUserHeaderData(ctx context.Context, in *pbUsers.GetBasicUserDataRequest,
+	opts ...grpc.CallOption) (*pbUsers.UserHeaderData, error) {
+	atomic.AddInt32(&u.calls, 1)
+	return &pbUsers.UserHeaderData{UnreadNotifs: u.notifs}, nil
+}
+
+func TestHubResumeUpToDate(t *testing.T) {
+	users := &headerUsers{}
+	hub := NewHub(users, time.Second, nil, Options{})
+	// The hub started a while ago.
+	hub.started = hub.started.Add(-resumeWindow / 2)
+	h := startTestHub(t, hub)
+	c := h.connect("u1", true)
+	resume := func(since time.Time) Ack {
+		t.Helper()
+		h.requests <- request{user: c.User, msg: clientMessage{Type: TypeResumeSince, Since: since}}
+		return c.expectAck(t)
+	}
+
+	// Nothing came after a recent time, so there is nothing to replay.
+	if ack := resume(time.Now()); !ack.Ok || ack.For != TypeResumeSince {
+		t.Errorf("ack = %+v", ack)
+	}
+	if n := atomic.LoadInt32(&users.calls); n != 0 {
+		t.Errorf("users service asked %d times for a recent time", n)
+	}
+
+	// A notification for another user changes nothing.
+	since := time.Now()
+	h.Broadcast("u2", notif("n1", 1))
+	h.flush(t)
+	resume(since)
+	if n := atomic.LoadInt32(&users.calls); n != 0 {
+		t.Errorf("users service asked %d times after a notification of another user", n)
+	}
+
+	// The notifications that came afterwards are replayed.
+	h.Broadcast("u1", notif("n2", 2))
+	h.flush(t)
+	c.expect(t, 1)
+	resume(since)
+	if n := atomic.LoadInt32(&users.calls); n != 1 {
+		t.Errorf("users service asked %d times, want once", n)
+	}
+
+	// The hub does not know what came before it started or long ago.
+	resume(time.Now().Add(-2 * resumeWindow))
+	if n := atomic.LoadInt32(&users.calls); n != 2 {
+		t.Errorf("users service asked %d times, want twice", n)
+	}
+}
+
+func TestHubAnonymousTopics(t *testing.T) {
+	h := newTestHub(t, Options{})
+	anon := h.connect("", true)
+	user := h.connect("u1", true)
+	topic := ThreadTopic("s", "t")
+	for _, c := range []*testConn{anon, user} {
+		h.requests <- request{user: c.User, msg: clientMessage{Type: TypeSubscribe, Topic: topic}}
+		if ack := c.expectAck(t); !ack.Ok {
+			t.Fatalf("subscribe ack = %+v", ack)
+		}
+	}
+
+	h.Publish(&Event{Topic: topic, Name: "comment"})
+	h.Publish(&Event{Topic: topic, Name: "counters", Skip: "u1"})
+	h.flush(t)
+	for _, want := range []string{"comment", "counters"} {
+		select {
+		case event := <-anon.events:
+			if event.Name != want {
+				t.Errorf("event = %s, want %s", event.Name, want)
+			}
+		case <-time.After(testWait):
+			t.Fatalf("event %s not delivered to the anonymous connection", want)
+		}
+	}
+	select {
+	case event := <-user.events:
+		if event.Name != "comment" {
+			t.Errorf("event = %s, want comment", event.Name)
+		}
+	case <-time.After(testWait):
+		t.Fatal("event not delivered to the user")
+	}
+	select {
+	case event := <-user.events:
+		t.Errorf("skipped event %s delivered to the user", event.Name)
+	default:
+	}
+}
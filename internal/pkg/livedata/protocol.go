@@ -0,0 +1,258 @@
+package livedata
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	pbDataFormat "github.com/luisguve/cheroproto-go/dataformat"
+	pbUsers "github.com/luisguve/cheroproto-go/userapi"
+)
+
+// Types of the messages of the websocket protocol. Every message is a JSON
+// object with a "type" field. The server sends:
+//   - notif: {"type":"notif","notif":{...}}, a notification.
+//   - ack: {"type":"ack","for":"clear","ok":true}, the result of a request of
+//     the client; "error" holds an error code if ok is false.
+//
+// The client sends:
+//   - mark_read: {"type":"mark_read"} marks all the notifications as read.
+//     Marking only some of them with "ids" is not supported by the users
+//     service yet.
+//   - clear: {"type":"clear"} deletes both read and unread notifications.
+//   - resume_since: {"type":"resume_since","since":"2020-06-01T10:00:00Z"}
+//     replays the notifications after the given time, e.g. the time of the last
+//     one received before reconnecting.
+//
+// The acks of mark_read and clear are sent to every connection of the user, so
+// that all of them show the same notifications. The notifications replayed by
+// resume_since are sent before its ack, which sets "more" if there were more
+// notifications than could be queued; the client is expected to resume again
+// since the last one received. Replayed notifications may have been received
+// already, so the client should discard the ids it already has. See TypeEvent
+// for the messages of the topics.
+const (
+	TypeNotif       = "notif"
+	TypeAck         = "ack"
+	TypeMarkRead    = "mark_read"
+	TypeClear       = "clear"
+	TypeResumeSince = "resume_since"
+)
+
+// Error codes of the acks.
+const (
+	ErrInvalidMessage = "INVALID_MESSAGE"
+	ErrUnsupported    = "UNSUPPORTED"
+	ErrUpstream       = "UPSTREAM_ERROR"
+)
+
+// maxReplay is the maximum number of notifications replayed by a resume_since
+// request. They are further limited to the room left in the queue of the
+// connection.
+const maxReplay = 100
+
+const (
+	// resumeWindow is the time the hub remembers that a user was notified;
+	// see upToDate.
+	resumeWindow = time.Minute
+
+	// clockSkew is the difference allowed between the clocks of the instances
+	// of the site.
+	clockSkew = time.Second
+)
+
+// clientMessage is a message sent by the client.
+type clientMessage struct {
+	Type  string    `json:"type"`
+	Ids   []string  `json:"ids,omitempty"`
+	Since time.Time `json:"since,omitempty"`
+	Topic string    `json:"topic,omitempty"`
+}
+
+// notifMessage is a notification sent to the client.
+type notifMessage struct {
+	Type  string              `json:"type"`
+	Notif *pbDataFormat.Notif `json:"notif"`
+}
+
+// Ack is the result of a request of the client.
+type Ack struct {
+	// For is the type of the request.
+	For string `json:"for"`
+	Ok  bool   `json:"ok"`
+	// Error is the error code of the request if it failed.
+	Error string `json:"error,omitempty"`
+	// More is set if a resume_since request did not replay every notification.
+	More bool `json:"more,omitempty"`
+}
+
+// ackMessage is an Ack sent to the client.
+type ackMessage struct {
+	Type string `json:"type"`
+	Ack
+}
+
+// request is a request of a connection of a user.
+type request struct {
+	user *User
+	msg  clientMessage
+}
+
+// result is the result of a request, to be sent by Run.
+type result struct {
+	user *User
+	// sync sends the ack to every connection of the user rather than only to
+	// the connection of the request.
+	sync bool
+	// notifs are queued for the connection of the request before the ack.
+	notifs []*pbDataFormat.Notif
+	ack    Ack
+}
+
+var (
+	errInvalidMessage = errors.New(ErrInvalidMessage)
+	errUnsupported    = errors.New(ErrUnsupported)
+)
+
+// handle performs the request with the users service and passes its result to
+// Run.
+func (h *Hub) handle(req request) {
+	res := result{user: req.user, ack: Ack{For: req.msg.Type, Ok: true}}
+	userId := req.user.Id
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	var err error
+	switch req.msg.Type {
+	case TypeMarkRead:
+		if len(req.msg.Ids) > 0 {
+			err = errUnsupported
+			break
+		}
+		_, err = h.usersClient.MarkAllAsRead(ctx, &pbUsers.ReadNotifsRequest{UserId: userId})
+		res.sync = true
+	case TypeClear:
+		_, err = h.usersClient.ClearNotifs(ctx, &pbUsers.ClearNotifsRequest{UserId: userId})
+		res.sync = true
+	case TypeResumeSince:
+		res.notifs, err = h.notifsSince(ctx, userId, req.msg.Since)
+	default:
+		err = errInvalidMessage
+	}
+	if err != nil {
+		res.sync = false
+		res.ack.Ok = false
+		switch err {
+		case errInvalidMessage, errUnsupported:
+			res.ack.Error = err.Error()
+		default:
+			h.log.Error("Could not handle live notifs request", "user", userId,
+				"type", req.msg.Type, "err", err)
+			res.ack.Error = ErrUpstream
+		}
+	}
+	if res.sync {
+		// The ack goes to the connections of the user on every instance.
+		h.send(&Message{UserId: userId, Ack: &res.ack})
+		return
+	}
+	select {
+	case h.results <- res:
+	case <-h.quit:
+	}
+}
+
+// upToDate reports whether the hub received no notification for the user
+// after since, so that resuming since then replays nothing and the users
+// service need not be asked, e.g. as every stream reconnects. It is only known
+// for the times within resumeWindow after the hub started. It must only be
+// called by Run.
+func (h *Hub) upToDate(userId string, since time.Time) bool {
+	since = since.Add(-clockSkew)
+	if since.Before(h.started) || time.Since(since) > resumeWindow {
+		return false
+	}
+	return !h.notified[userId].After(since)
+}
+
+// notify records that a notification for the user was received now, and
+// forgets the users notified before resumeWindow. It must only be called by
+// Run.
+func (h *Hub) notify(userId string) {
+	now := time.Now()
+	h.notified[userId] = now
+	if now.Sub(h.pruned) < resumeWindow {
+		return
+	}
+	for id, t := range h.notified {
+		if now.Sub(t) > resumeWindow {
+			delete(h.notified, id)
+		}
+	}
+	h.pruned = now
+}
+
+// notifsSince returns both the read and unread notifications of the user after
+// the given time, from the oldest to the newest.
+func (h *Hub) notifsSince(ctx context.Context, userId string, since time.Time) ([]*pbDataFormat.Notif, error) {
+	data, err := h.usersClient.GetUserHeaderData(ctx, &pbUsers.GetBasicUserDataRequest{UserId: userId})
+	if err != nil {
+		return nil, err
+	}
+	var notifs []*pbDataFormat.Notif
+	for _, list := range [][]*pbDataFormat.Notif{data.ReadNotifs, data.UnreadNotifs} {
+		for _, notif := range list {
+			if notif != nil && notifTime(notif).After(since) {
+				notifs = append(notifs, notif)
+			}
+		}
+	}
+	sort.SliceStable(notifs, func(i, j int) bool {
+		return notifTime(notifs[i]).Before(notifTime(notifs[j]))
+	})
+	return notifs, nil
+}
+
+func notifTime(notif *pbDataFormat.Notif) time.Time {
+	if notif.Timestamp == nil {
+		return time.Time{}
+	}
+	return time.Unix(notif.Timestamp.Seconds, int64(notif.Timestamp.Nanos))
+}
+
+// deliver sends the result of a request to the connection of the request, or to
+// every connection of the user if the result is synced. It must only be called
+// by Run.
+func (h *Hub) deliver(res result) {
+	registered := h.onlineUsers[res.user.Id][res.user]
+	if !registered && !res.sync {
+		// The connection of the request is gone.
+		return
+	}
+	if registered && len(res.notifs) > 0 {
+		// Replay only what fits in the queue, so that the queue policy does
+		// not kick in; the client resumes again for the rest.
+		room := cap(res.user.SendNotif) - len(res.user.SendNotif)
+		if room > maxReplay {
+			room = maxReplay
+		}
+		if len(res.notifs) > room {
+			res.notifs = res.notifs[:room]
+			res.ack.More = true
+		}
+		for _, notif := range res.notifs {
+			res.user.SendNotif <- notif
+		}
+	}
+	conns := map[*User]bool{res.user: true}
+	if res.sync {
+		conns = h.onlineUsers[res.user.Id]
+	}
+	for user := range conns {
+		select {
+		case user.SendAck <- res.ack:
+		default:
+			// The connection is not reading its acks.
+		}
+	}
+}
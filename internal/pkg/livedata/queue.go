@@ -0,0 +1,118 @@
+package livedata
+
+import (
+	pbDataFormat "github.com/luisguve/cheroproto-go/dataformat"
+	"github.com/luisguve/cherosite/internal/pkg/metrics"
+)
+
+// QueuePolicy is what the hub does with a notification for a connection whose
+// queue of notifications is full, that is, a connection that is too slow to
+// keep up with its notifications.
+type QueuePolicy int
+
+const (
+	// Disconnect unregisters the connection, which drops its queue.
+	Disconnect QueuePolicy = iota
+	// DropOldest drops the oldest notification of the queue to make room for
+	// the new one.
+	DropOldest
+	// Coalesce merges the notifications of the queue with the same id, keeping
+	// the last one, as the write pumps do before sending them. The oldest
+	// notifications are dropped if they are still too many.
+	Coalesce
+)
+
+// DefaultQueueSize is the number of notifications queued per connection of a
+// hub that sets none.
+const DefaultQueueSize = 256
+
+// Options holds the settings of a Hub.
+type Options struct {
+	// QueueSize is the number of notifications queued per connection. It
+	// defaults to DefaultQueueSize.
+	QueueSize int
+	// QueuePolicy defaults to Disconnect.
+	QueuePolicy QueuePolicy
+	// Bus carries the messages of the hub to the hubs of the rest of the
+	// instances of the site. It defaults to a MemoryBus, for a single instance.
+	Bus Bus
+}
+
+// enqueue queues the notification for the given connection, following the
+// queue policy of the hub if the queue is full. It must only be called by Run.
+func (h *Hub) enqueue(user *User, notif *pbDataFormat.Notif) {
+	select {
+	case user.SendNotif <- notif:
+		return
+	default:
+	}
+	switch h.policy {
+	case DropOldest:
+		// The write pump may have freed some room in the meantime.
+		select {
+		case <-user.SendNotif:
+			metrics.DroppedNotifs.Inc()
+		default:
+		}
+		select {
+		case user.SendNotif <- notif:
+		default:
+			metrics.DroppedNotifs.Inc()
+		}
+	case Coalesce:
+		merged := coalesce(append(drain(user.SendNotif), notif))
+		// The notifications merged into others are not counted as dropped.
+		dropped := 0
+		if extra := len(merged) - cap(user.SendNotif); extra > 0 {
+			merged = merged[extra:]
+			dropped = extra
+		}
+		for _, n := range merged {
+			select {
+			case user.SendNotif <- n:
+			default:
+				dropped++
+			}
+		}
+		metrics.DroppedNotifs.Add(float64(dropped))
+	default:
+		// The connection is stuck or dead. Proceed to remove it.
+		metrics.DroppedNotifs.Inc()
+		metrics.ForcedUnregisters.Inc()
+		h.remove(user)
+	}
+}
+
+// drain receives the notifications queued in the channel without blocking.
+func drain(receive chan *pbDataFormat.Notif) []*pbDataFormat.Notif {
+	n := len(receive)
+	notifs := make([]*pbDataFormat.Notif, 0, n)
+	for i := 0; i < n; i++ {
+		select {
+		case notif, ok := <-receive:
+			if !ok {
+				return notifs
+			}
+			notifs = append(notifs, notif)
+		default:
+			return notifs
+		}
+	}
+	return notifs
+}
+
+// coalesce discards all the notifications with the same id but the last one.
+// The notifications keep the order of their first occurrence.
+func coalesce(notifs []*pbDataFormat.Notif) []*pbDataFormat.Notif {
+	index := make(map[string]int, len(notifs))
+	merged := make([]*pbDataFormat.Notif, 0, len(notifs))
+	for _, notif := range notifs {
+		if i, ok := index[notif.Id]; ok {
+			merged[i] = notif
+			continue
+		}
+		index[notif.Id] = len(merged)
+		merged = append(merged, notif)
+	}
+	return merged
+}
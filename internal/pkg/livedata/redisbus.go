@@ -0,0 +1,262 @@
+package livedata
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/luisguve/cherosite/internal/pkg/logging"
+	"github.com/luisguve/cherosite/internal/pkg/metrics"
+	"github.com/luisguve/cherosite/internal/pkg/resp"
+)
+
+// DefaultRedisChannel is the channel of the RedisBuses that set none.
+const DefaultRedisChannel = "cherosite:livenotifs"
+
+const (
+	// Time allowed to read the next reply of the server, including the replies
+	// to the pings.
+	busPongWait = 60 * time.Second
+
+	// Send pings to the server with this period. Must be less than busPongWait.
+	busPingPeriod = (busPongWait * 9) / 10
+
+	// Time to wait to subscribe again after losing the connection.
+	busRetryDelay = time.Second
+
+	// Maximum number of idle connections kept to publish the messages.
+	busMaxIdle = 4
+)
+
+// RedisOptions holds the settings of a RedisBus.
+type RedisOptions struct {
+	// Addr is the address of the server, e.g. "localhost:6379".
+	Addr string
+	// Password is sent with AUTH if it is not empty.
+	Password string
+	// Channel is the channel the messages are published to. It defaults to
+	// DefaultRedisChannel.
+	Channel string
+	// Timeout is the deadline of every command, including dialing. It defaults
+	// to 5 seconds.
+	Timeout time.Duration
+}
+
+// RedisBus is a Bus that publishes the messages, encoded as JSON, to a channel
+// of a server that speaks the Redis protocol, such as Redis, KeyDB or Valkey,
+// and subscribes to it. The hubs of several instances of the site share the
+// notifications as long as they publish to the same channel of the same server.
+// The messages published while the subscription is lost, e.g. while the server
+// restarts, are not received.
+type RedisBus struct {
+	opts RedisOptions
+	log  *logging.Logger
+	f    *fanout
+
+	// pubs are the idle connections the messages are published through, and
+	// sub is the connection subscribed to the channel. mu is only held to take
+	// and put back the connections, not while publishing, so that publishers
+	// do not wait for the round trips of each other.
+	mu     sync.Mutex
+	pubs   []*resp.Conn
+	sub    *resp.Conn
+	closed bool
+}
+
+// NewRedisBus returns a RedisBus with the given options. It subscribes to the
+// channel in the background, and subscribes again whenever the connection is
+// lost, until the bus is closed.
+func NewRedisBus(opts RedisOptions, log *logging.Logger) *RedisBus {
+	if opts.Channel == "" {
+		opts.Channel = DefaultRedisChannel
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if log == nil {
+		log = logging.Default()
+	}
+	b := &RedisBus{opts: opts, log: log, f: newFanout()}
+	go b.listen()
+	return b
+}
+
+func (b *RedisBus) Publish(msg *Message) error {
+	select {
+	case <-b.f.done:
+		return ErrBusClosed
+	default:
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c, err := b.takeConn()
+	if err != nil {
+		return err
+	}
+	_, err = c.Do(b.opts.Timeout, "PUBLISH", b.opts.Channel, string(data))
+	var redisErr resp.Error
+	if err != nil && !errors.As(err, &redisErr) {
+		// The state of the connection is unknown.
+		c.Close()
+		return err
+	}
+	b.putConn(c)
+	return err
+}
+
+// takeConn returns an idle connection to publish through, or a new one if there
+// is none.
+func (b *RedisBus) takeConn() (*resp.Conn, error) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil, ErrBusClosed
+	}
+	if n := len(b.pubs); n > 0 {
+		c := b.pubs[n-1]
+		b.pubs = b.pubs[:n-1]
+		b.mu.Unlock()
+		return c, nil
+	}
+	b.mu.Unlock()
+	return b.dial()
+}
+
+// putConn keeps the connection c to publish through again, unless there are
+// enough idle connections or the bus is closed.
+func (b *RedisBus) putConn(c *resp.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || len(b.pubs) >= busMaxIdle {
+		c.Close()
+		return
+	}
+	b.pubs = append(b.pubs, c)
+}
+
+func (b *RedisBus) Subscribe() <-chan *Message {
+	return b.f.subscribe()
+}
+
+// Close closes the connections of the bus.
+func (b *RedisBus) Close() error {
+	b.f.close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, c := range b.pubs {
+		c.Close()
+	}
+	if b.sub != nil {
+		b.sub.Close()
+	}
+	b.pubs, b.sub = nil, nil
+	return nil
+}
+
+func (b *RedisBus) dial() (*resp.Conn, error) {
+	return resp.Dial(resp.Options{
+		Addr:     b.opts.Addr,
+		Password: b.opts.Password,
+		Timeout:  b.opts.Timeout,
+	})
+}
+
+// listen subscribes to the channel and passes the messages to the subscribers
+// of the bus until it is closed.
+func (b *RedisBus) listen() {
+	for {
+		err := b.subscribe()
+		select {
+		case <-b.f.done:
+			return
+		default:
+		}
+		metrics.BusErrors.Inc()
+		b.log.Error("Lost the subscription to the live notifications bus",
+			"channel", b.opts.Channel, "err", err)
+		select {
+		case <-time.After(busRetryDelay):
+		case <-b.f.done:
+			return
+		}
+	}
+}
+
+// subscribe opens a connection subscribed to the channel and passes the
+// messages received through it to the subscribers of the bus, until the
+// connection fails.
+func (b *RedisBus) subscribe() error {
+	c, err := b.dial()
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	select {
+	case <-b.f.done:
+		b.mu.Unlock()
+		c.Close()
+		return ErrBusClosed
+	default:
+	}
+	b.sub = c
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		if b.sub == c {
+			b.sub = nil
+		}
+		b.mu.Unlock()
+		c.Close()
+	}()
+
+	if err := c.Send(b.opts.Timeout, "SUBSCRIBE", b.opts.Channel); err != nil {
+		return err
+	}
+	// Ping the server, so that a dead connection is noticed by Receive.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(busPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.Send(b.opts.Timeout, "PING"); err != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	for {
+		reply, err := c.Receive(busPongWait)
+		if err != nil {
+			return err
+		}
+		// The messages are replied as ["message", channel, data]; the rest are
+		// the replies to SUBSCRIBE and PING.
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 {
+			continue
+		}
+		kind, _ := parts[0].([]byte)
+		data, _ := parts[2].([]byte)
+		if string(kind) != "message" {
+			continue
+		}
+		msg := new(Message)
+		if err := json.Unmarshal(data, msg); err != nil {
+			b.log.Error("Invalid message in the live notifications bus",
+				"channel", b.opts.Channel, "err", err)
+			continue
+		}
+		if err := b.f.send(msg); err != nil {
+			return err
+		}
+	}
+}
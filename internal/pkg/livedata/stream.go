@@ -0,0 +1,203 @@
+package livedata
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	pbDataFormat "github.com/luisguve/cheroproto-go/dataformat"
+)
+
+// heartbeatPeriod is the time between the comments sent to keep a stream alive
+// through the proxies that close idle connections.
+const heartbeatPeriod = 5 * time.Second
+
+// retryDelay is the time the clients wait to reconnect after a stream ends.
+const retryDelay = 500 * time.Millisecond
+
+// Stream sends the notifications of a connection of a user as Server-Sent
+// Events, for the clients whose websockets are blocked, e.g. by a proxy. It is
+// registered in the hub as any other connection, but it only sends events:
+//   - "notif" events carry a notification. Their id is the time of the
+//     notification, so that a client that reconnects with the header
+//     Last-Event-ID gets the notifications it missed replayed.
+//   - "ack" events carry the acks of the requests of the user, which are made
+//     through the rest of the routes, e.g. "/readnotifs".
+//   - "event" events carry the events of the topics the stream subscribed to
+//     with Subscribe, as the websocket messages of type event.
+type Stream struct {
+	Hub  *Hub
+	User *User
+	// resuming is set while the notifications replayed by Resume have not been
+	// written, so that the stream does not move the id of the last event past
+	// them.
+	resuming bool
+}
+
+// NewStream returns a stream for a connection of a user. The stream must be
+// registered before it is served. The streams of anonymous users, whose
+// userId is empty, only get the events of their topics.
+func (h *Hub) NewStream(userId string) *Stream {
+	c := h.NewClient(nil, userId)
+	return &Stream{Hub: h, User: c.User}
+}
+
+// Resume replays the notifications of the user after since on the stream, as
+// Client.Resume does. The stream must be registered.
+func (s *Stream) Resume(since time.Time) {
+	s.resuming = true
+	s.Hub.requests <- request{
+		user: s.User,
+		msg:  clientMessage{Type: TypeResumeSince, Since: since},
+	}
+}
+
+// Subscribe subscribes the stream to the events of the given topic, as
+// Client.Subscribe does. The stream must be registered.
+func (s *Stream) Subscribe(topic string) {
+	s.Hub.requests <- request{
+		user: s.User,
+		msg:  clientMessage{Type: TypeSubscribe, Topic: topic},
+	}
+}
+
+// Serve writes the events of the stream to w until ctx is done, d elapses or
+// the hub unregisters the stream, and then unregisters it. d must be shorter
+// than the write timeout of the server; the clients reconnect right away once
+// the stream ends, resuming since the time it ended.
+func (s *Stream) Serve(ctx context.Context, w http.ResponseWriter, d time.Duration) error {
+	defer func() {
+		s.Hub.Unregister <- s.User
+		s.Hub.pumps.Done()
+	}()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("response does not support flushing")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Ask the proxies that buffer the responses not to do so.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "retry: %d\n\n", retryDelay.Milliseconds())
+	if !s.resuming {
+		// Resume since now if the stream is cut before any notification.
+		writeID(&buf, time.Now())
+	}
+	if err := flush(w, flusher, &buf); err != nil {
+		return err
+	}
+
+	heartbeat := time.NewTicker(heartbeatPeriod)
+	defer heartbeat.Stop()
+	end := time.NewTimer(d)
+	defer end.Stop()
+	for {
+		select {
+		case notif, ok := <-s.User.SendNotif:
+			if !ok {
+				// The hub closed the channel.
+				return nil
+			}
+			notifs := append([]*pbDataFormat.Notif{notif}, drain(s.User.SendNotif)...)
+			if err := writeNotifs(&buf, notifs); err != nil {
+				return err
+			}
+		case ack, ok := <-s.User.SendAck:
+			if !ok {
+				// The hub closed the channel.
+				return nil
+			}
+			// The notifications replayed for a request are queued before its
+			// ack, so they are written first.
+			if err := writeNotifs(&buf, drain(s.User.SendNotif)); err != nil {
+				return err
+			}
+			if err := writeEvent(&buf, "", TypeAck, ack); err != nil {
+				return err
+			}
+			if ack.For == TypeResumeSince {
+				s.resuming = false
+			}
+		case event, ok := <-s.User.SendEvent:
+			if !ok {
+				// The hub closed the channel.
+				return nil
+			}
+			if err := writeEvent(&buf, "", TypeEvent, event); err != nil {
+				return err
+			}
+		case <-heartbeat.C:
+			buf.WriteString(": heartbeat\n\n")
+		case <-end.C:
+			if err := writeNotifs(&buf, drain(s.User.SendNotif)); err != nil {
+				return err
+			}
+			if !s.resuming {
+				writeID(&buf, time.Now())
+			}
+			return flush(w, flusher, &buf)
+		case <-ctx.Done():
+			return nil
+		}
+		if err := flush(w, flusher, &buf); err != nil {
+			return err
+		}
+	}
+}
+
+// flush writes the events in buf to w and flushes it.
+func flush(w http.ResponseWriter, flusher http.Flusher, buf *bytes.Buffer) error {
+	if _, err := buf.WriteTo(w); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// writeNotifs discards all the notifications with the same ID but the last
+// notification and writes an event for every one of the rest.
+func writeNotifs(buf *bytes.Buffer, notifs []*pbDataFormat.Notif) error {
+	for _, notif := range coalesce(notifs) {
+		id := ""
+		if notif.Timestamp != nil {
+			id = formatID(notifTime(notif))
+		}
+		if err := writeEvent(buf, id, TypeNotif, notif); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEvent writes an event of the given type with v as JSON data, and with
+// the given id unless it is empty.
+func writeEvent(buf *bytes.Buffer, id, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		fmt.Fprintf(buf, "id: %s\n", id)
+	}
+	fmt.Fprintf(buf, "event: %s\ndata: %s\n\n", event, data)
+	return nil
+}
+
+// writeID sets the id of the last event received by the client, which is sent
+// back in the header Last-Event-ID when it reconnects, to the given time. It
+// dispatches no event by itself.
+func writeID(buf *bytes.Buffer, t time.Time) {
+	fmt.Fprintf(buf, "id: %s\n\n", formatID(t))
+}
+
+// formatID returns the id of the events at the given time.
+func formatID(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
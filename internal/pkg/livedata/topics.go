@@ -0,0 +1,143 @@
+package livedata
+
+import (
+	"strings"
+
+	"github.com/luisguve/cherosite/internal/pkg/metrics"
+)
+
+// Types of the messages of the websocket protocol that deal with topics; see
+// TypeNotif for the rest:
+//   - subscribe: {"type":"subscribe","topic":"thread:{section}/{thread}"} sends
+//     the events of the topic to the connection, until it unsubscribes with
+//     {"type":"unsubscribe","topic":"..."}. Both are acked.
+//   - event: {"type":"event","topic":"...","event":"comment","data":{...}} is
+//     sent by the server with every event of the topics of the connection.
+//
+// The topics are the threads and the sections being viewed; see ThreadTopic and
+// SectionTopic.
+const (
+	TypeSubscribe   = "subscribe"
+	TypeUnsubscribe = "unsubscribe"
+	TypeEvent       = "event"
+)
+
+// ErrTooManyTopics is the error code of the acks of the subscriptions of the
+// connections with maxTopics topics already.
+const ErrTooManyTopics = "TOO_MANY_TOPICS"
+
+const (
+	// maxTopics is the maximum number of topics of a connection.
+	maxTopics = 16
+
+	// eventQueueSize is the number of events queued per connection. The events
+	// of a connection whose queue is full are dropped.
+	eventQueueSize = 32
+)
+
+// ThreadTopic returns the topic of the events of a thread, such as its new
+// comments.
+func ThreadTopic(sectionId, threadId string) string {
+	return "thread:" + sectionId + "/" + threadId
+}
+
+// SectionTopic returns the topic of the events of the threads of a section,
+// such as their counters.
+func SectionTopic(sectionId string) string {
+	return "section:" + sectionId
+}
+
+// validTopic reports whether topic is either a thread or a section topic.
+func validTopic(topic string) bool {
+	switch {
+	case strings.HasPrefix(topic, "thread:"):
+		ids := strings.Split(strings.TrimPrefix(topic, "thread:"), "/")
+		return len(ids) == 2 && ids[0] != "" && ids[1] != ""
+	case strings.HasPrefix(topic, "section:"):
+		id := strings.TrimPrefix(topic, "section:")
+		return id != "" && !strings.Contains(id, "/")
+	}
+	return false
+}
+
+// Event is an event of a topic. Data is encoded as JSON.
+type Event struct {
+	Topic string      `json:"topic"`
+	Name  string      `json:"event"`
+	Data  interface{} `json:"data"`
+	// Skip is the id of a user whose connections do not get the event, e.g.
+	// the user that caused it, whose pages already show it.
+	Skip string `json:"-"`
+}
+
+// eventMessage is an Event sent to the client.
+type eventMessage struct {
+	Type string `json:"type"`
+	*Event
+}
+
+// Publish sends the event to every connection subscribed to its topic on any
+// instance of the site. It is safe to call from any goroutine; it returns once
+// the event is published to the bus, or right away if the hub is shutting down.
+func (h *Hub) Publish(event *Event) {
+	h.send(&Message{Event: event, Skip: event.Skip})
+}
+
+// subscribe handles the subscriptions of a connection to a topic and its
+// unsubscriptions. It must only be called by Run.
+func (h *Hub) subscribe(req request) {
+	user, topic := req.user, req.msg.Topic
+	ack := Ack{For: req.msg.Type, Ok: true}
+	switch {
+	case !validTopic(topic):
+		ack.Ok = false
+		ack.Error = ErrInvalidMessage
+	case req.msg.Type == TypeUnsubscribe:
+		h.unsubscribe(user, topic)
+	case user.topics[topic]:
+		// Already subscribed.
+	case len(user.topics) >= maxTopics:
+		ack.Ok = false
+		ack.Error = ErrTooManyTopics
+	default:
+		if user.topics == nil {
+			user.topics = make(map[string]bool)
+		}
+		user.topics[topic] = true
+		users, ok := h.topics[topic]
+		if !ok {
+			users = make(map[*User]bool)
+			h.topics[topic] = users
+		}
+		users[user] = true
+	}
+	h.deliver(result{user: user, ack: ack})
+}
+
+// unsubscribe removes the connection from the subscribers of topic. It must
+// only be called by Run.
+func (h *Hub) unsubscribe(user *User, topic string) {
+	delete(user.topics, topic)
+	users := h.topics[topic]
+	delete(users, user)
+	if len(users) == 0 {
+		delete(h.topics, topic)
+	}
+}
+
+// publish queues the event for every connection subscribed to its topic. It
+// must only be called by Run.
+func (h *Hub) publish(event *Event) {
+	for user := range h.topics[event.Topic] {
+		if event.Skip != "" && user.Id == event.Skip {
+			continue
+		}
+		select {
+		case user.SendEvent <- event:
+		default:
+			// The connection is too slow; it is not worth disconnecting it
+			// for the events of a topic.
+			metrics.DroppedEvents.Inc()
+		}
+	}
+}
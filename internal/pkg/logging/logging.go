@@ -0,0 +1,242 @@
+// Package logging implements a leveled logger that writes structured entries,
+// made of a message and key-value pairs, either as text or as JSON.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of an entry. Entries below the level of the logger are
+// discarded.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+}
+
+// ParseLevel returns the level named s, which is one of "debug", "info", "warn"
+// or "error", regardless of case.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Formats of the entries.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// output is the destination shared by a logger and the loggers derived from it.
+type output struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Logger writes entries to an output. A Logger is safe for concurrent use.
+type Logger struct {
+	out    *output
+	level  Level
+	json   bool
+	fields []interface{}
+}
+
+// New returns a logger that writes the entries of the given level and above to
+// w in the given format, either FormatText or FormatJSON.
+func New(w io.Writer, level Level, format string) (*Logger, error) {
+	switch format {
+	case FormatText, "":
+	case FormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return &Logger{
+		out:   &output{w: w},
+		level: level,
+		json:  format == FormatJSON,
+	}, nil
+}
+
+// defaultLogger is used when no logger is set.
+var defaultLogger = &Logger{
+	out:   &output{w: os.Stderr},
+	level: LevelInfo,
+}
+
+// Default returns a logger that writes entries of level info and above as text
+// to the standard error.
+func Default() *Logger {
+	return defaultLogger
+}
+
+// With returns a logger that adds the given key-value pairs to every entry.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{
+		out:    l.out,
+		level:  l.level,
+		json:   l.json,
+		fields: fields,
+	}
+}
+
+// Enabled reports whether entries of the given level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, msg, kv)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+}
+
+// log writes an entry made of the message, the fields of the logger and the
+// given key-value pairs. A key without value is written with the value
+// "!MISSING".
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	pairs := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	pairs = append(pairs, "time", time.Now().Format(time.RFC3339), "level", level.String(),
+		"msg", msg)
+	pairs = append(pairs, l.fields...)
+	pairs = append(pairs, kv...)
+	if len(pairs)%2 != 0 {
+		pairs = append(pairs, "!MISSING")
+	}
+
+	var buf bytes.Buffer
+	if l.json {
+		writeJSON(&buf, pairs)
+	} else {
+		writeText(&buf, pairs)
+	}
+	buf.WriteByte('\n')
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+func writeText(buf *bytes.Buffer, pairs []interface{}) {
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(pairs[i]))
+		buf.WriteByte('=')
+		s := valueString(pairs[i+1])
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, pairs []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(pairs[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+		value := pairs[i+1]
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case fmt.Stringer:
+			value = v.String()
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			b, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buf.Write(b)
+	}
+	buf.WriteByte('}')
+}
+
+func valueString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx that carries the given logger.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger if there
+// is none.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+	return defaultLogger
+}
+
+// SetDefault sets the logger returned by Default and by FromContext for contexts
+// without logger. It must be called before the logger is used concurrently.
+func SetDefault(l *Logger) {
+	defaultLogger = l
+}
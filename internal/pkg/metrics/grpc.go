@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryClientInterceptor returns an interceptor that records the latency and
+// status code of the unary calls to the given backend.
+func UnaryClientInterceptor(backend string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		observeCall(backend, method, start, err)
+		return err
+	}
+}
+
+// StreamClientInterceptor returns an interceptor that records the latency and
+// status code of the streaming calls to the given backend. The latency is the
+// time until the stream is over.
+func StreamClientInterceptor(backend string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+		method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		start := time.Now()
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			observeCall(backend, method, start, err)
+			return nil, err
+		}
+		return &observedStream{
+			ClientStream: stream,
+			backend:      backend,
+			method:       method,
+			start:        start,
+		}, nil
+	}
+}
+
+// observedStream records the call once the first error, io.EOF included, is
+// received from the stream.
+type observedStream struct {
+	grpc.ClientStream
+	backend string
+	method  string
+	start   time.Time
+	once    sync.Once
+}
+
+func (s *observedStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.once.Do(func() {
+			if err == io.EOF {
+				observeCall(s.backend, s.method, s.start, nil)
+			} else {
+				observeCall(s.backend, s.method, s.start, err)
+			}
+		})
+	}
+	return err
+}
+
+func observeCall(backend, method string, start time.Time, err error) {
+	code := status.Code(err).String()
+	GRPCDuration.WithLabelValues(backend, method, code).Observe(time.Since(start).Seconds())
+}
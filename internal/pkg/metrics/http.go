@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Middleware records the count and latency of the requests to the routes of a
+// mux.Router, labeled by the template of the route rather than by the path, so
+// that the number of series is bounded.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := "unknown"
+		if r := mux.CurrentRoute(req); r != nil {
+			if tpl, err := r.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, req)
+
+		HTTPDuration.WithLabelValues(route, req.Method).Observe(time.Since(start).Seconds())
+		HTTPRequests.WithLabelValues(route, req.Method, strconv.Itoa(rec.status)).Inc()
+		if rec.status == http.StatusPartialContent {
+			PartialResponses.WithLabelValues(route).Inc()
+		}
+	})
+}
+
+// statusRecorder keeps the status code written to the response. It supports
+// hijacking and flushing, so that websockets and streams keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	// The connection is taken over by the handler; it is recorded as switching
+	// protocols.
+	r.status = http.StatusSwitchingProtocols
+	r.wroteHeader = true
+	return h.Hijack()
+}
@@ -0,0 +1,191 @@
+// Package metrics holds the Prometheus collectors of the site and the helpers
+// to record them.
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "cherosite"
+
+var (
+	// HTTPRequests counts the requests by route template, method and status code.
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	// HTTPDuration observes the latency of the requests by route template and
+	// method.
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of HTTP requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// PartialResponses counts the responses with status 206 Partial Content by
+	// route template.
+	PartialResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "partial_responses_total",
+		Help:      "Number of 206 Partial Content responses by route.",
+	}, []string{"route"})
+
+	// GRPCDuration observes the latency of the calls to the gRPC services by
+	// backend, method and status code.
+	GRPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "grpc",
+		Name:      "client_call_duration_seconds",
+		Help:      "Latency of gRPC calls by backend, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "method", "code"})
+
+	// FeedItems observes the number of contents returned in every feed by type
+	// of feed.
+	FeedItems = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "feed",
+		Name:      "items",
+		Help:      "Number of contents returned in a feed by type of feed.",
+		Buckets:   []float64{0, 1, 2, 5, 10, 20, 50},
+	}, []string{"feed"})
+
+	// OnlineUsers is the number of users registered in the hub.
+	OnlineUsers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "hub",
+		Name:      "online_users",
+		Help:      "Number of users connected to the live notifications hub.",
+	})
+
+	// OnlineConns is the number of connections registered in the hub, which
+	// may be more than one per user.
+	OnlineConns = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "hub",
+		Name:      "connections",
+		Help:      "Number of connections to the live notifications hub.",
+	})
+
+	// DroppedNotifs counts the notifications that could not be delivered to an
+	// online user.
+	DroppedNotifs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "hub",
+		Name:      "dropped_notifications_total",
+		Help:      "Number of notifications dropped because the connection was stuck.",
+	})
+
+	// DroppedEvents counts the events of the topics that could not be delivered
+	// to a subscribed connection.
+	DroppedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "hub",
+		Name:      "dropped_events_total",
+		Help:      "Number of topic events dropped because the connection was too slow.",
+	})
+
+	// BusErrors counts the messages that could not be published to the bus of
+	// the hub and the subscriptions to the bus that were lost.
+	BusErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "hub",
+		Name:      "bus_errors_total",
+		Help:      "Number of failed publications to the bus and lost subscriptions.",
+	})
+
+	// KickedConns counts the connections closed because their session ended or
+	// their user was deleted.
+	KickedConns = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "hub",
+		Name:      "kicked_connections_total",
+		Help:      "Number of connections closed because their session ended.",
+	})
+
+	// RejectedConns counts the live connections refused, by reason: "origin"
+	// or "limit".
+	RejectedConns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "hub",
+		Name:      "rejected_connections_total",
+		Help:      "Number of live connections refused by reason.",
+	}, []string{"reason"})
+
+	// ForcedUnregisters counts the connections unregistered by the hub because
+	// they were stuck.
+	ForcedUnregisters = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "hub",
+		Name:      "forced_unregisters_total",
+		Help:      "Number of connections unregistered because they were stuck.",
+	})
+
+	// RateLimited counts the requests rejected for exceeding the rate limit of
+	// their class of routes.
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "rate_limited_requests_total",
+		Help:      "Number of requests rejected by the rate limits by class of routes.",
+	}, []string{"class"})
+
+	// LoginLockouts counts the usernames locked out after repeated failed
+	// logins.
+	LoginLockouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "login_lockouts_total",
+		Help:      "Number of usernames locked out after repeated failed logins.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		HTTPRequests,
+		HTTPDuration,
+		PartialResponses,
+		GRPCDuration,
+		FeedItems,
+		OnlineUsers,
+		OnlineConns,
+		DroppedNotifs,
+		DroppedEvents,
+		BusErrors,
+		KickedConns,
+		RejectedConns,
+		ForcedUnregisters,
+		RateLimited,
+		LoginLockouts,
+	)
+}
+
+// Handler returns the handler that exposes the metrics in the Prometheus format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// BasicAuth returns a handler that passes the requests to h only if they carry
+// the given username and password with HTTP basic authentication.
+func BasicAuth(h http.Handler, username, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, pass, ok := req.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
@@ -2,7 +2,9 @@ package pagination
 
 import (
 	"encoding/gob"
+	"sort"
 	"sync"
+	"time"
 
 	pbApi "github.com/luisguve/cheroproto-go/cheroapi"
 	pbContext "github.com/luisguve/cheroproto-go/context"
@@ -32,6 +34,223 @@ type DiscardIds struct {
 	ThreadComments map[string][]string
 	// GeneralThreads maps section names to threads ids.
 	GeneralThreads map[string][]string
+	// Accessed maps the keys of the pagination contexts, as returned by
+	// contextKey, to the last time their ids were updated.
+	Accessed map[string]time.Time
+}
+
+// NewDiscardIds returns a DiscardIds with no contents seen.
+func NewDiscardIds() *DiscardIds {
+	d := &DiscardIds{}
+	d.init()
+	return d
+}
+
+// init makes the maps that are nil, as gob does not encode empty maps.
+func (d *DiscardIds) init() {
+	if d.UserActivity == nil {
+		d.UserActivity = make(map[string]Activity)
+	}
+	if d.FeedActivity == nil {
+		d.FeedActivity = make(map[string]Activity)
+	}
+	if d.SavedThreads == nil {
+		d.SavedThreads = make(map[string][]string)
+	}
+	if d.SectionThreads == nil {
+		d.SectionThreads = make(map[string][]string)
+	}
+	if d.ThreadComments == nil {
+		d.ThreadComments = make(map[string][]string)
+	}
+	if d.GeneralThreads == nil {
+		d.GeneralThreads = make(map[string][]string)
+	}
+	if d.Accessed == nil {
+		d.Accessed = make(map[string]time.Time)
+	}
+}
+
+// clone returns a deep copy of d.
+func (d *DiscardIds) clone() *DiscardIds {
+	return &DiscardIds{
+		UserActivity:   cloneActivities(d.UserActivity),
+		FeedActivity:   cloneActivities(d.FeedActivity),
+		SavedThreads:   cloneIds(d.SavedThreads),
+		SectionThreads: cloneIds(d.SectionThreads),
+		ThreadComments: cloneIds(d.ThreadComments),
+		GeneralThreads: cloneIds(d.GeneralThreads),
+		Accessed:       cloneTimes(d.Accessed),
+	}
+}
+
+func cloneTimes(m map[string]time.Time) map[string]time.Time {
+	result := make(map[string]time.Time, len(m))
+	for k, t := range m {
+		result[k] = t
+	}
+	return result
+}
+
+func cloneIds(m map[string][]string) map[string][]string {
+	result := make(map[string][]string, len(m))
+	for k, ids := range m {
+		result[k] = append([]string(nil), ids...)
+	}
+	return result
+}
+
+func cloneActivities(m map[string]Activity) map[string]Activity {
+	result := make(map[string]Activity, len(m))
+	for k, a := range m {
+		result[k] = Activity{
+			Subcomments:    append([]Subcomment(nil), a.Subcomments...),
+			Comments:       append([]Comment(nil), a.Comments...),
+			ThreadsCreated: append([]Thread(nil), a.ThreadsCreated...),
+		}
+	}
+	return result
+}
+
+// Kinds of pagination contexts. Contexts of the kinds UserActivity,
+// SectionThreads and ThreadComments are identified by the key of their ids in
+// the corresponding field of DiscardIds, whereas the ids of the other kinds
+// belong all to the same context, identified by an empty string.
+const (
+	KindUserActivity   = "user_activity"
+	KindFeedActivity   = "feed_activity"
+	KindSavedThreads   = "saved_threads"
+	KindSectionThreads = "section_threads"
+	KindThreadComments = "thread_comments"
+	KindGeneralThreads = "general_threads"
+)
+
+// Limits bounds the ids kept by a DiscardIds. A zero value sets no limit.
+type Limits struct {
+	// MaxIds is the maximum number of ids of every kind of content kept per
+	// context and key; the ids seen first are dropped first.
+	MaxIds int
+	// MaxContexts is the maximum number of contexts kept; the least recently
+	// accessed ones are dropped first.
+	MaxContexts int
+	// MaxAge is the time a context is kept without being accessed.
+	MaxAge time.Duration
+}
+
+// DefaultLimits are the limits used when none are set.
+var DefaultLimits = Limits{
+	MaxIds:      500,
+	MaxContexts: 50,
+	MaxAge:      6 * time.Hour,
+}
+
+// contextKey returns the key of the given context in Accessed.
+func contextKey(kind, id string) string {
+	return kind + "/" + id
+}
+
+// Touch records that the ids of the given context were just updated.
+func (d *DiscardIds) Touch(kind, id string) {
+	d.Accessed[contextKey(kind, id)] = time.Now()
+}
+
+// Reset drops the ids of the given context, so that its pagination starts over,
+// and records that it was just accessed.
+func (d *DiscardIds) Reset(kind, id string) {
+	switch kind {
+	case KindUserActivity:
+		delete(d.UserActivity, id)
+	case KindSectionThreads:
+		delete(d.SectionThreads, id)
+	case KindThreadComments:
+		delete(d.ThreadComments, id)
+	case KindFeedActivity:
+		d.FeedActivity = make(map[string]Activity)
+	case KindSavedThreads:
+		d.SavedThreads = make(map[string][]string)
+	case KindGeneralThreads:
+		d.GeneralThreads = make(map[string][]string)
+	}
+	d.Touch(kind, id)
+}
+
+// pruneContext is a context considered by Prune.
+type pruneContext struct {
+	key      string
+	accessed time.Time
+	drop     func()
+}
+
+// Prune drops the contexts that have not been accessed for longer than the
+// maximum age and the least recently accessed contexts above the maximum
+// number, and keeps only the ids seen last of every context within the
+// maximum number of ids. Contexts without access time are considered as just
+// accessed.
+func (d *DiscardIds) Prune(l Limits) {
+	now := time.Now()
+	var contexts []pruneContext
+	add := func(kind, id string, drop func()) {
+		key := contextKey(kind, id)
+		accessed, ok := d.Accessed[key]
+		if !ok {
+			accessed = now
+		}
+		contexts = append(contexts, pruneContext{key, accessed, drop})
+	}
+	for id := range d.UserActivity {
+		id := id
+		add(KindUserActivity, id, func() { delete(d.UserActivity, id) })
+	}
+	for id := range d.SectionThreads {
+		id := id
+		add(KindSectionThreads, id, func() { delete(d.SectionThreads, id) })
+	}
+	for id := range d.ThreadComments {
+		id := id
+		add(KindThreadComments, id, func() { delete(d.ThreadComments, id) })
+	}
+	if len(d.FeedActivity) > 0 {
+		add(KindFeedActivity, "", func() { d.FeedActivity = make(map[string]Activity) })
+	}
+	if len(d.SavedThreads) > 0 {
+		add(KindSavedThreads, "", func() { d.SavedThreads = make(map[string][]string) })
+	}
+	if len(d.GeneralThreads) > 0 {
+		add(KindGeneralThreads, "", func() { d.GeneralThreads = make(map[string][]string) })
+	}
+
+	// Keep the most recently accessed contexts, forgetting the access time of
+	// the dropped ones and of the contexts without ids.
+	sort.Slice(contexts, func(i, j int) bool {
+		return contexts[i].accessed.After(contexts[j].accessed)
+	})
+	accessed := make(map[string]time.Time, len(contexts))
+	for i, c := range contexts {
+		expired := l.MaxAge > 0 && now.Sub(c.accessed) > l.MaxAge
+		if expired || (l.MaxContexts > 0 && i >= l.MaxContexts) {
+			c.drop()
+			continue
+		}
+		accessed[c.key] = c.accessed
+	}
+	d.Accessed = accessed
+
+	if l.MaxIds <= 0 {
+		return
+	}
+	for _, m := range []map[string][]string{d.SavedThreads, d.SectionThreads,
+		d.ThreadComments, d.GeneralThreads} {
+		for k, ids := range m {
+			if len(ids) > l.MaxIds {
+				m[k] = append([]string(nil), ids[len(ids)-l.MaxIds:]...)
+			}
+		}
+	}
+	for _, m := range []map[string]Activity{d.UserActivity, d.FeedActivity} {
+		for k, a := range m {
+			m[k] = a.keepLast(l.MaxIds)
+		}
+	}
 }
 
 // FormatSectionThreads is an utility function to get and return the thread
@@ -164,6 +383,21 @@ type Activity struct {
 	ThreadsCreated []Thread
 }
 
+// keepLast returns a copy of a holding only the last n threads, comments and
+// subcomments.
+func (a Activity) keepLast(n int) Activity {
+	if len(a.Subcomments) > n {
+		a.Subcomments = append([]Subcomment(nil), a.Subcomments[len(a.Subcomments)-n:]...)
+	}
+	if len(a.Comments) > n {
+		a.Comments = append([]Comment(nil), a.Comments[len(a.Comments)-n:]...)
+	}
+	if len(a.ThreadsCreated) > n {
+		a.ThreadsCreated = append([]Thread(nil), a.ThreadsCreated[len(a.ThreadsCreated)-n:]...)
+	}
+	return a
+}
+
 // A thread is in a section and has an id
 type Thread struct {
 	SectionName string
@@ -0,0 +1,273 @@
+package pagination
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SeenStore keeps the ids of the contents already seen by every session, so that
+// they are discarded from the next loads of the feeds. Entries expire after a
+// period of time without being updated.
+type SeenStore interface {
+	// Get returns the ids stored under key, or nil if there is no entry or it
+	// has expired. The returned DiscardIds is a copy and can be modified freely.
+	Get(key string) (*DiscardIds, error)
+	// Update calls fn with the ids stored under key, or with empty ids if there
+	// is no entry, and stores the ids modified by fn, resetting the expiration
+	// of the entry. Updates of the same key are serialized.
+	Update(key string, fn func(*DiscardIds)) error
+	// Delete removes the entry stored under key, if any.
+	Delete(key string) error
+}
+
+// Default settings of the SeenStores.
+const (
+	DefaultSeenCapacity = 10000
+	DefaultSeenTTL      = 24 * time.Hour
+)
+
+var errInvalidKey = errors.New("invalid seen store key")
+
+// validKey reports whether key is not empty and is made only of letters,
+// digits, '-' and '_', so that it is safe to use as a file name.
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// MemorySeenStore is a SeenStore that keeps the entries in memory. It holds at
+// most a fixed number of entries, evicting the least recently used ones.
+type MemorySeenStore struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	// lru holds the entries from the most to the least recently used one.
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key     string
+	ids     *DiscardIds
+	expires time.Time
+}
+
+// NewMemorySeenStore returns a SeenStore that holds up to capacity entries in
+// memory, each of them expiring after ttl without being updated.
+func NewMemorySeenStore(capacity int, ttl time.Duration) *MemorySeenStore {
+	return &MemorySeenStore{
+		capacity: capacity,
+		ttl:      ttl,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (s *MemorySeenStore) Get(key string) (*DiscardIds, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.lookup(key)
+	if e == nil {
+		return nil, nil
+	}
+	s.lru.MoveToFront(e)
+	return e.Value.(*memoryEntry).ids.clone(), nil
+}
+
+func (s *MemorySeenStore) Update(key string, fn func(*DiscardIds)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.lookup(key)
+	if e == nil {
+		e = s.lru.PushFront(&memoryEntry{key: key, ids: NewDiscardIds()})
+		s.entries[key] = e
+		// Make room for the new entry.
+		for s.lru.Len() > s.capacity {
+			s.remove(s.lru.Back())
+		}
+	} else {
+		s.lru.MoveToFront(e)
+	}
+	entry := e.Value.(*memoryEntry)
+	fn(entry.ids)
+	entry.expires = time.Now().Add(s.ttl)
+	return nil
+}
+
+func (s *MemorySeenStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok {
+		s.remove(e)
+	}
+	return nil
+}
+
+// lookup returns the element of the entry stored under key, or nil if there is
+// no entry or it has expired, in which case it is removed.
+func (s *MemorySeenStore) lookup(key string) *list.Element {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.Value.(*memoryEntry).expires) {
+		s.remove(e)
+		return nil
+	}
+	return e
+}
+
+func (s *MemorySeenStore) remove(e *list.Element) {
+	s.lru.Remove(e)
+	delete(s.entries, e.Value.(*memoryEntry).key)
+}
+
+// FileSeenStore is a SeenStore that keeps every entry gob-encoded in a file in a
+// directory. The modification time of the file tells when the entry expires.
+type FileSeenStore struct {
+	mu  sync.Mutex
+	dir string
+	ttl time.Duration
+}
+
+// NewFileSeenStore returns a SeenStore that keeps the entries in dir, creating it
+// if it does not exist. Every entry expires after ttl without being updated.
+func NewFileSeenStore(dir string, ttl time.Duration) (*FileSeenStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileSeenStore{dir: dir, ttl: ttl}, nil
+}
+
+func (s *FileSeenStore) Get(key string) (*DiscardIds, error) {
+	if !validKey(key) {
+		return nil, errInvalidKey
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(key)
+}
+
+func (s *FileSeenStore) Update(key string, fn func(*DiscardIds)) error {
+	if !validKey(key) {
+		return errInvalidKey
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.load(key)
+	if err != nil {
+		return err
+	}
+	if ids == nil {
+		ids = NewDiscardIds()
+	}
+	fn(ids)
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(ids); err != nil {
+		return fmt.Errorf("could not encode seen ids: %w", err)
+	}
+	// Write to a temporary file and rename it, so that the entry is never left
+	// half written.
+	tmp, err := ioutil.TempFile(s.dir, key+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+func (s *FileSeenStore) Delete(key string) error {
+	if !validKey(key) {
+		return errInvalidKey
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Purge removes the expired entries. It should be called periodically, since
+// entries that are never requested again are not removed otherwise.
+func (s *FileSeenStore) Purge() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".gob" || !s.expired(f) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, f.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// load returns the entry stored under key, or nil if there is no entry or it
+// has expired, in which case it is removed. s.mu must be held.
+func (s *FileSeenStore) load(key string) (*DiscardIds, error) {
+	path := s.path(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if s.expired(info) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ids := &DiscardIds{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(ids); err != nil {
+		return nil, fmt.Errorf("could not decode seen ids: %w", err)
+	}
+	ids.init()
+	return ids, nil
+}
+
+func (s *FileSeenStore) expired(info os.FileInfo) bool {
+	return time.Since(info.ModTime()) > s.ttl
+}
+
+func (s *FileSeenStore) path(key string) string {
+	return filepath.Join(s.dir, key+".gob")
+}
@@ -0,0 +1,204 @@
+// Package ratelimit implements token bucket rate limiters keyed by client, and
+// a lockout of the keys with repeated failures, such as the usernames whose
+// logins keep failing. Both are kept in memory, so every instance of the site
+// limits the requests it receives on its own.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is the number of calls between sweeps of the entries that no
+// longer hold any state.
+const sweepInterval = 1000
+
+// Policy is the rate a client is allowed to make requests at.
+type Policy struct {
+	// Rate is the number of requests allowed per second in the long run.
+	Rate float64
+	// Burst is the number of requests allowed at once.
+	Burst int
+}
+
+// Limiter limits the rate of the requests of every key with a token bucket: the
+// bucket of a key holds up to Burst tokens, a token is added Rate times per
+// second and every request takes one. A nil Limiter allows every request.
+type Limiter struct {
+	mu      sync.Mutex
+	policy  Policy
+	buckets map[string]*bucket
+	calls   int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter with the given policy, or nil if the policy
+// allows no burst or no rate, that is, if it sets no limit.
+func NewLimiter(p Policy) *Limiter {
+	if p.Rate <= 0 || p.Burst <= 0 {
+		return nil
+	}
+	return &Limiter{
+		policy:  p,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket of key. If the bucket is empty, it returns
+// false along with the time until a token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.policy.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.refill(l.policy, now)
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.policy.Rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets that are full again, which are the same as no bucket,
+// every sweepInterval calls. l.mu must be held.
+func (l *Limiter) sweep(now time.Time) {
+	l.calls++
+	if l.calls%sweepInterval != 0 {
+		return
+	}
+	for key, b := range l.buckets {
+		b.refill(l.policy, now)
+		if b.tokens >= float64(l.policy.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (b *bucket) refill(p Policy, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * p.Rate
+	if b.tokens > float64(p.Burst) {
+		b.tokens = float64(p.Burst)
+	}
+	b.last = now
+}
+
+// LockoutPolicy sets when a key is locked out.
+type LockoutPolicy struct {
+	// MaxFailures is the number of failures within Window that lock a key out.
+	MaxFailures int
+	Window      time.Duration
+	// Duration is the time a key stays locked out.
+	Duration time.Duration
+}
+
+// Lockout locks out the keys that fail too often. A nil Lockout never locks
+// a key out.
+type Lockout struct {
+	mu      sync.Mutex
+	policy  LockoutPolicy
+	entries map[string]*failures
+	calls   int
+}
+
+type failures struct {
+	count int
+	// first is the time of the first failure of the current window.
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// NewLockout returns a Lockout with the given policy, or nil if the policy
+// never locks a key out.
+func NewLockout(p LockoutPolicy) *Lockout {
+	if p.MaxFailures <= 0 || p.Window <= 0 || p.Duration <= 0 {
+		return nil
+	}
+	return &Lockout{
+		policy:  p,
+		entries: make(map[string]*failures),
+	}
+}
+
+// Locked returns the time until key is no longer locked out, or zero if it is
+// not locked out.
+func (l *Lockout) Locked(key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.entries[key]
+	if !ok {
+		return 0
+	}
+	if wait := time.Until(f.lockedUntil); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Fail records a failure of key. It returns the time key is locked out for if
+// the failure locked it out, or zero otherwise.
+func (l *Lockout) Fail(key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	f, ok := l.entries[key]
+	if !ok || now.Sub(f.first) > l.policy.Window {
+		f = &failures{first: now}
+		l.entries[key] = f
+	}
+	f.count++
+	if f.count < l.policy.MaxFailures {
+		return 0
+	}
+	// Start a new window once the lockout is over.
+	f.count = 0
+	f.first = now.Add(l.policy.Duration)
+	f.lockedUntil = f.first
+	return l.policy.Duration
+}
+
+// Reset forgets the failures of key, e.g. after it succeeds. It does not lift a
+// lockout in effect.
+func (l *Lockout) Reset(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.entries[key]; ok && time.Now().After(f.lockedUntil) {
+		delete(l.entries, key)
+	}
+}
+
+// sweep drops the entries whose window and lockout are over every
+// sweepInterval calls. l.mu must be held.
+func (l *Lockout) sweep(now time.Time) {
+	l.calls++
+	if l.calls%sweepInterval != 0 {
+		return
+	}
+	for key, f := range l.entries {
+		if now.Sub(f.first) > l.policy.Window && now.After(f.lockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
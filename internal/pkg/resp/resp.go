@@ -0,0 +1,151 @@
+// Package resp implements a minimal client of the Redis protocol (RESP), enough
+// for the session store and the pub/sub bus of the live notifications to talk to
+// Redis, KeyDB, Valkey or any other server that speaks it.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Options holds the settings of the connections to a server.
+type Options struct {
+	// Addr is the address of the server, e.g. "localhost:6379".
+	Addr string
+	// Password is sent with AUTH if it is not empty.
+	Password string
+	// DB is the number of the database selected with SELECT.
+	DB int
+	// Timeout is the deadline of dialing and of every command.
+	Timeout time.Duration
+}
+
+// Error is an error replied by the server.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// Conn is a connection to a server that speaks RESP.
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Dial opens a connection to the server, authenticates it and selects the
+// database set in opts.
+func Dial(opts Options) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", opts.Addr, opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{Conn: conn, r: bufio.NewReader(conn)}
+	if opts.Password != "" {
+		if _, err := c.Do(opts.Timeout, "AUTH", opts.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if opts.DB != 0 {
+		if _, err := c.Do(opts.Timeout, "SELECT", strconv.Itoa(opts.DB)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Do sends a command and reads its reply, which is either nil, a string for
+// simple strings, an int64 for integers, a []byte for bulk strings or an
+// []interface{} for arrays. Errors replied by the server are returned as an
+// Error.
+func (c *Conn) Do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := c.Send(timeout, args...); err != nil {
+		return nil, err
+	}
+	return c.Receive(timeout)
+}
+
+// Send sends a command without reading its reply. It may be called while
+// another goroutine waits for a reply in Receive, as long as no other goroutine
+// sends at the same time.
+func (c *Conn) Send(timeout time.Duration, args ...string) error {
+	if err := c.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(c.Conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return w.Flush()
+}
+
+// Receive reads the next reply, as Do does, waiting for it for up to timeout.
+// The messages of the channels a connection is subscribed to are read with it.
+func (c *Conn) Receive(timeout time.Duration) (interface{}, error) {
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *Conn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			// $-1 is a null bulk string.
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		res := make([]interface{}, n)
+		for i := range res {
+			if res[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// readLine reads a line terminated by CRLF, without the terminator.
+func (c *Conn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
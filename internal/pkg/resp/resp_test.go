@@ -0,0 +1,149 @@
+package resp_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/luisguve/cherosite/internal/pkg/resp"
+	"github.com/luisguve/cherosite/internal/pkg/resp/resptest"
+)
+
+func newServer(t *testing.T) *resptest.Server {
+	t.Helper()
+	s, err := resptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestDialAuthSelect(t *testing.T) {
+	s := newServer(t)
+	s.Password = "secret"
+
+	var redisErr resp.Error
+	// SELECT fails without the password.
+	_, err := resp.Dial(resp.Options{Addr: s.Addr, DB: 1, Timeout: time.Second})
+	if !errors.As(err, &redisErr) {
+		t.Errorf("Dial without password = %v, want an Error", err)
+	}
+	_, err = resp.Dial(resp.Options{Addr: s.Addr, Password: "wrong", Timeout: time.Second})
+	if !errors.As(err, &redisErr) {
+		t.Errorf("Dial with the wrong password = %v, want an Error", err)
+	}
+	_, err = resp.Dial(resp.Options{Addr: s.Addr, Password: "secret", DB: 16, Timeout: time.Second})
+	if !errors.As(err, &redisErr) {
+		t.Errorf("Dial of an invalid DB = %v, want an Error", err)
+	}
+
+	c, err := resp.Dial(resp.Options{Addr: s.Addr, Password: "secret", DB: 3, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Do(time.Second, "SET", "k", "v"); err != nil {
+		t.Fatalf("SET: %v", err)
+	}
+	if v, ok := s.Get(3, "k"); !ok || v != "v" {
+		t.Errorf("key in DB 3 = %q, %v; want the value set", v, ok)
+	}
+	if _, ok := s.Get(0, "k"); ok {
+		t.Error("key set in DB 0")
+	}
+}
+
+func TestDialWithoutDB(t *testing.T) {
+	s := newServer(t)
+	c, err := resp.Dial(resp.Options{Addr: s.Addr, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	c.Close()
+	// Neither AUTH nor SELECT are sent if they are not needed.
+	if cmds := s.Commands(); len(cmds) != 0 {
+		t.Errorf("commands = %v, want none", cmds)
+	}
+}
+
+func TestDo(t *testing.T) {
+	s := newServer(t)
+	c, err := resp.Dial(resp.Options{Addr: s.Addr, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tests := []struct {
+		args []string
+		want interface{}
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"GET", "k"}, nil},
+		{[]string{"SET", "k", "a\r\nvalue"}, "OK"},
+		{[]string{"GET", "k"}, []byte("a\r\nvalue")},
+		{[]string{"SET", "empty", ""}, "OK"},
+		{[]string{"GET", "empty"}, []byte{}},
+		{[]string{"SET", "t", "v", "PX", "1500"}, "OK"},
+		{[]string{"DEL", "k", "t", "missing"}, int64(2)},
+		{[]string{"GET", "k"}, nil},
+		{[]string{"SUBSCRIBE", "ch"}, []interface{}{[]byte("subscribe"), []byte("ch"), int64(1)}},
+	}
+	for _, tt := range tests {
+		got, err := c.Do(time.Second, tt.args...)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v = %#v, want %#v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestErrorReplies(t *testing.T) {
+	s := newServer(t)
+	c, err := resp.Dial(resp.Options{Addr: s.Addr, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s.Fail("GET", "LOADING server is loading")
+	_, err = c.Do(time.Second, "GET", "k")
+	var redisErr resp.Error
+	if !errors.As(err, &redisErr) || string(redisErr) != "LOADING server is loading" {
+		t.Fatalf("GET = %v, want the error replied", err)
+	}
+	if err.Error() != "redis: LOADING server is loading" {
+		t.Errorf("Error() = %q", err.Error())
+	}
+	// The connection is still usable after an error reply.
+	s.Fail("GET", "")
+	if _, err := c.Do(time.Second, "SET", "k", "v"); err != nil {
+		t.Fatalf("SET after an error reply: %v", err)
+	}
+	if got, err := c.Do(time.Second, "GET", "k"); err != nil || string(got.([]byte)) != "v" {
+		t.Errorf("GET after an error reply = %v, %v", got, err)
+	}
+	if _, err := c.Do(time.Second, "NOSUCHCOMMAND"); !errors.As(err, &redisErr) {
+		t.Errorf("unknown command = %v, want an Error", err)
+	}
+}
+
+func TestReceiveTimeout(t *testing.T) {
+	s := newServer(t)
+	c, err := resp.Dial(resp.Options{Addr: s.Addr, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	if _, err := c.Receive(50 * time.Millisecond); err == nil {
+		t.Fatal("Receive without a reply succeeded")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Receive waited %v", d)
+	}
+}
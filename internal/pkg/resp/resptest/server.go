@@ -0,0 +1,345 @@
+// Package resptest implements a server of the Redis protocol (RESP) for the
+// tests of the packages that talk to one. It knows the commands those packages
+// use: AUTH, SELECT, PING, GET, SET with PX, DEL, PUBLISH and SUBSCRIBE.
+package resptest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a RESP server listening on a local address. Its keys are kept in
+// memory and expire according to its clock, which only moves forward with
+// FastForward.
+type Server struct {
+	// Addr is the address the server listens on.
+	Addr string
+	// Password is the password required with AUTH before any other command,
+	// if it is not empty. It must be set before the server is used.
+	Password string
+
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu       sync.Mutex
+	now      time.Time
+	dbs      map[int]map[string]entry
+	subs     map[string]map[*conn]bool
+	conns    map[*conn]bool
+	fails    map[string]string
+	commands []string
+	closed   bool
+}
+
+type entry struct {
+	value   string
+	expires time.Time
+}
+
+// conn is a connection to the server.
+type conn struct {
+	net.Conn
+	// mu serializes the writes to the connection.
+	mu     sync.Mutex
+	w      *bufio.Writer
+	authed bool
+	db     int
+}
+
+// NewServer starts a Server on a local address. It must be closed with Close.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Addr:  ln.Addr().String(),
+		ln:    ln,
+		now:   time.Now(),
+		dbs:   make(map[int]map[string]entry),
+		subs:  make(map[string]map[*conn]bool),
+		conns: make(map[*conn]bool),
+		fails: make(map[string]string),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Close stops listening, closes the connections to the server and waits for
+// them to finish.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// CloseConns closes the connections open to the server, as a restart of the
+// server would, but keeps accepting new ones.
+func (s *Server) CloseConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// Fail makes the server reply to the next commands named cmd with the error
+// msg, until Fail is called again with an empty msg.
+func (s *Server) Fail(cmd, msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg == "" {
+		delete(s.fails, strings.ToUpper(cmd))
+		return
+	}
+	s.fails[strings.ToUpper(cmd)] = msg
+}
+
+// FastForward moves the clock of the server forward by d, expiring the keys
+// whose time to live is shorter.
+func (s *Server) FastForward(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = s.now.Add(d)
+}
+
+// Get returns the value of the key in the database db, if it is set and has
+// not expired.
+func (s *Server) Get(db int, key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.get(db, key)
+	return e.value, ok
+}
+
+// TTL returns the time to live of the key in the database db, or zero if it
+// never expires or is not set.
+func (s *Server) TTL(db int, key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.get(db, key)
+	if !ok || e.expires.IsZero() {
+		return 0
+	}
+	return e.expires.Sub(s.now)
+}
+
+// Commands returns the names of the commands received so far, in order.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Subscribers returns the number of connections subscribed to the channel.
+func (s *Server) Subscribers(channel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subs[channel])
+}
+
+// get returns the entry of the key if it has not expired. s.mu must be held.
+func (s *Server) get(db int, key string) (entry, bool) {
+	e, ok := s.dbs[db][key]
+	if ok && !e.expires.IsZero() && !s.now.Before(e.expires) {
+		delete(s.dbs[db], key)
+		return entry{}, false
+	}
+	return e, ok
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{Conn: nc, w: bufio.NewWriter(nc)}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return
+		}
+		s.conns[c] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+// handle reads the commands of the connection and replies to them until the
+// connection is closed.
+func (s *Server) handle(c *conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		for _, subs := range s.subs {
+			delete(subs, c)
+		}
+		s.mu.Unlock()
+		c.Close()
+	}()
+	r := bufio.NewReader(c)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.exec(c, args)
+	}
+}
+
+// exec runs the command made of args and writes the reply to the connection.
+func (s *Server) exec(c *conn, args []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd := strings.ToUpper(args[0])
+	s.commands = append(s.commands, cmd)
+	if msg, ok := s.fails[cmd]; ok {
+		c.reply("-" + msg)
+		return
+	}
+	if s.Password != "" && !c.authed && cmd != "AUTH" {
+		c.reply("-NOAUTH Authentication required.")
+		return
+	}
+	switch {
+	case cmd == "AUTH" && len(args) == 2:
+		if args[1] != s.Password {
+			c.reply("-WRONGPASS invalid username-password pair")
+			return
+		}
+		c.authed = true
+		c.reply("+OK")
+	case cmd == "SELECT" && len(args) == 2:
+		db, err := strconv.Atoi(args[1])
+		if err != nil || db < 0 || db > 15 {
+			c.reply("-ERR DB index is out of range")
+			return
+		}
+		c.db = db
+		c.reply("+OK")
+	case cmd == "PING":
+		c.reply("+PONG")
+	case cmd == "GET" && len(args) == 2:
+		e, ok := s.get(c.db, args[1])
+		if !ok {
+			c.reply("$-1")
+			return
+		}
+		c.reply(bulk(e.value))
+	case cmd == "SET" && (len(args) == 3 || len(args) == 5):
+		e := entry{value: args[2]}
+		if len(args) == 5 {
+			ms, err := strconv.ParseInt(args[4], 10, 64)
+			if strings.ToUpper(args[3]) != "PX" || err != nil || ms <= 0 {
+				c.reply("-ERR syntax error")
+				return
+			}
+			e.expires = s.now.Add(time.Duration(ms) * time.Millisecond)
+		}
+		if s.dbs[c.db] == nil {
+			s.dbs[c.db] = make(map[string]entry)
+		}
+		s.dbs[c.db][args[1]] = e
+		c.reply("+OK")
+	case cmd == "DEL" && len(args) >= 2:
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := s.get(c.db, key); ok {
+				delete(s.dbs[c.db], key)
+				n++
+			}
+		}
+		c.reply(":" + strconv.Itoa(n))
+	case cmd == "PUBLISH" && len(args) == 3:
+		msg := array(bulk("message"), bulk(args[1]), bulk(args[2]))
+		for sub := range s.subs[args[1]] {
+			sub.reply(msg)
+		}
+		c.reply(":" + strconv.Itoa(len(s.subs[args[1]])))
+	case cmd == "SUBSCRIBE" && len(args) >= 2:
+		for i, channel := range args[1:] {
+			if s.subs[channel] == nil {
+				s.subs[channel] = make(map[*conn]bool)
+			}
+			s.subs[channel][c] = true
+			c.reply(array(bulk("subscribe"), bulk(channel), ":"+strconv.Itoa(i+1)))
+		}
+	default:
+		c.reply(fmt.Sprintf("-ERR unknown command or wrong number of arguments for '%s'", args[0]))
+	}
+}
+
+// reply writes the encoded reply followed by CRLF. Errors are ignored: the
+// connection is closed by handle once its next command cannot be read.
+func (c *conn) reply(s string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w.WriteString(s + "\r\n")
+	c.w.Flush()
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s
+}
+
+func array(elems ...string) string {
+	return "*" + strconv.Itoa(len(elems)) + "\r\n" + strings.Join(elems, "\r\n")
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[0] != '*' {
+		return nil, fmt.Errorf("resptest: unexpected command %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("resptest: unexpected command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(line, "$"))
+		if err != nil || line[0] != '$' || size < 0 {
+			return nil, fmt.Errorf("resptest: unexpected argument %q", line)
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
@@ -0,0 +1,229 @@
+package router
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/luisguve/cherosite/internal/pkg/logging"
+)
+
+const (
+	// apiPrefix is the path under which the API routes are served.
+	apiPrefix = "/api/v1"
+	// apiTokenName is the name the tokens are signed with, so that they cannot
+	// be swapped with other values signed with the same key.
+	apiTokenName = "api_token"
+	// apiTokenPrefix precedes the ids of the tokens in the session registry,
+	// where they are kept along with the sessions of the users.
+	apiTokenPrefix = "api:"
+	// maxJSONBodySize is the maximum size of the JSON body of an API request.
+	maxJSONBodySize = 1 << 20 // 1 mb
+)
+
+// apiError is the object returned by the API when a request fails.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Status  int    `json:"status"`
+}
+
+// apiToken is the response to a successful token request.
+type apiToken struct {
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+	ExpiresAt int64  `json:"expires_at"` // Unix time in seconds
+}
+
+// tokenClaims are the values signed in a token: the user it was issued for and
+// the id it is registered with, so that it can be revoked.
+type tokenClaims struct {
+	UserId string `json:"user_id"`
+	Id     string `json:"id"`
+}
+
+// newTokenCodec returns a codec to sign and verify API tokens with the given
+// key. Tokens older than lifetime are rejected.
+func newTokenCodec(key []byte, lifetime time.Duration) *securecookie.SecureCookie {
+	codec := securecookie.New(key, nil)
+	codec.MaxAge(int(lifetime.Seconds()))
+	codec.SetSerializer(securecookie.JSONEncoder{})
+	return codec
+}
+
+// issueToken returns a new signed token for the given user, registered in the
+// session registry until it expires. Like the sessions, the tokens of a user are
+// revoked by unregistering them.
+func (r *Router) issueToken(userId string) (apiToken, error) {
+	claims := tokenClaims{UserId: userId, Id: randToken(32)}
+	expires := time.Now().Add(r.tokenLifetime)
+	if err := r.registry.Add(userId, apiTokenPrefix+claims.Id, expires); err != nil {
+		return apiToken{}, err
+	}
+	token, err := r.apiTokens.Encode(apiTokenName, claims)
+	if err != nil {
+		return apiToken{}, err
+	}
+	return apiToken{
+		Token:     token,
+		TokenType: "Bearer",
+		ExpiresAt: expires.Unix(),
+	}, nil
+}
+
+// decodeToken returns the claims of the bearer token in the Authorization header
+// of the request, if it is signed and has not expired. It does not check whether
+// the token was revoked; see tokenUser.
+func (r *Router) decodeToken(req *http.Request) (tokenClaims, bool) {
+	var claims tokenClaims
+	auth := req.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return claims, false
+	}
+	if err := r.apiTokens.Decode(apiTokenName, auth[len(prefix):], &claims); err != nil {
+		return claims, false
+	}
+	return claims, claims.UserId != "" && claims.Id != ""
+}
+
+// tokenUser returns the id of the user the bearer token in the Authorization
+// header of the request was issued for, or an empty string if there is no token
+// or it is not valid, that is, it expired or it was revoked.
+func (r *Router) tokenUser(req *http.Request) string {
+	claims, ok := r.decodeToken(req)
+	if !ok {
+		return ""
+	}
+	ok, err := r.registry.Contains(claims.UserId, apiTokenPrefix+claims.Id)
+	if err != nil {
+		logFor(req).Error("Could not check token", "err", err)
+		return ""
+	}
+	if !ok {
+		return ""
+	}
+	return claims.UserId
+}
+
+// revokeTokens revokes every token and session of the user and closes its live
+// connections, as "/logout/all" does.
+func (r *Router) revokeTokens(userId string) error {
+	if err := r.registry.RemoveAll(userId); err != nil {
+		return err
+	}
+	r.hub.Kick(userId, "", kickLoggedOut)
+	return nil
+}
+
+// replyAPIError replies to an API request of the given user with err, like
+// replyError. If the user is no longer registered, its tokens are revoked, as
+// its sessions are deleted by the rest of the routes.
+func (r *Router) replyAPIError(w http.ResponseWriter, req *http.Request, userId string,
+	err error) {
+	if err == errUnregistered {
+		logFor(req).Info("User unregistered; revoking tokens", "user", userId)
+		if err := r.revokeTokens(userId); err != nil {
+			logFor(req).Error("Could not revoke tokens", "err", err)
+		}
+	}
+	replyError(w, req, err)
+}
+
+// onlyAPIUsers middleware replies with an INVALID_TOKEN error if the request has
+// no valid bearer token, otherwise it executes the next handler passing it the
+// id of the user the token was issued for, the ResponseWriter and the Request.
+func (r *Router) onlyAPIUsers(next func(string, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		userId := r.tokenUser(req)
+		if userId == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			replyError(w, req, errInvalidToken)
+			return
+		}
+		next(userId, w, req)
+	}
+}
+
+// writeJSON replies to the request with v encoded in JSON format and the given
+// http status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	res, err := json.Marshal(v)
+	if err != nil {
+		logging.Default().Error("Could not encode response", "err", err)
+		status = http.StatusInternalServerError
+		res = []byte(`{"error":{"code":"INTERNAL_FAILURE","status":500}}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(res)
+}
+
+// writeAPIOK replies to the request with an object indicating the operation
+// succeeded.
+func writeAPIOK(w http.ResponseWriter) {
+	writeJSON(w, http.StatusOK, struct {
+		Ok bool `json:"ok"`
+	}{true})
+}
+
+// decodeJSON decodes the JSON body of the request into v.
+func decodeJSON(req *http.Request, v interface{}) error {
+	return json.NewDecoder(io.LimitReader(req.Body, maxJSONBodySize)).Decode(v)
+}
+
+// setupAPIRoutes sets up the routes of the API. All of them, but the one to
+// request a token, require a bearer token issued by the latter.
+func (r *Router) setupAPIRoutes() {
+	api := r.handler.PathPrefix(apiPrefix).Subrouter()
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		replyError(w, req, errNotFound)
+	})
+	api.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		replyError(w, req, errMethodNotAllowed)
+	})
+
+	// request a token with username and password
+	api.HandleFunc("/tokens", r.limit(ClassAuth, r.handleAPIToken)).Methods("POST")
+	// revoke the token of the request, or every token of the user
+	api.HandleFunc("/tokens", r.limit(ClassWrite, r.onlyAPIUsers(r.handleAPIRevokeToken))).Methods("DELETE")
+	api.HandleFunc("/tokens/all", r.limit(ClassWrite, r.onlyAPIUsers(r.handleAPIRevokeAll))).Methods("DELETE")
+
+	// follow and unfollow users
+	api.HandleFunc("/users/{username:[a-zA-Z0-9_]+}/follow", r.limit(ClassWrite, r.onlyAPIUsers(r.handleAPIFollow))).Methods("POST")
+	api.HandleFunc("/users/{username:[a-zA-Z0-9_]+}/follow", r.limit(ClassWrite, r.onlyAPIUsers(r.handleAPIUnfollow))).Methods("DELETE")
+
+	// create a thread
+	api.HandleFunc("/sections/{section}/threads", r.limit(ClassWrite, r.onlyAPIUsers(r.handleAPINewThread))).Methods("POST")
+
+	thread := api.PathPrefix("/sections/{section}/threads/{thread}").Subrouter()
+	// delete a thread
+	thread.HandleFunc("", r.limit(ClassWrite, r.onlyAPIUsers(r.handleAPIDelete))).Methods("DELETE")
+	// save and undo save a thread
+	thread.HandleFunc("/save", r.limit(ClassWrite, r.onlyAPIUsers(r.handleAPISave))).Methods("POST")
+	thread.HandleFunc("/save", r.limit(ClassWrite, r.onlyAPIUsers(r.handleAPIUndoSave))).Methods("DELETE")
+	// upvote and undo upvote a thread
+	thread.HandleFunc("/upvote", r.limit(ClassVote, r.onlyAPIUsers(r.handleAPIUpvote))).Methods("POST")
+	thread.HandleFunc("/upvote", r.limit(ClassVote, r.onlyAPIUsers(r.handleAPIUndoUpvote))).Methods("DELETE")
+	// post a comment
+	thread.HandleFunc("/comments", r.limit(ClassWrite, r.onlyAPIUsers(r.handleAPIComment))).Methods("POST")
+
+	comment := thread.PathPrefix("/comments/{c_id:[a-zA-Z0-9]+}").Subrouter()
+	// delete a comment
+	comment.HandleFunc("", r.limit(ClassWrite, r.onlyAPIUsers(r.handleAPIDelete))).Methods("DELETE")
+	// upvote and undo upvote a comment
+	comment.HandleFunc("/upvote", r.limit(ClassVote, r.onlyAPIUsers(r.handleAPIUpvote))).Methods("POST")
+	comment.HandleFunc("/upvote", r.limit(ClassVote, r.onlyAPIUsers(r.handleAPIUndoUpvote))).Methods("DELETE")
+	// post a subcomment
+	comment.HandleFunc("/replies", r.limit(ClassWrite, r.onlyAPIUsers(r.handleAPIComment))).Methods("POST")
+
+	subcomment := comment.PathPrefix("/replies/{sc_id:[a-zA-Z0-9]+}").Subrouter()
+	// delete a subcomment
+	subcomment.HandleFunc("", r.limit(ClassWrite, r.onlyAPIUsers(r.handleAPIDelete))).Methods("DELETE")
+	// upvote and undo upvote a subcomment
+	subcomment.HandleFunc("/upvote", r.limit(ClassVote, r.onlyAPIUsers(r.handleAPIUpvote))).Methods("POST")
+	subcomment.HandleFunc("/upvote", r.limit(ClassVote, r.onlyAPIUsers(r.handleAPIUndoUpvote))).Methods("DELETE")
+}
@@ -0,0 +1,73 @@
+package router
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/luisguve/cherosite/internal/pkg/livedata"
+	"github.com/luisguve/cherosite/internal/pkg/sessionstore"
+)
+
+// newTokenRouter returns a Router with just what the API tokens need.
+func newTokenRouter() *Router {
+	return &Router{
+		apiTokens:     newTokenCodec([]byte("0123456789abcdef0123456789abcdef"), time.Hour),
+		tokenLifetime: time.Hour,
+		registry:      sessionstore.NewRegistry(sessionstore.NewMemoryBackend()),
+		hub:           livedata.NewHub(nil, time.Second, nil, livedata.Options{}),
+	}
+}
+
+func TestTokenRevocation(t *testing.T) {
+	r := newTokenRouter()
+	issue := func(userId string) string {
+		t.Helper()
+		token, err := r.issueToken(userId)
+		if err != nil {
+			t.Fatalf("issueToken: %v", err)
+		}
+		return token.Token
+	}
+	user := func(token string) string {
+		req := httptest.NewRequest("DELETE", apiPrefix+"/tokens", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return r.tokenUser(req)
+	}
+
+	first, second := issue("u1"), issue("u1")
+	other := issue("u2")
+	for _, token := range []string{first, second} {
+		if got := user(token); got != "u1" {
+			t.Fatalf("tokenUser = %q, want u1", got)
+		}
+	}
+	if got := user("not a token"); got != "" {
+		t.Errorf("tokenUser of an invalid token = %q", got)
+	}
+
+	// Revoking a token leaves the rest valid.
+	req := httptest.NewRequest("DELETE", apiPrefix+"/tokens", nil)
+	req.Header.Set("Authorization", "Bearer "+first)
+	w := httptest.NewRecorder()
+	r.handleAPIRevokeToken("u1", w, req)
+	if w.Code != 200 {
+		t.Fatalf("revoke status = %d", w.Code)
+	}
+	if got := user(first); got != "" {
+		t.Errorf("revoked token still valid for %q", got)
+	}
+	if got := user(second); got != "u1" {
+		t.Errorf("tokenUser = %q, want u1", got)
+	}
+
+	// A user no longer registered loses every token, as after "/logout/all".
+	w = httptest.NewRecorder()
+	r.replyAPIError(w, req, "u1", errUnregistered)
+	if got := user(second); got != "" {
+		t.Errorf("token of unregistered user still valid for %q", got)
+	}
+	if got := user(other); got != "u2" {
+		t.Errorf("tokenUser = %q, want u2", got)
+	}
+}
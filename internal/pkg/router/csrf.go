@@ -0,0 +1,84 @@
+package router
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// csrfHeader is the header in which the pages send the CSRF token of the
+// session along with the requests that change the state of the site.
+const csrfHeader = "X-CSRF-Token"
+
+// loginPaths are the paths whose requests log a user in. Their requests are
+// checked even if no user is logged in, so that a page of another site can not
+// log the visitor in an account of the attacker.
+var loginPaths = map[string]bool{
+	"/login":  true,
+	"/signin": true,
+}
+
+// checkCSRF middleware rejects the requests that may change the state of the
+// site on behalf of a logged in user, that is, the requests of a session with a
+// logged in user with any method but GET, HEAD, OPTIONS and TRACE, that do not
+// carry the CSRF token of the session in the header X-CSRF-Token. Since a page
+// of another site can not read the token nor set the header, it can not forge
+// such requests. The requests of anonymous sessions act on behalf of no one, so
+// they are not checked, except the logins; see loginPaths.
+func (r *Router) checkCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, req)
+			return
+		}
+		if r.currentUser(req) == "" && !loginPaths[req.URL.Path] {
+			next.ServeHTTP(w, req)
+			return
+		}
+		expected := r.csrfToken(req)
+		token := req.Header.Get(csrfHeader)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			logFor(req).Warn("Rejected request without a valid CSRF token",
+				"method", req.Method, "path", req.URL.Path)
+			replyError(w, req, errInvalidCSRFToken)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// csrfToken returns the CSRF token of the session of the request, which is set
+// when the user logs in, or by issueCSRFToken for anonymous sessions. It is
+// empty if the session has none.
+func (r *Router) csrfToken(req *http.Request) string {
+	// Get always returns a session, even if empty
+	session, _ := r.store.Get(req, "session")
+	token, _ := session.Values["csrf_token"].(string)
+	return token
+}
+
+// issueCSRFToken returns the CSRF token of the session of the request, setting
+// a new one and saving the session if it has none, so that the login page can
+// send it along with the logins. As in setSeenKey, the session is saved holding
+// its lock and the token saved by a concurrent request is kept.
+func (r *Router) issueCSRFToken(req *http.Request, w http.ResponseWriter) (string, error) {
+	// Get always returns a session, even if empty
+	session, _ := r.store.Get(req, "session")
+	if token, ok := session.Values["csrf_token"].(string); ok {
+		return token, nil
+	}
+	if !session.IsNew {
+		mu := r.sessionLock(session.ID)
+		mu.Lock()
+		defer mu.Unlock()
+		if saved, err := r.store.New(req, "session"); err == nil {
+			if token, ok := saved.Values["csrf_token"].(string); ok {
+				session.Values["csrf_token"] = token
+				return token, nil
+			}
+		}
+	}
+	token := randToken(32)
+	session.Values["csrf_token"] = token
+	return token, session.Save(req, w)
+}
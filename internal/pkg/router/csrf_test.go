@@ -0,0 +1,75 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/luisguve/cherosite/internal/pkg/sessionstore"
+)
+
+func TestLoginCSRF(t *testing.T) {
+	backend := sessionstore.NewMemoryBackend()
+	r := &Router{
+		store:        sessionstore.New(backend, []byte("0123456789abcdef0123456789abcdef")),
+		registry:     sessionstore.NewRegistry(backend),
+		sessLifetime: time.Hour,
+	}
+	handler := r.withSession(r.checkCSRF(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	})))
+	post := func(path string, cookie *http.Cookie, token string) int {
+		req := httptest.NewRequest("POST", path, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		if token != "" {
+			req.Header.Set(csrfHeader, token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// A login forged by another site has no session nor token.
+	for _, path := range []string{"/login", "/signin"} {
+		if code := post(path, nil, ""); code != http.StatusForbidden {
+			t.Errorf("%s without a token: status = %d, want 403", path, code)
+		}
+	}
+	// The rest of the anonymous requests are not checked.
+	if code := post("/explore/recycle/reset", nil, ""); code != http.StatusOK {
+		t.Errorf("anonymous request: status = %d, want 200", code)
+	}
+
+	// The login page issues the token to the anonymous session.
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	token, err := r.issueCSRFToken(req, w)
+	if err != nil || token == "" {
+		t.Fatalf("issueCSRFToken = %q, %v", token, err)
+	}
+	cookie := w.Result().Cookies()[0]
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	if again, err := r.issueCSRFToken(req, w); err != nil || again != token {
+		t.Errorf("issueCSRFToken of the same session = %q, %v; want %q", again, err, token)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("session saved again")
+	}
+
+	if code := post("/login", cookie, "forged"); code != http.StatusForbidden {
+		t.Errorf("login with the wrong token: status = %d, want 403", code)
+	}
+	if code := post("/login", nil, token); code != http.StatusForbidden {
+		t.Errorf("login with the token of another session: status = %d, want 403", code)
+	}
+	for _, path := range []string{"/login", "/signin"} {
+		if code := post(path, cookie, token); code != http.StatusOK {
+			t.Errorf("%s with the token: status = %d, want 200", path, code)
+		}
+	}
+}
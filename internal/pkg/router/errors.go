@@ -0,0 +1,263 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/luisguve/cherosite/internal/pkg/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// httpError is an error replied to the client. Code is the machine readable
+// description of the error, Status the http status code it is replied with and
+// Message a human readable description of the error.
+type httpError struct {
+	Code    string
+	Status  int
+	Message string
+}
+
+func (e *httpError) Error() string {
+	return e.Code
+}
+
+// retryError is an httpError replied along with the header Retry-After, telling
+// the client how long to wait before trying again.
+type retryError struct {
+	*httpError
+	after time.Duration
+}
+
+func (e *retryError) Unwrap() error {
+	return e.httpError
+}
+
+// Errors replied to the client.
+var (
+	errNotFound           = &httpError{"NOT_FOUND", http.StatusNotFound, "The requested resource does not exist."}
+	errMethodNotAllowed   = &httpError{"METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed, "The method is not allowed on the resource."}
+	errInternalFailure    = &httpError{"INTERNAL_FAILURE", http.StatusInternalServerError, "An internal error occurred."}
+	errTemplate           = &httpError{"TEMPLATE_ERROR", http.StatusInternalServerError, "The page could not be rendered."}
+	errCookie             = &httpError{"COOKIE_ERROR", http.StatusServiceUnavailable, "The session could not be saved."}
+	errSectionUnavailable = &httpError{"SECTION_UNAVAILABLE", http.StatusServiceUnavailable, "The section is temporarily unavailable."}
+	errUpstreamTimeout    = &httpError{"UPSTREAM_TIMEOUT", http.StatusGatewayTimeout, "The service took too long to respond."}
+	errOutOfRange         = &httpError{"OUT_OF_RANGE", http.StatusBadRequest, "There are no more contents available."}
+	errInvalidOffset      = &httpError{"INVALID_OFFSET", http.StatusBadRequest, "The offset is not a positive number."}
+	errOffsetOOR          = &httpError{"OFFSET_OOR", http.StatusBadRequest, "The offset is out of range."}
+	errInvalidContext     = &httpError{"INVALID_CONTEXT", http.StatusBadRequest, "The context is not followers nor following."}
+
+	errUnregistered       = &httpError{"USER_UNREGISTERED", http.StatusUnauthorized, "The user is not registered."}
+	errUserUnauthorized   = &httpError{"USER_UNAUTHORIZED", http.StatusForbidden, "The user is not the author of the content."}
+	errUnableToPost       = &httpError{"USER_UNABLE_TO_POST", http.StatusForbidden, "The user has reached the limit of threads for today."}
+	errNotUpvoted         = &httpError{"NOT_UPVOTED", http.StatusBadRequest, "The user has not upvoted the content."}
+	errSelfFollow         = &httpError{"SELF_FOLLOW", http.StatusBadRequest, "A user cannot follow itself."}
+	errSelfUnfollow       = &httpError{"SELF_UNFOLLOW", http.StatusBadRequest, "A user cannot unfollow itself."}
+	errInvalidCredentials = &httpError{"INVALID_CREDENTIALS", http.StatusUnauthorized, "The username or the password are not valid."}
+	errInvalidToken       = &httpError{"INVALID_TOKEN", http.StatusUnauthorized, "The bearer token is missing, invalid or expired."}
+	errInvalidCSRFToken   = &httpError{"INVALID_CSRF_TOKEN", http.StatusForbidden, "The CSRF token is missing or invalid."}
+	errTooManyRequests    = &httpError{"TOO_MANY_REQUESTS", http.StatusTooManyRequests, "Too many requests; try again later."}
+	errLoginLocked        = &httpError{"LOGIN_LOCKED", http.StatusTooManyRequests, "Too many failed logins; try again later."}
+	errInvalidUsername    = &httpError{"INVALID_USERNAME", http.StatusBadRequest, "The username is not valid."}
+	errUsernameTaken      = &httpError{"USERNAME_UNAVAILABLE", http.StatusConflict, "The username is already in use."}
+	errEmailExists        = &httpError{"EMAIL_ALREADY_EXISTS", http.StatusConflict, "The email is already in use."}
+	errUsernameExists     = &httpError{"USERNAME_ALREADY_EXISTS", http.StatusConflict, "The username is already in use."}
+
+	errInvalidBody      = &httpError{"INVALID_BODY", http.StatusBadRequest, "The request body is not valid JSON."}
+	errNoContent        = &httpError{"NO_CONTENT", http.StatusBadRequest, "The content is empty."}
+	errNoTitle          = &httpError{"NO_TITLE", http.StatusBadRequest, "The title is empty."}
+	errMissingFile      = &httpError{"MISSING_ft_file_INPUT", http.StatusBadRequest, "The file is missing."}
+	errFileTooBig       = &httpError{"FILE_TOO_BIG", http.StatusRequestEntityTooLarge, "The file is greater than 64mb."}
+	errInvalidFile      = &httpError{"INVALID_FILE", http.StatusBadRequest, "The file could not be read."}
+	errInvalidFileType  = &httpError{"INVALID_FILE_TYPE", http.StatusBadRequest, "The file is not an image."}
+	errCantReadFileType = &httpError{"CANT_READ_FILE_TYPE", http.StatusInternalServerError, "The type of the file could not be read."}
+	errCantWriteFile    = &httpError{"CANT_WRITE_FILE", http.StatusInternalServerError, "The file could not be saved."}
+)
+
+// grpcErrors maps the gRPC status codes returned by an operation to the errors
+// replied to the client.
+type grpcErrors map[codes.Code]*httpError
+
+// Error tables of the operations of the users, general and section services.
+// Codes not in the table of an operation are replied as INTERNAL_FAILURE, except
+// DeadlineExceeded, which is replied as UPSTREAM_TIMEOUT for every operation.
+var (
+	// Operations on the current user that fail if it does not exist anymore:
+	// GetDashboardData, GetUserFollowingIds, GetUserHeaderData, GetBasicUserData,
+	// MarkAllAsRead, ClearNotifs, and RecycleActivity and RecycleSaved on the
+	// current user.
+	currentUserErrors = grpcErrors{
+		codes.NotFound: errUnregistered,
+	}
+	// Operations on a given user: ViewUserByUsername and RecycleActivity on
+	// other users.
+	userErrors = grpcErrors{
+		codes.NotFound: errNotFound,
+	}
+	followErrors = grpcErrors{
+		codes.NotFound:        errNotFound,
+		codes.InvalidArgument: errSelfFollow,
+		codes.Unauthenticated: errUnregistered,
+	}
+	unfollowErrors = grpcErrors{
+		codes.NotFound:        errNotFound,
+		codes.InvalidArgument: errSelfUnfollow,
+		codes.Unauthenticated: errUnregistered,
+	}
+	viewUsersErrors = grpcErrors{
+		codes.NotFound:   errNotFound,
+		codes.OutOfRange: errOffsetOOR,
+	}
+	updateUserErrors = grpcErrors{
+		codes.AlreadyExists:   errUsernameTaken,
+		codes.InvalidArgument: errInvalidUsername,
+	}
+	loginErrors = grpcErrors{
+		codes.PermissionDenied: errInvalidCredentials,
+	}
+	// RegisterUser returns the name of the field already in use in the message
+	// of AlreadyExists errors; see (*Router).handleSignin.
+	registerErrors = grpcErrors{
+		codes.InvalidArgument: errInvalidUsername,
+	}
+	generalErrors = grpcErrors{}
+
+	// Operations on the contents of a section: RecycleContent, GetThread,
+	// GetSubcomments, SaveThread, UndoSaveThread, Upvote and Comment.
+	sectionErrors = grpcErrors{
+		codes.NotFound:    errNotFound,
+		codes.Unavailable: errSectionUnavailable,
+	}
+	recycleCommentsErrors = grpcErrors{
+		codes.NotFound:    errNotFound,
+		codes.Unavailable: errSectionUnavailable,
+		codes.OutOfRange:  errOutOfRange,
+	}
+	createThreadErrors = grpcErrors{
+		codes.NotFound:           errNotFound,
+		codes.Unavailable:        errSectionUnavailable,
+		codes.FailedPrecondition: errUnableToPost,
+		codes.Unauthenticated:    errUnregistered,
+	}
+	deleteErrors = grpcErrors{
+		codes.NotFound:        errNotFound,
+		codes.Unavailable:     errSectionUnavailable,
+		codes.Unauthenticated: errUserUnauthorized,
+	}
+	undoUpvoteErrors = grpcErrors{
+		codes.NotFound:           errNotFound,
+		codes.Unavailable:        errSectionUnavailable,
+		codes.FailedPrecondition: errNotUpvoted,
+	}
+)
+
+// translate returns the error to be replied to the client given the error err
+// returned by the operation op. Errors whose code is not in the table, and errors
+// that do not come from the service, are logged and translated into
+// INTERNAL_FAILURE. Operations that run out of time are translated into
+// UPSTREAM_TIMEOUT. The error is logged with the logger of ctx.
+func (t grpcErrors) translate(ctx context.Context, op string, err error) *httpError {
+	lg := logging.FromContext(ctx).With("op", op)
+	resErr, ok := status.FromError(err)
+	if !ok {
+		lg.Error("Could not send request", "err", err)
+		return errInternalFailure
+	}
+	switch resErr.Code() {
+	case codes.DeadlineExceeded:
+		lg.Warn("Deadline exceeded", "detail", resErr.Message())
+		return errUpstreamTimeout
+	case codes.Canceled:
+		// The client went away before the service answered; nobody will
+		// read the reply.
+		lg.Info("Canceled by the client", "detail", resErr.Message())
+		return errInternalFailure
+	}
+	if e, ok := t[resErr.Code()]; ok {
+		lg.Debug("Request failed", "code", resErr.Code(), "detail", resErr.Message())
+		return e
+	}
+	lg.Error("Unknown error code", "code", resErr.Code(), "detail", resErr.Message())
+	return errInternalFailure
+}
+
+// errorPage is the page replied to browsers when a request fails.
+const errorPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>%d %s</title></head>
+<body><h1>%d %s</h1><p>%s</p><p><a href="/">Go back home</a></p></body>
+</html>
+`
+
+// replyError replies to the request with the given error. Errors other than
+// *httpError are replied as INTERNAL_FAILURE. The body of the response is:
+// - a JSON error object for API requests and clients accepting application/json.
+// - a page for browsers loading a page.
+// - the error code in plain text otherwise, which is what the scripts of the
+// site check.
+// Status codes that do not allow a body are replied without body. The header
+// Retry-After is set for a *retryError.
+func replyError(w http.ResponseWriter, req *http.Request, err error) {
+	var e *httpError
+	if !errors.As(err, &e) {
+		logFor(req).Error("Unexpected error", "err", err)
+		e = errInternalFailure
+	}
+	var retry *retryError
+	if errors.As(err, &retry) {
+		secs := int(math.Ceil(retry.after.Seconds()))
+		if secs < 1 {
+			secs = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+	switch {
+	case !bodyAllowed(e.Status):
+		w.WriteHeader(e.Status)
+	case strings.HasPrefix(req.URL.Path, apiPrefix+"/") || acceptsJSON(req):
+		writeJSON(w, e.Status, struct {
+			Error apiError `json:"error"`
+		}{
+			Error: apiError{
+				Code:    e.Code,
+				Message: e.Message,
+				Status:  e.Status,
+			},
+		})
+	case acceptsHTML(req):
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(e.Status)
+		text := http.StatusText(e.Status)
+		fmt.Fprintf(w, errorPage, e.Status, text, e.Status, text,
+			template.HTMLEscapeString(e.Message))
+	default:
+		http.Error(w, e.Code, e.Status)
+	}
+}
+
+// acceptsHTML reports whether the client is a browser loading a page, rather
+// than a script.
+func acceptsHTML(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/html") &&
+		req.Header.Get("X-Requested-With") != "XMLHttpRequest"
+}
+
+// bodyAllowed reports whether a response with the given status code may have a
+// body.
+func bodyAllowed(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,352 @@
+package router
+
+import (
+	"net/http"
+	"time"
+
+	pbTime "github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/gorilla/mux"
+	pbApi "github.com/luisguve/cheroproto-go/cheroapi"
+)
+
+// API Token "/api/v1/tokens" handler. It checks the username and password in
+// the JSON body {"username", "password"} and returns a bearer token for the user
+// on success or an error in case of the following:
+// - malformed body ----------------> INVALID_BODY
+// - invalid username or password -> INVALID_CREDENTIALS
+// - network failure --------------> INTERNAL_FAILURE
+func (r *Router) handleAPIToken(w http.ResponseWriter, req *http.Request) {
+	var credentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := decodeJSON(req, &credentials); err != nil {
+		replyError(w, req, errInvalidBody)
+		return
+	}
+	ctx, cancel := r.usersContext(req)
+	defer cancel()
+	userId, err := r.login(ctx, credentials.Username, credentials.Password)
+	if err != nil {
+		replyError(w, req, err)
+		return
+	}
+	token, err := r.issueToken(userId)
+	if err != nil {
+		replyError(w, req, errInternalFailure)
+		return
+	}
+	writeJSON(w, http.StatusOK, token)
+}
+
+// API Revoke Token "/api/v1/tokens" DELETE handler. It revokes the bearer token
+// of the request, so that it is no longer accepted. It returns {"ok": true} on
+// success or an error in case of the following:
+// - storage failure -> INTERNAL_FAILURE
+func (r *Router) handleAPIRevokeToken(userId string, w http.ResponseWriter, req *http.Request) {
+	claims, _ := r.decodeToken(req)
+	if err := r.registry.Remove(userId, apiTokenPrefix+claims.Id); err != nil {
+		logFor(req).Error("Could not revoke token", "err", err)
+		replyError(w, req, errInternalFailure)
+		return
+	}
+	writeAPIOK(w)
+}
+
+// API Revoke All "/api/v1/tokens/all" DELETE handler. It revokes every token of
+// the user, along with its sessions in every browser and device, as
+// "/logout/all" does. It returns {"ok": true} on success or an error in case
+// of the following:
+// - storage failure -> INTERNAL_FAILURE
+func (r *Router) handleAPIRevokeAll(userId string, w http.ResponseWriter, req *http.Request) {
+	if err := r.revokeTokens(userId); err != nil {
+		logFor(req).Error("Could not revoke tokens", "err", err)
+		replyError(w, req, errInternalFailure)
+		return
+	}
+	writeAPIOK(w)
+}
+
+// API Follow "/api/v1/users/{username}/follow" POST handler. It updates the
+// current user to follow the user with the given username. It may return an
+// error in case of the following:
+// - username not found ----> 404 NOT_FOUND
+// - user following itself -> SELF_FOLLOW
+// - user is unregistered --> USER_UNREGISTERED
+// - network failures ------> INTERNAL_FAILURE
+func (r *Router) handleAPIFollow(userId string, w http.ResponseWriter, req *http.Request) {
+	username := mux.Vars(req)["username"]
+	ctx, cancel := r.usersContext(req)
+	defer cancel()
+	if err := r.followUser(ctx, userId, username); err != nil {
+		r.replyAPIError(w, req, userId, err)
+		return
+	}
+	writeAPIOK(w)
+}
+
+// API Unfollow "/api/v1/users/{username}/follow" DELETE handler. It updates the
+// current user to unfollow the user with the given username. It may return an
+// error in case of the following:
+// - username not found ------> 404 NOT_FOUND
+// - user unfollowing itself -> SELF_UNFOLLOW
+// - user is unregistered ----> USER_UNREGISTERED
+// - network failures --------> INTERNAL_FAILURE
+func (r *Router) handleAPIUnfollow(userId string, w http.ResponseWriter, req *http.Request) {
+	username := mux.Vars(req)["username"]
+	ctx, cancel := r.usersContext(req)
+	defer cancel()
+	if err := r.unfollowUser(ctx, userId, username); err != nil {
+		r.replyAPIError(w, req, userId, err)
+		return
+	}
+	writeAPIOK(w)
+}
+
+// API New Thread "/api/v1/sections/{section}/threads" handler. It creates a
+// thread with the title and content in the JSON body {"title", "content"} and
+// returns its permalink with status 201 on success or an error in case of the
+// following:
+// - malformed body --------------------------> INVALID_BODY
+// - empty content or title ------------------> NO_CONTENT, NO_TITLE
+// - creating a thread in an invalid section -> 404 NOT_FOUND
+// - user has already posted today -----------> USER_UNABLE_TO_POST
+// - user unathenticated ---------------------> USER_UNREGISTERED
+// - network failures ------------------------> INTERNAL_FAILURE
+func (r *Router) handleAPINewThread(userId string, w http.ResponseWriter, req *http.Request) {
+	section, ok := r.apiSection(w, req)
+	if !ok {
+		return
+	}
+	var body struct {
+		Title   string `json:"title"`
+		Content string `json:"content"`
+	}
+	if err := decodeJSON(req, &body); err != nil {
+		replyError(w, req, errInvalidBody)
+		return
+	}
+	if body.Content == "" {
+		replyError(w, req, errNoContent)
+		return
+	}
+	if body.Title == "" {
+		replyError(w, req, errNoTitle)
+		return
+	}
+	content := &pbApi.Content{
+		Title:   body.Title,
+		Content: body.Content,
+		PublishDate: &pbTime.Timestamp{
+			Seconds: time.Now().Unix(),
+		},
+	}
+	ctx, cancel := sectionContext(req, section)
+	defer cancel()
+	permalink, err := r.createThread(ctx, userId, section.Id, content, section.Client)
+	if err != nil {
+		r.replyAPIError(w, req, userId, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, struct {
+		Permalink string `json:"permalink"`
+	}{permalink})
+}
+
+// API Save "/api/v1/sections/{section}/threads/{thread}/save" POST handler. It
+// adds the thread to the list of saved threads of the current user. It may
+// return an error in case of the following:
+// - invalid section name or thread id -> 404 NOT_FOUND
+// - section or thread are unavailable -> SECTION_UNAVAILABLE
+// - network failures ------------------> INTERNAL_FAILURE
+func (r *Router) handleAPISave(userId string, w http.ResponseWriter, req *http.Request) {
+	section, ok := r.apiSection(w, req)
+	if !ok {
+		return
+	}
+	threadCtx := formatContextThread(section.Id, mux.Vars(req)["thread"])
+	ctx, cancel := sectionContext(req, section)
+	defer cancel()
+	if err := r.saveThread(ctx, userId, threadCtx, section.Client); err != nil {
+		r.replyAPIError(w, req, userId, err)
+		return
+	}
+	writeAPIOK(w)
+}
+
+// API Undo Save "/api/v1/sections/{section}/threads/{thread}/save" DELETE
+// handler. It removes the thread from the list of saved threads of the current
+// user. It may return an error in case of the following:
+// - invalid section name or thread id -> 404 NOT_FOUND
+// - network failures ------------------> INTERNAL_FAILURE
+func (r *Router) handleAPIUndoSave(userId string, w http.ResponseWriter, req *http.Request) {
+	section, ok := r.apiSection(w, req)
+	if !ok {
+		return
+	}
+	threadCtx := formatContextThread(section.Id, mux.Vars(req)["thread"])
+	ctx, cancel := sectionContext(req, section)
+	defer cancel()
+	if err := r.undoSaveThread(ctx, userId, threadCtx, section.Client); err != nil {
+		r.replyAPIError(w, req, userId, err)
+		return
+	}
+	writeAPIOK(w)
+}
+
+// API Upvote ".../upvote" POST handler. It upvotes the thread, comment or
+// subcomment given in the URL. It may return an error in case of the following:
+// - invalid section name, thread id or comment -> 404 NOT_FOUND
+// - section, thread or comment are unavailable -> SECTION_UNAVAILABLE
+// - network failures ---------------------------> INTERNAL_FAILURE
+func (r *Router) handleAPIUpvote(userId string, w http.ResponseWriter, req *http.Request) {
+	section, ok := r.apiSection(w, req)
+	if !ok {
+		return
+	}
+	upvoteRequest := &pbApi.UpvoteRequest{UserId: userId}
+	vars := mux.Vars(req)
+	switch {
+	case vars["sc_id"] != "":
+		subcomment := formatContextSubcomment(section.Id, vars["thread"], vars["c_id"],
+			vars["sc_id"])
+		upvoteRequest.ContentContext = &pbApi.UpvoteRequest_SubcommentCtx{subcomment}
+	case vars["c_id"] != "":
+		comment := formatContextComment(section.Id, vars["thread"], vars["c_id"])
+		upvoteRequest.ContentContext = &pbApi.UpvoteRequest_CommentCtx{comment}
+	default:
+		thread := formatContextThread(section.Id, vars["thread"])
+		upvoteRequest.ContentContext = &pbApi.UpvoteRequest_ThreadCtx{thread}
+	}
+	if err := r.postUpvote(req, upvoteRequest, section); err != nil {
+		r.replyAPIError(w, req, userId, err)
+		return
+	}
+	writeAPIOK(w)
+}
+
+// API Undo Upvote ".../upvote" DELETE handler. It undoes the upvote on the
+// thread, comment or subcomment given in the URL. It may return an error in
+// case of the following:
+// - invalid section name or thread id ------> 404 NOT_FOUND
+// - user did not upvote the content before -> NOT_UPVOTED
+// - network failures -----------------------> INTERNAL_FAILURE
+func (r *Router) handleAPIUndoUpvote(userId string, w http.ResponseWriter, req *http.Request) {
+	section, ok := r.apiSection(w, req)
+	if !ok {
+		return
+	}
+	undoUpvoteRequest := &pbApi.UndoUpvoteRequest{UserId: userId}
+	vars := mux.Vars(req)
+	switch {
+	case vars["sc_id"] != "":
+		subcomment := formatContextSubcomment(section.Id, vars["thread"], vars["c_id"],
+			vars["sc_id"])
+		undoUpvoteRequest.ContentContext = &pbApi.UndoUpvoteRequest_SubcommentCtx{subcomment}
+	case vars["c_id"] != "":
+		comment := formatContextComment(section.Id, vars["thread"], vars["c_id"])
+		undoUpvoteRequest.ContentContext = &pbApi.UndoUpvoteRequest_CommentCtx{comment}
+	default:
+		thread := formatContextThread(section.Id, vars["thread"])
+		undoUpvoteRequest.ContentContext = &pbApi.UndoUpvoteRequest_ThreadCtx{thread}
+	}
+	ctx, cancel := sectionContext(req, section)
+	defer cancel()
+	if err := r.undoUpvote(ctx, undoUpvoteRequest, section.Client); err != nil {
+		r.replyAPIError(w, req, userId, err)
+		return
+	}
+	writeAPIOK(w)
+}
+
+// API Comment ".../comments" and ".../replies" POST handler. It posts a comment
+// on the thread or a reply on the comment given in the URL with the content in
+// the JSON body {"content"}. It returns status 201 on success or an error in case
+// of the following:
+// - malformed body ----------------------------> INVALID_BODY
+// - empty content ------------------------------> NO_CONTENT
+// - invalid section name, thread id or comment -> 404 NOT_FOUND
+// - network failures ---------------------------> INTERNAL_FAILURE
+func (r *Router) handleAPIComment(userId string, w http.ResponseWriter, req *http.Request) {
+	section, ok := r.apiSection(w, req)
+	if !ok {
+		return
+	}
+	var body struct {
+		Content string `json:"content"`
+	}
+	if err := decodeJSON(req, &body); err != nil {
+		replyError(w, req, errInvalidBody)
+		return
+	}
+	if body.Content == "" {
+		replyError(w, req, errNoContent)
+		return
+	}
+	commentRequest := &pbApi.CommentRequest{
+		Content: body.Content,
+		UserId:  userId,
+		PublishDate: &pbTime.Timestamp{
+			Seconds: time.Now().Unix(),
+		},
+	}
+	vars := mux.Vars(req)
+	if vars["c_id"] != "" {
+		comment := formatContextComment(section.Id, vars["thread"], vars["c_id"])
+		commentRequest.ContentContext = &pbApi.CommentRequest_CommentCtx{comment}
+	} else {
+		thread := formatContextThread(section.Id, vars["thread"])
+		commentRequest.ContentContext = &pbApi.CommentRequest_ThreadCtx{thread}
+	}
+	if err := r.postComment(req, commentRequest, section); err != nil {
+		r.replyAPIError(w, req, userId, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, struct {
+		Ok bool `json:"ok"`
+	}{true})
+}
+
+// API Delete DELETE handler for threads, comments and subcomments. It deletes the
+// content given in the URL and all the content related to it. It may return an
+// error in case of the following:
+// - invalid section name or thread id ---> 404 NOT_FOUND
+// - user id and author id are not equal -> USER_UNAUTHORIZED
+// - network failures --------------------> INTERNAL_FAILURE
+func (r *Router) handleAPIDelete(userId string, w http.ResponseWriter, req *http.Request) {
+	section, ok := r.apiSection(w, req)
+	if !ok {
+		return
+	}
+	deleteRequest := &pbApi.DeleteContentRequest{UserId: userId}
+	vars := mux.Vars(req)
+	switch {
+	case vars["sc_id"] != "":
+		subcomment := formatContextSubcomment(section.Id, vars["thread"], vars["c_id"],
+			vars["sc_id"])
+		deleteRequest.ContentContext = &pbApi.DeleteContentRequest_SubcommentCtx{subcomment}
+	case vars["c_id"] != "":
+		comment := formatContextComment(section.Id, vars["thread"], vars["c_id"])
+		deleteRequest.ContentContext = &pbApi.DeleteContentRequest_CommentCtx{comment}
+	default:
+		thread := formatContextThread(section.Id, vars["thread"])
+		deleteRequest.ContentContext = &pbApi.DeleteContentRequest_ThreadCtx{thread}
+	}
+	ctx, cancel := sectionContext(req, section)
+	defer cancel()
+	if err := r.deleteContent(ctx, deleteRequest, section.Client); err != nil {
+		r.replyAPIError(w, req, userId, err)
+		return
+	}
+	writeAPIOK(w)
+}
+
+// apiSection returns the section whose id is in the URL of the request. If there
+// is no such section, it replies with a NOT_FOUND error and returns false.
+func (r *Router) apiSection(w http.ResponseWriter, req *http.Request) (Section, bool) {
+	section, ok := r.sections[mux.Vars(req)["section"]]
+	if !ok {
+		replyError(w, req, errNotFound)
+	}
+	return section, ok
+}
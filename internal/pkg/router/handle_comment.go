@@ -1,9 +1,7 @@
 package router
 
 import (
-	"context"
 	"errors"
-	"log"
 	"net/http"
 	"strconv"
 	"time"
@@ -31,8 +29,8 @@ func (r *Router) handleGetSubcomments(w http.ResponseWriter, req *http.Request)
 	vars := mux.Vars(req)
 	offset, err := strconv.Atoi(vars["offset"])
 	if err != nil || offset < 0 {
-		log.Printf("offset (%v) is not valid\n", offset)
-		http.Error(w, "INVALID_OFFSET", http.StatusBadRequest)
+		logFor(req).Debug("Invalid offset", "offset", vars["offset"])
+		replyError(w, req, errInvalidOffset)
 		return
 	}
 	sectionId := vars["section"]
@@ -41,8 +39,8 @@ func (r *Router) handleGetSubcomments(w http.ResponseWriter, req *http.Request)
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 	commentCtx := formatContextComment(sectionId, thread, commentId)
@@ -52,29 +50,21 @@ func (r *Router) handleGetSubcomments(w http.ResponseWriter, req *http.Request)
 		CommentCtx: commentCtx,
 	}
 
-	stream, err := section.Client.GetSubcomments(context.Background(), request)
+	ctx, cancel := sectionContext(req, section)
+	defer cancel()
+	stream, err := section.Client.GetSubcomments(ctx, request)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				log.Printf("Could not find content: %v", resErr.Message())
-				http.NotFound(w, req)
-				return
-			case codes.OutOfRange:
-				w.Write([]byte("OFFSET_OOR"))
-				return
-			default:
-				log.Printf("Unknown error code %v: %v\n", resErr.Code(),
-					resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
+		if status.Code(err) == codes.OutOfRange {
+			// There are no more subcomments; the scripts of the site expect this
+			// along with a 200 status code.
+			w.Write([]byte("OFFSET_OOR"))
+			return
 		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, sectionErrors.translate(ctx, "GetSubcomments", err))
 		return
 	}
-	feed, err := getFeed(stream)
+	feed, err := getFeed(stream, feedSubcomments)
+	code := http.StatusOK
 	if err != nil {
 		if resErr, ok := status.FromError(err); ok {
 			switch resErr.Code() {
@@ -83,8 +73,8 @@ func (r *Router) handleGetSubcomments(w http.ResponseWriter, req *http.Request)
 				return
 			}
 		}
-		log.Printf("An error occurred while getting feed: %v\n", err)
-		w.WriteHeader(http.StatusPartialContent)
+		logFor(req).Warn("An error occurred while getting feed", "err", err)
+		code = http.StatusPartialContent
 	}
 
 	// Get current user id.
@@ -94,10 +84,11 @@ func (r *Router) handleGetSubcomments(w http.ResponseWriter, req *http.Request)
 	contentLength := strconv.Itoa(len(res))
 	w.Header().Set("Content-Length", contentLength)
 	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(code)
 
 	if _, err = w.Write(res); err != nil {
-		log.Println("Get subcomments: could not send response:", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		logFor(req).Error("Get subcomments: could not send response", "err", err)
+		replyError(w, req, errInternalFailure)
 	}
 }
 
@@ -122,24 +113,24 @@ func (r *Router) handlePostComment(userId string, w http.ResponseWriter,
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 	// Get ft_file and save it to the disk with a unique, random name.
-	filePath, err, status := getAndSaveFile(req, "ft_file")
+	filePath, err := getAndSaveFile(req, "ft_file")
 	if err != nil {
 		// It's ok to get an errMissingFile, but if it's not such an error, it is
 		// an internal failure.
 		if !errors.Is(err, errMissingFile) {
-			http.Error(w, err.Error(), status)
+			replyError(w, req, err)
 			return
 		}
 	}
 	// Get the rest of the content parts
 	content := req.FormValue("content")
 	if content == "" {
-		http.Error(w, "NO_CONTENT", http.StatusBadRequest)
+		replyError(w, req, errNoContent)
 		return
 	}
 	thread := formatContextThread(sectionId, threadId)
@@ -152,7 +143,7 @@ func (r *Router) handlePostComment(userId string, w http.ResponseWriter,
 		},
 		ContentContext: &pbApi.CommentRequest_ThreadCtx{thread},
 	}
-	r.handleComment(w, req, postCommentRequest, section.Client)
+	r.handleComment(w, req, postCommentRequest, section)
 }
 
 // Delete Comment "/{section}/{thread}/comment/delete/?c_id={c_id}" handler.
@@ -171,8 +162,8 @@ func (r *Router) handleDeleteComment(userId string, w http.ResponseWriter,
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
@@ -181,7 +172,7 @@ func (r *Router) handleDeleteComment(userId string, w http.ResponseWriter,
 		UserId:         userId,
 		ContentContext: &pbApi.DeleteContentRequest_CommentCtx{comment},
 	}
-	r.handleDelete(w, req, deleteContentRequest, section.Client)
+	r.handleDelete(w, req, deleteContentRequest, section)
 }
 
 // Post Subcomment "/{section}/{thread}/comment/?c_id={c_id}" handler. It handles the
@@ -207,24 +198,24 @@ func (r *Router) handlePostSubcomment(userId string, w http.ResponseWriter,
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 	// Get ft_file and save it to the disk with a unique, random name.
-	filePath, err, status := getAndSaveFile(req, "ft_file")
+	filePath, err := getAndSaveFile(req, "ft_file")
 	if err != nil {
 		// It's ok to get an errMissingFile, but if it's not such an error, it is
 		// an internal failure.
 		if !errors.Is(err, errMissingFile) {
-			http.Error(w, err.Error(), status)
+			replyError(w, req, err)
 			return
 		}
 	}
 	// Get the rest of the content parts
 	content := req.FormValue("content")
 	if content == "" {
-		http.Error(w, "NO_CONTENT", http.StatusBadRequest)
+		replyError(w, req, errNoContent)
 		return
 	}
 	comment := formatContextComment(sectionId, thread, commentId)
@@ -237,7 +228,7 @@ func (r *Router) handlePostSubcomment(userId string, w http.ResponseWriter,
 		UserId:         userId,
 		ContentContext: &pbApi.CommentRequest_CommentCtx{comment},
 	}
-	r.handleComment(w, req, postCommentRequest, section.Client)
+	r.handleComment(w, req, postCommentRequest, section)
 }
 
 // Delete Subcomment
@@ -258,8 +249,8 @@ func (r *Router) handleDeleteSubcomment(userId string, w http.ResponseWriter,
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
@@ -268,7 +259,7 @@ func (r *Router) handleDeleteSubcomment(userId string, w http.ResponseWriter,
 		UserId:         userId,
 		ContentContext: &pbApi.DeleteContentRequest_SubcommentCtx{subcomment},
 	}
-	r.handleDelete(w, req, deleteRequest, section.Client)
+	r.handleDelete(w, req, deleteRequest, section)
 }
 
 // Post Upvote "/{section}/{thread}/upvote/?c_id={c_id}" handler.
@@ -286,8 +277,8 @@ func (r *Router) handleUpvoteComment(userId string, w http.ResponseWriter,
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
@@ -296,7 +287,7 @@ func (r *Router) handleUpvoteComment(userId string, w http.ResponseWriter,
 		UserId:         userId,
 		ContentContext: &pbApi.UpvoteRequest_CommentCtx{comment},
 	}
-	r.handleUpvote(w, req, upvoteRequest, section.Client)
+	r.handleUpvote(w, req, upvoteRequest, section)
 }
 
 // Post Upvote "/{section}/{thread}/upvote/?c_id={c_id}&sc_id={sc_id}" handler.
@@ -315,8 +306,8 @@ func (r *Router) handleUpvoteSubcomment(userId string, w http.ResponseWriter,
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
@@ -325,7 +316,7 @@ func (r *Router) handleUpvoteSubcomment(userId string, w http.ResponseWriter,
 		UserId:         userId,
 		ContentContext: &pbApi.UpvoteRequest_SubcommentCtx{subcomment},
 	}
-	r.handleUpvote(w, req, upvoteRequest, section.Client)
+	r.handleUpvote(w, req, upvoteRequest, section)
 }
 
 // Post upvote undoing "/{section}/{thread}/unupvote/?c_id={c_id}" handler.
@@ -344,8 +335,8 @@ func (r *Router) handleUndoUpvoteComment(userId string, w http.ResponseWriter,
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
@@ -354,7 +345,7 @@ func (r *Router) handleUndoUpvoteComment(userId string, w http.ResponseWriter,
 		UserId:         userId,
 		ContentContext: &pbApi.UndoUpvoteRequest_CommentCtx{comment},
 	}
-	r.handleUndoUpvote(w, req, undoUpvoteRequest, section.Client)
+	r.handleUndoUpvote(w, req, undoUpvoteRequest, section)
 }
 
 // Post upvote undoing "/{section}/{thread}/unupvote/?c_id={c_id}&sc_id={sc_id}"
@@ -374,8 +365,8 @@ func (r *Router) handleUndoUpvoteSubcomment(userId string, w http.ResponseWriter
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
@@ -384,5 +375,5 @@ func (r *Router) handleUndoUpvoteSubcomment(userId string, w http.ResponseWriter
 		UserId:         userId,
 		ContentContext: &pbApi.UndoUpvoteRequest_SubcommentCtx{subcomment},
 	}
-	r.handleUndoUpvote(w, req, undoUpvoteRequest, section.Client)
+	r.handleUndoUpvote(w, req, undoUpvoteRequest, section)
 }
@@ -1,11 +1,9 @@
 package router
 
 import (
-	"context"
-	"log"
 	"net/http"
-	"strconv"
 	"sync"
+	"sync/atomic"
 
 	pbApi "github.com/luisguve/cheroproto-go/cheroapi"
 	pbUsers "github.com/luisguve/cheroproto-go/userapi"
@@ -26,32 +24,25 @@ func (r *Router) handleRoot(userId string, w http.ResponseWriter, req *http.Requ
 	request := &pbUsers.GetDashboardDataRequest{
 		UserId: userId,
 	}
-	dData, err := r.usersClient.GetDashboardData(context.Background(), request)
+	ctx, cancel := r.usersContext(req)
+	defer cancel()
+	dData, err := r.usersClient.GetDashboardData(ctx, request)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				log.Printf("User %s unregistered. Deleting session... ", userId)
-				if err = r.deleteSession(req, w); err != nil {
-					log.Printf("Could not save session because: %v\n", err)
-				} else {
-					log.Println("Done.")
-				}
-				http.Error(w, "USER_UNREGISTERED", http.StatusUnauthorized)
-				return
-			default:
-				log.Printf("Unknown error code %v: %v\n", resErr.Code(),
-					resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
+		e := currentUserErrors.translate(ctx, "GetDashboardData", err)
+		if e == errUnregistered {
+			logFor(req).Info("User unregistered; deleting session", "user", userId)
+			if err = r.deleteSession(req, w); err != nil {
+				logFor(req).Error("Could not save session", "err", err)
 			}
 		}
-		log.Printf("Could not get full user data: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, e)
 		return
 	}
 
 	var wg sync.WaitGroup
+	// partial is set by the goroutines that fail to get their feed; the status
+	// is written along with the headers set afterwards.
+	var partial int32
 	// Get dashboard feed only if this user is following other users
 	var feed templates.ContentsFeed
 	following := len(dData.FollowingIds)
@@ -65,15 +56,17 @@ func (r *Router) handleRoot(userId string, w http.ResponseWriter, req *http.Requ
 				// ignore DiscardIds; do not discard any activity
 			}
 
-			stream, err := r.generalClient.RecycleActivity(context.Background(), activityPattern)
+			ctx, cancel := r.generalContext(req)
+			defer cancel()
+			stream, err := r.generalClient.RecycleActivity(ctx, activityPattern)
 			if err != nil {
-				log.Printf("Could not send request: %v\n", err)
-				w.WriteHeader(http.StatusPartialContent)
+				logFor(req).Warn("Could not send request", "err", err)
+				atomic.StoreInt32(&partial, 1)
 			} else {
-				feed, err = getFeed(stream)
+				feed, err = getFeed(stream, feedDashboard)
 				if err != nil {
-					log.Printf("An error occurred while getting feed: %v\n", err)
-					w.WriteHeader(http.StatusPartialContent)
+					logFor(req).Warn("An error occurred while getting feed", "err", err)
+					atomic.StoreInt32(&partial, 1)
 				}
 			}
 		}()
@@ -89,15 +82,17 @@ func (r *Router) handleRoot(userId string, w http.ResponseWriter, req *http.Requ
 			Users:   []string{dData.UserId},
 			// ignore DiscardIds; do not discard any activity
 		}
-		stream, err := r.generalClient.RecycleActivity(context.Background(), activityPattern)
+		ctx, cancel := r.generalContext(req)
+		defer cancel()
+		stream, err := r.generalClient.RecycleActivity(ctx, activityPattern)
 		if err != nil {
-			log.Printf("Could not send request: %v\n", err)
-			w.WriteHeader(http.StatusPartialContent)
+			logFor(req).Warn("Could not send request", "err", err)
+			atomic.StoreInt32(&partial, 1)
 		} else {
-			userActivity, err = getFeed(stream)
+			userActivity, err = getFeed(stream, feedActivity)
 			if err != nil {
-				log.Printf("An error occurred while getting feed: %v\n", err)
-				w.WriteHeader(http.StatusPartialContent)
+				logFor(req).Warn("An error occurred while getting feed", "err", err)
+				atomic.StoreInt32(&partial, 1)
 			}
 		}
 	}()
@@ -113,96 +108,95 @@ func (r *Router) handleRoot(userId string, w http.ResponseWriter, req *http.Requ
 				UserId:  dData.UserId,
 				// ignore DiscardIds; do not discard any thread
 			}
-			stream, err := r.generalClient.RecycleSaved(context.Background(), savedPattern)
+			ctx, cancel := r.generalContext(req)
+			defer cancel()
+			stream, err := r.generalClient.RecycleSaved(ctx, savedPattern)
 			if err != nil {
-				log.Printf("Could not send request: %v\n", err)
-				w.WriteHeader(http.StatusPartialContent)
+				logFor(req).Warn("Could not send request", "err", err)
+				atomic.StoreInt32(&partial, 1)
 			} else {
-				savedThreads, err = getFeed(stream)
+				savedThreads, err = getFeed(stream, feedSaved)
 				if err != nil {
-					log.Printf("An error occurred while getting feed: %v\n", err)
-					w.WriteHeader(http.StatusPartialContent)
+					logFor(req).Warn("An error occurred while getting feed", "err", err)
+					atomic.StoreInt32(&partial, 1)
 				}
 			}
 		}()
 	}
 	wg.Wait()
-	// update session only if there is content.
-	if len(feed.Contents) > 0 {
+	// update session only if there is content, updating the three feeds at
+	// once.
+	if len(feed.Contents) > 0 || len(userActivity.Contents) > 0 ||
+		len(savedThreads.Contents) > 0 {
 		r.updateDiscardIdsSession(req, w, func(d *pagination.DiscardIds) {
-			pActivity := feed.GetPaginationActivity()
-
-			for userId, content := range pActivity {
-				a := d.FeedActivity[userId]
-				a.ThreadsCreated = content.ThreadsCreated
-				a.Comments = content.Comments
-				a.Subcomments = content.Subcomments
-				d.FeedActivity[userId] = a
+			if len(feed.Contents) > 0 {
+				pActivity := feed.GetPaginationActivity()
+
+				d.Reset(pagination.KindFeedActivity, "")
+				for userId, content := range pActivity {
+					a := d.FeedActivity[userId]
+					a.ThreadsCreated = content.ThreadsCreated
+					a.Comments = content.Comments
+					a.Subcomments = content.Subcomments
+					d.FeedActivity[userId] = a
+				}
 			}
-		})
-	}
-	if len(userActivity.Contents) > 0 {
-		r.updateDiscardIdsSession(req, w, func(d *pagination.DiscardIds) {
-			pActivity := userActivity.GetUserPaginationActivity()
-
-			// avoid conflict with profile view by adding a preffix dashboard-
-			id := "dashboard-" + dData.UserId
-			a := d.UserActivity[id]
-			a.ThreadsCreated = pActivity.ThreadsCreated
-			a.Comments = pActivity.Comments
-			a.Subcomments = pActivity.Subcomments
-			d.UserActivity[id] = a
-		})
-	}
-	if len(savedThreads.Contents) > 0 {
-		r.updateDiscardIdsSession(req, w, func(d *pagination.DiscardIds) {
-			pThreads := savedThreads.GetPaginationThreads()
+			if len(userActivity.Contents) > 0 {
+				pActivity := userActivity.GetUserPaginationActivity()
+
+				// avoid conflict with profile view by adding a preffix dashboard-
+				id := "dashboard-" + dData.UserId
+				d.Reset(pagination.KindUserActivity, id)
+				a := d.UserActivity[id]
+				a.ThreadsCreated = pActivity.ThreadsCreated
+				a.Comments = pActivity.Comments
+				a.Subcomments = pActivity.Subcomments
+				d.UserActivity[id] = a
+			}
+			if len(savedThreads.Contents) > 0 {
+				pThreads := savedThreads.GetPaginationThreads()
 
-			for section, threadIds := range pThreads {
-				d.SavedThreads[section] = threadIds
+				d.Reset(pagination.KindSavedThreads, "")
+				for section, threadIds := range pThreads {
+					d.SavedThreads[section] = threadIds
+				}
 			}
 		})
 	}
 	dashboardView := templates.DataToDashboardView(dData, feed.Contents,
 		userActivity.Contents, savedThreads.Contents)
+	dashboardView.CSRFToken = r.csrfToken(req)
 
+	if atomic.LoadInt32(&partial) == 1 {
+		w.WriteHeader(http.StatusPartialContent)
+	}
 	err = r.templates.ExecuteTemplate(w, "dashboard.html", dashboardView)
 	if err != nil {
-		log.Printf("Could not execute template dashboard.html: %v\n", err)
-		http.Error(w, "TEMPLATE_ERROR", http.StatusInternalServerError)
+		logFor(req).Error("Could not execute template", "template", "dashboard.html", "err", err)
+		replyError(w, req, errTemplate)
 	}
 }
 
 // Recycle Feed "/recyclefeed" handler. It returns a new activity feed of several users
-// in HTML format. The user must be logged in and follow other users, whose recent
-// activity will compose up the returned feed. It may return an error in case of
-// the following:
+// in HTML format, or in JSON format if the client accepts application/json. The
+// user must be logged in and follow other users, whose recent activity will compose
+// up the returned feed. It may return an error in case of the following:
 // - user is unregistered --------------> USER_UNREGISTERED
 // - user is not following other users -> NO_USERS_FOLLOWING
+// - no more contents are available ----> EXHAUSTED
 // - network or encoding failures ------> INTERNAL_FAILURE
-// Note: NO_USERS_FOLLOWING is returned along with a 200 status code.
+// Note: NO_USERS_FOLLOWING and EXHAUSTED are returned along with a 200 status
+// code; see writeExhausted.
 func (r *Router) handleRecycleFeed(userId string, w http.ResponseWriter,
 	req *http.Request) {
 	request := &pbUsers.GetBasicUserDataRequest{
 		UserId: userId,
 	}
-	following, err := r.usersClient.GetUserFollowingIds(context.Background(), request)
+	ctx, cancel := r.usersContext(req)
+	defer cancel()
+	following, err := r.usersClient.GetUserFollowingIds(ctx, request)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				log.Printf("User %s unregistered\n", userId)
-				http.Error(w, "USER_UNREGISTERED", http.StatusUnauthorized)
-				return
-			default:
-				log.Printf("Unknown error code %v: %v\n", resErr.Code(),
-					resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request to get following ids: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, currentUserErrors.translate(ctx, "GetUserFollowingIds", err))
 		return
 	}
 	// Recycle feed only if this user is following other users.
@@ -210,10 +204,8 @@ func (r *Router) handleRecycleFeed(userId string, w http.ResponseWriter,
 		w.Write([]byte("NO_USERS_FOLLOWING"))
 		return
 	}
-	// Get always returns a session, even if empty
-	session, _ := r.store.Get(req, "session")
 	// Get id of contents to be discarded
-	discard := getDiscardIds(session)
+	discard := r.getDiscardIds(req)
 
 	activityPattern := &pbApi.ActivityPattern{
 		Pattern:    templates.FeedPattern,
@@ -221,17 +213,24 @@ func (r *Router) handleRecycleFeed(userId string, w http.ResponseWriter,
 		DiscardIds: discard.FormatFeedActivity(following.Ids),
 	}
 
-	stream, err := r.generalClient.RecycleActivity(context.Background(), activityPattern)
+	ctx, cancel = r.generalContext(req)
+	defer cancel()
+	stream, err := r.generalClient.RecycleActivity(ctx, activityPattern)
 	if err != nil {
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		logFor(req).Error("Could not send request", "err", err)
+		replyError(w, req, errInternalFailure)
 		return
 	}
 
-	feed, err := getFeed(stream)
+	feed, err := getFeed(stream, feedDashboard)
+	if exhausted(feed, err) {
+		writeExhausted(w, req, "/recyclefeed/reset")
+		return
+	}
+	code := http.StatusOK
 	if err != nil {
-		log.Printf("An error occurred while getting feed: %v\n", err)
-		w.WriteHeader(http.StatusPartialContent)
+		logFor(req).Warn("An error occurred while getting feed", "err", err)
+		code = http.StatusPartialContent
 	}
 
 	// Update session only if there is content.
@@ -239,6 +238,7 @@ func (r *Router) handleRecycleFeed(userId string, w http.ResponseWriter,
 		r.updateDiscardIdsSession(req, w, func(d *pagination.DiscardIds) {
 			pActivity := feed.GetPaginationActivity()
 
+			d.Touch(pagination.KindFeedActivity, "")
 			for userId, content := range pActivity {
 				a := d.FeedActivity[userId]
 				a.ThreadsCreated = append(a.ThreadsCreated, content.ThreadsCreated...)
@@ -248,28 +248,35 @@ func (r *Router) handleRecycleFeed(userId string, w http.ResponseWriter,
 			}
 		})
 	}
-	res := templates.FeedToBytes(feed.Contents, userId, true)
-	contentLength := strconv.Itoa(len(res))
-	w.Header().Set("Content-Length", contentLength)
-	w.Header().Set("Content-Type", "text/html")
-	if _, err = w.Write(res); err != nil {
-		log.Println("Recycle activity: could not send response:", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+	err = writeFeed(w, req, code, feed, userId, true, templates.FeedToBytes)
+	if err != nil {
+		logFor(req).Error("Recycle activity: could not send response", "err", err)
+		replyError(w, req, errInternalFailure)
 	}
 }
 
+// Reset feed "/recyclefeed/reset" handler. It forgets the contents already seen
+// in the feed of the dashboard, so that the next recycle starts over. It returns
+// OK on success or an error in case of the following:
+// - user is unregistered -> USER_UNREGISTERED
+// - storage failure ------> INTERNAL_FAILURE
+func (r *Router) handleResetFeed(userId string, w http.ResponseWriter,
+	req *http.Request) {
+	r.resetPagination(w, req, pagination.KindFeedActivity, "")
+}
+
 // Recycle activity "/recycleactivity" handler. It returns a new feed of user
-// activity in HTML format. The user must be logged in, and its recent activity
-// will compose up the returned feed. It may return an error in case of the
-// following:
-// - user is unregistered ---------> USER_UNREGISTERED
-// - network or encoding failures -> INTERNAL_FAILURE
+// activity in HTML format, or in JSON format if the client accepts
+// application/json. The user must be logged in, and its recent activity will
+// compose up the returned feed. It may return an error in case of the following:
+// - user is unregistered -----------> USER_UNREGISTERED
+// - no more contents are available -> EXHAUSTED
+// - network or encoding failures ---> INTERNAL_FAILURE
+// Note: EXHAUSTED is returned along with a 200 status code; see writeExhausted.
 func (r *Router) handleRecycleMyActivity(userId string, w http.ResponseWriter,
 	req *http.Request) {
-	// Get always returns a session, even if empty
-	session, _ := r.store.Get(req, "session")
 	// Get id of contents to be discarded
-	discard := getDiscardIds(session)
+	discard := r.getDiscardIds(req)
 
 	discardActivity := discard.FormatUserActivity("dashboard-" + userId)
 	if len(discardActivity) > 0 {
@@ -286,29 +293,23 @@ func (r *Router) handleRecycleMyActivity(userId string, w http.ResponseWriter,
 		Users:      []string{userId},
 	}
 
-	stream, err := r.generalClient.RecycleActivity(context.Background(), activityPattern)
+	ctx, cancel := r.generalContext(req)
+	defer cancel()
+	stream, err := r.generalClient.RecycleActivity(ctx, activityPattern)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				log.Printf("User %s unregistered\n", userId)
-				http.Error(w, "USER_UNREGISTERED", http.StatusUnauthorized)
-				return
-			default:
-				log.Printf("Unknown error code %v: %v\n", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, currentUserErrors.translate(ctx, "RecycleActivity", err))
 		return
 	}
 
-	userActivity, err = getFeed(stream)
+	userActivity, err = getFeed(stream, feedActivity)
+	if exhausted(userActivity, err) {
+		writeExhausted(w, req, "/recycleactivity/reset")
+		return
+	}
+	code := http.StatusOK
 	if err != nil {
-		log.Printf("An error occurred while getting feed: %v\n", err)
-		w.WriteHeader(http.StatusPartialContent)
+		logFor(req).Warn("An error occurred while getting feed", "err", err)
+		code = http.StatusPartialContent
 	}
 
 	// Update session only if there is content.
@@ -319,6 +320,7 @@ func (r *Router) handleRecycleMyActivity(userId string, w http.ResponseWriter,
 			// avoid conflict with view profile by adding a preffix dashboard-
 			id := "dashboard-" + userId
 
+			d.Touch(pagination.KindUserActivity, id)
 			a := d.UserActivity[id]
 			a.ThreadsCreated = append(a.ThreadsCreated, pActivity.ThreadsCreated...)
 			a.Comments = append(a.Comments, pActivity.Comments...)
@@ -326,28 +328,35 @@ func (r *Router) handleRecycleMyActivity(userId string, w http.ResponseWriter,
 			d.UserActivity[id] = a
 		})
 	}
-	res := templates.FeedToBytes(userActivity.Contents, userId, true)
-	contentLength := strconv.Itoa(len(res))
-	w.Header().Set("Content-Length", contentLength)
-	w.Header().Set("Content-Type", "text/html")
-	if _, err = w.Write(res); err != nil {
-		log.Println("Recycle my activity: could not send response:", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+	err = writeFeed(w, req, code, userActivity, userId, true, templates.FeedToBytes)
+	if err != nil {
+		logFor(req).Error("Recycle my activity: could not send response", "err", err)
+		replyError(w, req, errInternalFailure)
 	}
 }
 
+// Reset activity "/recycleactivity/reset" handler. It forgets the activity of
+// the user already seen in the dashboard, so that the next recycle starts over.
+// It returns OK on success or an error in case of the following:
+// - user is unregistered -> USER_UNREGISTERED
+// - storage failure ------> INTERNAL_FAILURE
+func (r *Router) handleResetMyActivity(userId string, w http.ResponseWriter,
+	req *http.Request) {
+	r.resetPagination(w, req, pagination.KindUserActivity, "dashboard-"+userId)
+}
+
 // Recycle saved "/recyclesaved" handler. It returns a new feed of user saved
-// content in HTML format. The user must be logged in, and its saved content
-// will compose up the returned feed. It may return an error in case of the
-// following:
-// - user is unregistered ---------> USER_UNREGISTERED
-// - network or encoding failures -> INTERNAL_FAILURE
+// content in HTML format, or in JSON format if the client accepts
+// application/json. The user must be logged in, and its saved content will
+// compose up the returned feed. It may return an error in case of the following:
+// - user is unregistered -----------> USER_UNREGISTERED
+// - no more contents are available -> EXHAUSTED
+// - network or encoding failures ---> INTERNAL_FAILURE
+// Note: EXHAUSTED is returned along with a 200 status code; see writeExhausted.
 func (r *Router) handleRecycleMySaved(userId string, w http.ResponseWriter,
 	req *http.Request) {
-	// Get always returns a session, even if empty
-	session, _ := r.store.Get(req, "session")
 	// Get id of contents to be discarded
-	discard := getDiscardIds(session)
+	discard := r.getDiscardIds(req)
 
 	var savedThreads templates.ContentsFeed
 
@@ -357,58 +366,64 @@ func (r *Router) handleRecycleMySaved(userId string, w http.ResponseWriter,
 		DiscardIds: discard.FormatSavedThreads(),
 	}
 
-	stream, err := r.generalClient.RecycleSaved(context.Background(), savedPattern)
+	ctx, cancel := r.generalContext(req)
+	defer cancel()
+	stream, err := r.generalClient.RecycleSaved(ctx, savedPattern)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				log.Printf("User %s unregistered\n", userId)
-				http.Error(w, "USER_UNREGISTERED", http.StatusUnauthorized)
-				return
-			default:
-				log.Printf("Unknown error code %v: %v\n", resErr.Code(),
-					resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, currentUserErrors.translate(ctx, "RecycleSaved", err))
 		return
 	}
 
-	savedThreads, err = getFeed(stream)
+	savedThreads, err = getFeed(stream, feedSaved)
+	if exhausted(savedThreads, err) {
+		writeExhausted(w, req, "/recyclesaved/reset")
+		return
+	}
+	code := http.StatusOK
 	if err != nil {
 		if resErr, ok := status.FromError(err); ok {
 			switch resErr.Code() {
 			case codes.InvalidArgument:
-				w.Write([]byte(""))
+				// There are no saved threads; send an empty feed.
+				err = writeFeed(w, req, http.StatusOK, templates.ContentsFeed{}, userId, true,
+					templates.FeedToBytes)
+				if err != nil {
+					logFor(req).Error("Recycle saved: could not send response", "err", err)
+				}
 				return
 			}
 		}
-		log.Printf("An error occurred while getting feed: %v\n", err)
-		w.WriteHeader(http.StatusPartialContent)
+		logFor(req).Warn("An error occurred while getting feed", "err", err)
+		code = http.StatusPartialContent
 	}
 
 	// Update session only if there is content.
 	if len(savedThreads.Contents) > 0 {
 		r.updateDiscardIdsSession(req, w, func(d *pagination.DiscardIds) {
 			pThreads := savedThreads.GetPaginationThreads()
+			d.Touch(pagination.KindSavedThreads, "")
 			for section, threadIds := range pThreads {
 				d.SavedThreads[section] = append(d.SavedThreads[section], threadIds...)
 			}
 		})
 	}
-	res := templates.FeedToBytes(savedThreads.Contents, userId, true)
-	contentLength := strconv.Itoa(len(res))
-	w.Header().Set("Content-Length", contentLength)
-	w.Header().Set("Content-Type", "text/html")
-	if _, err = w.Write(res); err != nil {
-		log.Println("Recycle saved: could not send response:", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+	err = writeFeed(w, req, code, savedThreads, userId, true, templates.FeedToBytes)
+	if err != nil {
+		logFor(req).Error("Recycle saved: could not send response", "err", err)
+		replyError(w, req, errInternalFailure)
 	}
 }
 
+// Reset saved "/recyclesaved/reset" handler. It forgets the saved threads
+// already seen in the dashboard, so that the next recycle starts over. It
+// returns OK on success or an error in case of the following:
+// - user is unregistered -> USER_UNREGISTERED
+// - storage failure ------> INTERNAL_FAILURE
+func (r *Router) handleResetMySaved(userId string, w http.ResponseWriter,
+	req *http.Request) {
+	r.resetPagination(w, req, pagination.KindSavedThreads, "")
+}
+
 // Explore page "/explore" handler. It displays a page containing a feed made up
 // of random threads from different sections. It may return an error in case of
 // the following:
@@ -420,82 +435,86 @@ func (r *Router) handleExplore(w http.ResponseWriter, req *http.Request) {
 		// ignore DiscardIds; do not discard any thread
 	}
 
-	stream, err := r.generalClient.RecycleGeneral(context.Background(), generalPattern)
+	ctx, cancel := r.generalContext(req)
+	defer cancel()
+	stream, err := r.generalClient.RecycleGeneral(ctx, generalPattern)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			log.Printf("Unknown error code %v: %v\n", resErr.Code(), resErr.Message())
-			http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-			return
-		}
-		log.Println("Could not send request:", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, generalErrors.translate(ctx, "RecycleGeneral", err))
 		return
 	}
-	feed, err := getFeed(stream)
+	feed, err := getFeed(stream, feedExplore)
+	code := http.StatusOK
 	if err != nil {
-		log.Printf("An error occurred while getting feed: %v\n", err)
-		w.WriteHeader(http.StatusPartialContent)
+		logFor(req).Warn("An error occurred while getting feed", "err", err)
+		code = http.StatusPartialContent
 	}
 	// get current user data for header section
 	userId := r.currentUser(req)
 	var userHeader *pbUsers.UserHeaderData
 	if userId != "" {
 		// A user is logged in. Get its data.
-		userHeader = r.getUserHeaderData(w, userId)
+		userHeader = r.getUserHeaderData(req, userId, &code)
 	}
 
 	exploreView := templates.DataToExploreView(feed.Contents, userHeader, userId)
+	exploreView.CSRFToken = r.csrfToken(req)
 
 	// Update session only if there is feed
 	if len(feed.Contents) > 0 {
 		r.updateDiscardIdsSession(req, w, func(d *pagination.DiscardIds) {
 			pThreads := feed.GetPaginationThreads()
+			d.Reset(pagination.KindGeneralThreads, "")
 			for section, threadIds := range pThreads {
 				d.GeneralThreads[section] = threadIds
 			}
 		})
 	}
 	// render explore page
+	w.WriteHeader(code)
 	if err = r.templates.ExecuteTemplate(w, "explore.html", exploreView); err != nil {
-		log.Printf("Could not execute template explore.html: %v\n", err)
-		http.Error(w, "TEMPLATE_ERROR", http.StatusInternalServerError)
+		logFor(req).Error("Could not execute template", "template", "explore.html", "err", err)
+		replyError(w, req, errTemplate)
 	}
 }
 
 // Explore Recycle "/explore/recycle" handler. It returns a new feed of explore
-// in HTML format, excluding threads already seen. It may return an error in case
-// of the following:
+// in HTML format, or in JSON format if the client accepts application/json,
+// excluding threads already seen. It may return an error in case of the
+// following:
+// - no more threads are available -----> EXHAUSTED
 // - encoding failure or network error -> INTERNAL_FAILURE
+// Note: EXHAUSTED is returned along with a 200 status code; see writeExhausted.
 func (r *Router) handleExploreRecycle(w http.ResponseWriter, req *http.Request) {
-	// Get always returns a session, even if empty
-	session, _ := r.store.Get(req, "session")
-	discard := getDiscardIds(session)
+	// Get id of contents to be discarded
+	discard := r.getDiscardIds(req)
 
 	generalPattern := &pbApi.GeneralPattern{
 		Pattern:    templates.FeedPattern,
 		DiscardIds: discard.FormatGeneralThreads(),
 	}
 
-	stream, err := r.generalClient.RecycleGeneral(context.Background(), generalPattern)
+	ctx, cancel := r.generalContext(req)
+	defer cancel()
+	stream, err := r.generalClient.RecycleGeneral(ctx, generalPattern)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			log.Printf("Unknown error code %v: %v\n", resErr.Code(), resErr.Message())
-			http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-			return
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, generalErrors.translate(ctx, "RecycleGeneral", err))
 		return
 	}
-	feed, err := getFeed(stream)
+	feed, err := getFeed(stream, feedExplore)
+	if exhausted(feed, err) {
+		writeExhausted(w, req, "/explore/recycle/reset")
+		return
+	}
+	code := http.StatusOK
 	if err != nil {
-		log.Printf("An error occurred while getting feed: %v\n", err)
-		w.WriteHeader(http.StatusPartialContent)
+		logFor(req).Warn("An error occurred while getting feed", "err", err)
+		code = http.StatusPartialContent
 	}
 	// update session only if there is new feed.
 	if len(feed.Contents) > 0 {
 		r.updateDiscardIdsSession(req, w, func(d *pagination.DiscardIds) {
 			pThreads := feed.GetPaginationThreads()
+			d.Touch(pagination.KindGeneralThreads, "")
 			for section, threadIds := range pThreads {
 				d.GeneralThreads[section] = append(d.GeneralThreads[section],
 					threadIds...)
@@ -504,12 +523,17 @@ func (r *Router) handleExploreRecycle(w http.ResponseWriter, req *http.Request)
 	}
 	// Get current user id.
 	userId := r.currentUser(req)
-	res := templates.FeedToBytes(feed.Contents, userId, true)
-	contentLength := strconv.Itoa(len(res))
-	w.Header().Set("Content-Length", contentLength)
-	w.Header().Set("Content-Type", "text/html")
-	if _, err = w.Write(res); err != nil {
-		log.Println("Recycle explore: could not send response:", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+	err = writeFeed(w, req, code, feed, userId, true, templates.FeedToBytes)
+	if err != nil {
+		logFor(req).Error("Recycle explore: could not send response", "err", err)
+		replyError(w, req, errInternalFailure)
 	}
 }
+
+// Explore Reset "/explore/recycle/reset" handler. It forgets the threads already
+// seen in explore, so that the next recycle starts over. It returns OK on
+// success or an error in case of the following:
+// - storage failure -> INTERNAL_FAILURE
+func (r *Router) handleExploreReset(w http.ResponseWriter, req *http.Request) {
+	r.resetPagination(w, req, pagination.KindGeneralThreads, "")
+}
@@ -2,9 +2,7 @@ package router
 
 import (
 	"context"
-	"log"
 	"net/http"
-	"strconv"
 	"time"
 
 	pbTime "github.com/golang/protobuf/ptypes/timestamp"
@@ -13,8 +11,6 @@ import (
 	pbUsers "github.com/luisguve/cheroproto-go/userapi"
 	"github.com/luisguve/cherosite/internal/pkg/pagination"
 	"github.com/luisguve/cherosite/internal/pkg/templates"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 // Section "/{section}" handler. It requests a pattern of active threads from the
@@ -32,8 +28,8 @@ func (r *Router) handleViewSection(w http.ResponseWriter, req *http.Request) {
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
@@ -45,64 +41,54 @@ func (r *Router) handleViewSection(w http.ResponseWriter, req *http.Request) {
 		// ignore DiscardIds, do not discard any thread
 	}
 
-	stream, err := section.Client.RecycleContent(context.Background(), contentPattern)
+	ctx, cancel := sectionContext(req, section)
+	defer cancel()
+	stream, err := section.Client.RecycleContent(ctx, contentPattern)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				// The section name is probably wrong.
-				// log for debugging.
-				log.Printf("Section %s not found\n", sectionId)
-				http.NotFound(w, req)
-				return
-			case codes.Unavailable:
-				log.Printf("Section %s temporarily unavailable\n", sectionId)
-				http.Error(w, "SECTION_UNAVAILABLE", http.StatusNoContent)
-				return
-			default:
-				log.Printf("Unknown code: %v - %s\n", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, sectionErrors.translate(ctx, "RecycleContent", err))
 		return
 	}
 
-	feed, err := getFeed(stream)
+	feed, err := getFeed(stream, feedSection)
+	code := http.StatusOK
 	if err != nil {
-		log.Printf("An error occurred while getting feed: %v\n", err)
-		w.WriteHeader(http.StatusPartialContent)
+		logFor(req).Warn("An error occurred while getting feed", "err", err)
+		code = http.StatusPartialContent
 	}
 
 	var userHeader *pbUsers.UserHeaderData
 	userId := r.currentUser(req)
 	if userId != "" {
 		// A user is logged in. Get its data.
-		userHeader = r.getUserHeaderData(w, userId)
+		userHeader = r.getUserHeaderData(req, userId, &code)
 	}
 	sectionView := templates.DataToSectionView(feed.Contents, userHeader, userId, section.Name, sectionId)
+	sectionView.CSRFToken = r.csrfToken(req)
 	// update session only if there is content.
 	if len(feed.Contents) > 0 {
 		r.updateDiscardIdsSession(req, w, func(d *pagination.DiscardIds) {
 			pThreads := feed.GetSectionPaginationThreads()
 
+			d.Reset(pagination.KindSectionThreads, sectionId)
 			d.SectionThreads[sectionId] = pThreads
 		})
 	}
 
+	w.WriteHeader(code)
 	if err := r.templates.ExecuteTemplate(w, "section.html", sectionView); err != nil {
-		log.Printf("Could not execute template section.html: %v\n", err)
-		http.Error(w, "TEMPLATE_ERROR", http.StatusInternalServerError)
+		logFor(req).Error("Could not execute template", "template", "section.html", "err", err)
+		replyError(w, req, errTemplate)
 	}
 }
 
 // Recycle section "/{section}/recycle" handler. It returns a new feed for the
-// section in HTML format. It may return an error in case of the following:
+// section in HTML format, or in JSON format if the client accepts
+// application/json. It may return an error in case of the following:
 // - wrong section name ------------------> 404 NOT FOUND
 // - valid section name, but unavailable -> SECTION_UNAVAILABLE
+// - no more threads are available -------> EXHAUSTED
 // - network or encoding failure ---------> INTERNAL_FAILURE
+// Note: EXHAUSTED is returned along with a 200 status code; see writeExhausted.
 func (r *Router) handleRecycleSection(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	sectionId := vars["section"]
@@ -110,17 +96,15 @@ func (r *Router) handleRecycleSection(w http.ResponseWriter, req *http.Request)
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
 	sectionCtx := formatContextSection(sectionId)
 
-	// Get always returns a session, even if empty
-	session, _ := r.store.Get(req, "session")
 	// Get id of contents to be discarded
-	discard := getDiscardIds(session)
+	discard := r.getDiscardIds(req)
 
 	contentPattern := &pbApi.ContentPattern{
 		Pattern:        templates.FeedPattern,
@@ -128,34 +112,22 @@ func (r *Router) handleRecycleSection(w http.ResponseWriter, req *http.Request)
 		DiscardIds:     discard.FormatSectionThreads(sectionId),
 	}
 
-	stream, err := section.Client.RecycleContent(context.Background(), contentPattern)
+	ctx, cancel := sectionContext(req, section)
+	defer cancel()
+	stream, err := section.Client.RecycleContent(ctx, contentPattern)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				// The section name is probably wrong.
-				// log for debugging.
-				log.Printf("Section %s not found\n", sectionId)
-				http.NotFound(w, req)
-				return
-			case codes.Unavailable:
-				log.Printf("Section %s temporarily unavailable\n", sectionId)
-				http.Error(w, "SECTION_UNAVAILABLE", http.StatusNoContent)
-				return
-			default:
-				log.Printf("Unknown code: %v - %s\n", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, sectionErrors.translate(ctx, "RecycleContent", err))
 		return
 	}
-	feed, err := getFeed(stream)
+	feed, err := getFeed(stream, feedSection)
+	if exhausted(feed, err) {
+		writeExhausted(w, req, "/"+sectionId+"/recycle/reset")
+		return
+	}
+	code := http.StatusOK
 	if err != nil {
-		log.Printf("An error occurred while getting feed: %v\n", err)
-		w.WriteHeader(http.StatusPartialContent)
+		logFor(req).Warn("An error occurred while getting feed", "err", err)
+		code = http.StatusPartialContent
 	}
 
 	// update session only if there is content.
@@ -163,21 +135,34 @@ func (r *Router) handleRecycleSection(w http.ResponseWriter, req *http.Request)
 		r.updateDiscardIdsSession(req, w, func(d *pagination.DiscardIds) {
 			pThreads := feed.GetSectionPaginationThreads()
 
+			d.Touch(pagination.KindSectionThreads, sectionId)
 			d.SectionThreads[sectionId] = append(d.SectionThreads[sectionId], pThreads...)
 		})
 	}
 	// Get current user id.
 	userId := r.currentUser(req)
-	res := templates.FeedToBytes(feed.Contents, userId, false)
-	contentLength := strconv.Itoa(len(res))
-	w.Header().Set("Content-Length", contentLength)
-	w.Header().Set("Content-Type", "text/html")
-	if _, err = w.Write(res); err != nil {
-		log.Println("Recycle section: could not send response:", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+	err = writeFeed(w, req, code, feed, userId, false, templates.FeedToBytes)
+	if err != nil {
+		logFor(req).Error("Recycle section: could not send response", "err", err)
+		replyError(w, req, errInternalFailure)
 	}
 }
 
+// Reset section "/{section}/recycle/reset" handler. It forgets the threads
+// already seen in the section, so that the next recycle starts over. It returns
+// OK on success or an error in case of the following:
+// - wrong section name -> 404 NOT FOUND
+// - storage failure ----> INTERNAL_FAILURE
+func (r *Router) handleResetSection(w http.ResponseWriter, req *http.Request) {
+	sectionId := mux.Vars(req)["section"]
+	if _, ok := r.sections[sectionId]; !ok {
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
+		return
+	}
+	r.resetPagination(w, req, pagination.KindSectionThreads, sectionId)
+}
+
 // Create thread "/{section}/new" handler. It handles the creation of content
 // in a section through POSTing a form. It returns the permalink of the newly created
 // thread on success, or an error in case of the following:
@@ -200,69 +185,65 @@ func (r *Router) handleNewThread(userId string, w http.ResponseWriter,
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
 	// Get ft_file and save it to the disk with a unique, random name.
-	filePath, err, s := getAndSaveFile(req, "ft_file")
+	filePath, err := getAndSaveFile(req, "ft_file")
 	if err != nil {
-		http.Error(w, err.Error(), s)
+		replyError(w, req, err)
 		return
 	}
 	// Get the rest of the content parts
 	content := req.FormValue("content")
 	if content == "" {
-		http.Error(w, "NO_CONTENT", http.StatusBadRequest)
+		replyError(w, req, errNoContent)
 		return
 	}
 	title := req.FormValue("title")
 	if title == "" {
-		http.Error(w, "NO_TITLE", http.StatusBadRequest)
+		replyError(w, req, errNoTitle)
 		return
 	}
-	sectionCtx := formatContextSection(sectionId)
-	createRequest := &pbApi.CreateThreadRequest{
-		UserId:  userId,
-		Content: &pbApi.Content{
-			Title:   title,
-			Content: content,
-			FtFile:  filePath,
-			PublishDate: &pbTime.Timestamp{
-				Seconds: time.Now().Unix(),
-			},
+	threadContent := &pbApi.Content{
+		Title:   title,
+		Content: content,
+		FtFile:  filePath,
+		PublishDate: &pbTime.Timestamp{
+			Seconds: time.Now().Unix(),
 		},
-		SectionCtx: sectionCtx,
 	}
-	res, err := section.Client.CreateThread(context.Background(), createRequest)
+	ctx, cancel := sectionContext(req, section)
+	defer cancel()
+	permalink, err := r.createThread(ctx, userId, sectionId, threadContent, section.Client)
 	if err != nil {
-		resErr, ok := status.FromError(err)
-		if ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				// the section name is probably wrong; log message.
-				log.Printf("Section %s not found\n", sectionId)
-				http.NotFound(w, req)
-				return
-			// A user can create a limited number of threads daily.
-			case codes.FailedPrecondition:
-				http.Error(w, "USER_UNABLE_TO_POST", http.StatusPreconditionFailed)
-				return
-			case codes.Unauthenticated:
-				log.Println("This user is unregistered")
-				http.Error(w, "USER_UNREGISTERED", http.StatusUnauthorized)
-				return
-			default:
-				log.Printf("Unknown code: %v - %s\n", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(res.Permalink))
+	w.Write([]byte(permalink))
+}
+
+// createThread submits the creation of a thread with the given content in the
+// given section on behalf of the given user. It returns the permalink of the
+// newly created thread or an error in case of the following:
+// - creating a thread in an invalid section -> 404 NOT_FOUND
+// - user has already posted today -----------> USER_UNABLE_TO_POST
+// - user unathenticated ---------------------> USER_UNREGISTERED
+// - network failures ------------------------> INTERNAL_FAILURE
+func (r *Router) createThread(ctx context.Context, userId, sectionId string,
+	content *pbApi.Content, section pbApi.CrudCheropatillaClient) (string, error) {
+	sectionCtx := formatContextSection(sectionId)
+	createRequest := &pbApi.CreateThreadRequest{
+		UserId:     userId,
+		Content:    content,
+		SectionCtx: sectionCtx,
+	}
+	res, err := section.CreateThread(ctx, createRequest)
+	if err != nil {
+		return "", createThreadErrors.translate(ctx, "CreateThread", err)
+	}
+	return res.Permalink, nil
 }
@@ -2,17 +2,14 @@ package router
 
 import (
 	"context"
-	"log"
 	"net/http"
-	"strconv"
 
 	"github.com/gorilla/mux"
 	pbApi "github.com/luisguve/cheroproto-go/cheroapi"
+	pbContext "github.com/luisguve/cheroproto-go/context"
 	pbUsers "github.com/luisguve/cheroproto-go/userapi"
 	"github.com/luisguve/cherosite/internal/pkg/pagination"
 	"github.com/luisguve/cherosite/internal/pkg/templates"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 // Thread "/{section}/{thread}" handler. It looks for a thread using its identifier
@@ -31,8 +28,8 @@ func (r *Router) handleViewThread(w http.ResponseWriter, req *http.Request) {
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
@@ -42,34 +39,15 @@ func (r *Router) handleViewThread(w http.ResponseWriter, req *http.Request) {
 		Thread: threadCtx,
 	}
 	// Load thread
-	content, err := section.Client.GetThread(context.Background(), request)
+	ctx, cancel := sectionContext(req, section)
+	defer cancel()
+	content, err := section.Client.GetThread(ctx, request)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				// Section name or thread id are probably wrong.
-				// Log for debugging.
-				log.Printf("Could not find thread (id: %s) on section %s\n",
-					thread, sectionId)
-				http.NotFound(w, req)
-				return
-			case codes.Unavailable:
-				// Section unavailable
-				log.Printf("Section %s unavailable\n", sectionId)
-				http.Error(w, "SECTION_UNAVAILABLE", http.StatusNoContent)
-				return
-			default:
-				log.Printf("Unknown error code %v: %v\n", resErr.Code(),
-					resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, sectionErrors.translate(ctx, "GetThread", err))
 		return
 	}
 	var feed templates.ContentsFeed
+	code := http.StatusOK
 	// Load comments only if there are comments on this thread
 	if content.Metadata.Replies > 0 {
 		// Request to load comments
@@ -78,15 +56,17 @@ func (r *Router) handleViewThread(w http.ResponseWriter, req *http.Request) {
 			ContentContext: &pbApi.ContentPattern_ThreadCtx{threadCtx},
 			// ignore DiscardIds; do not discard any comment
 		}
-		stream, err := section.Client.RecycleContent(context.Background(), contentPattern)
+		ctx, cancel := sectionContext(req, section)
+		defer cancel()
+		stream, err := section.Client.RecycleContent(ctx, contentPattern)
 		if err != nil {
-			log.Printf("Could not send request: %v\n", err)
-			w.WriteHeader(http.StatusPartialContent)
+			logFor(req).Warn("Could not send request", "err", err)
+			code = http.StatusPartialContent
 		} else {
-			feed, err = getFeed(stream)
+			feed, err = getFeed(stream, feedComments)
 			if err != nil {
-				log.Printf("An error occurred while getting feed: %v\n", err)
-				w.WriteHeader(http.StatusPartialContent)
+				logFor(req).Warn("An error occurred while getting feed", "err", err)
+				code = http.StatusPartialContent
 			}
 		}
 	}
@@ -95,6 +75,7 @@ func (r *Router) handleViewThread(w http.ResponseWriter, req *http.Request) {
 		r.updateDiscardIdsSession(req, w, func(d *pagination.DiscardIds) {
 			pComments := feed.GetPaginationComments()
 
+			d.Reset(pagination.KindThreadComments, thread)
 			d.ThreadComments[thread] = pComments
 		})
 	}
@@ -104,23 +85,27 @@ func (r *Router) handleViewThread(w http.ResponseWriter, req *http.Request) {
 	var userHeader *pbUsers.UserHeaderData
 	if userId != "" {
 		// A user is logged in. Get its data.
-		userHeader = r.getUserHeaderData(w, userId)
+		userHeader = r.getUserHeaderData(req, userId, &code)
 	}
 
 	threadView := templates.DataToThreadView(content, feed.Contents, userHeader, userId, sectionId)
+	threadView.CSRFToken = r.csrfToken(req)
 
+	w.WriteHeader(code)
 	if err := r.templates.ExecuteTemplate(w, "thread.html", threadView); err != nil {
-		log.Printf("Could not execute template thread.html: %v\n", err)
-		http.Error(w, "TEMPLATE_ERROR", http.StatusInternalServerError)
+		logFor(req).Error("Could not execute template", "template", "thread.html", "err", err)
+		replyError(w, req, errTemplate)
 	}
 }
 
 // Recycle thread comments "/{section}/{thread}/recycle" handler.
-// It returns a new feed of comments for the thread in JSON format.
+// It returns a new feed of comments for the thread in HTML format, or in JSON
+// format if the client accepts application/json.
 // It may return an error in the following cases:
 // - invalid section name or thread id -> 404 NOT_FOUND
-// - no more comments are available ----> OUT_OF_RANGE
+// - no more comments are available ----> EXHAUSTED
 // - network or encoding failures ------> INTERNAL_FAILURE
+// Note: EXHAUSTED is returned along with a 200 status code; see writeExhausted.
 func (r *Router) handleRecycleComments(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	sectionId := vars["section"]
@@ -128,16 +113,15 @@ func (r *Router) handleRecycleComments(w http.ResponseWriter, req *http.Request)
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
 	threadCtx := formatContextThread(sectionId, thread)
 
-	// Get always returns a session, even if empty
-	session, _ := r.store.Get(req, "session")
-	discardIds := getDiscardIds(session)
+	// Get id of contents to be discarded
+	discardIds := r.getDiscardIds(req)
 
 	contentPattern := &pbApi.ContentPattern{
 		Pattern:        templates.CommentPattern,
@@ -146,33 +130,29 @@ func (r *Router) handleRecycleComments(w http.ResponseWriter, req *http.Request)
 	}
 	var feed templates.ContentsFeed
 
-	stream, err := section.Client.RecycleContent(context.Background(), contentPattern)
+	ctx, cancel := sectionContext(req, section)
+	defer cancel()
+	// No more comments are available if the section replies OUT_OF_RANGE.
+	reset := "/" + sectionId + "/" + thread + "/recycle/reset"
+	stream, err := section.Client.RecycleContent(ctx, contentPattern)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				// log for debugging
-				log.Printf("Invalid section id %s or thread id %s\n", sectionId, thread)
-				http.NotFound(w, req)
-				return
-			case codes.OutOfRange:
-				log.Println("OOR: no more comments on this thread are available")
-				http.Error(w, "OUT_OF_RANGE", http.StatusNoContent)
-				return
-			default:
-				log.Printf("Unknown code %v: %v\n", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
+		err = recycleCommentsErrors.translate(ctx, "RecycleContent", err)
+		if err == errOutOfRange {
+			writeExhausted(w, req, reset)
+			return
 		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, err)
+		return
+	}
+	feed, err = getFeed(stream, feedComments)
+	if exhausted(feed, err) {
+		writeExhausted(w, req, reset)
 		return
 	}
-	feed, err = getFeed(stream)
+	code := http.StatusOK
 	if err != nil {
-		log.Printf("An error occurred while getting feed: %v\n", err)
-		w.WriteHeader(http.StatusPartialContent)
+		logFor(req).Warn("An error occurred while getting feed", "err", err)
+		code = http.StatusPartialContent
 	}
 
 	// update session only if there is content.
@@ -180,21 +160,34 @@ func (r *Router) handleRecycleComments(w http.ResponseWriter, req *http.Request)
 		r.updateDiscardIdsSession(req, w, func(d *pagination.DiscardIds) {
 			pComments := feed.GetPaginationComments()
 
+			d.Touch(pagination.KindThreadComments, thread)
 			d.ThreadComments[thread] = append(d.ThreadComments[thread], pComments...)
 		})
 	}
 	// Get current user id.
 	userId := r.currentUser(req)
 
-	res := templates.FeedToContentBytes(feed.Contents, userId, false)
+	err = writeFeed(w, req, code, feed, userId, false, templates.FeedToContentBytes)
+	if err != nil {
+		logFor(req).Error("Recycle comments: could not send response", "err", err)
+		replyError(w, req, errInternalFailure)
+	}
+}
 
-	contentLength := strconv.Itoa(len(res))
-	w.Header().Set("Content-Length", contentLength)
-	w.Header().Set("Content-Type", "text/html")
-	if _, err = w.Write(res); err != nil {
-		log.Println("Recycle comments: could not send response:", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+// Reset thread comments "/{section}/{thread}/recycle/reset" handler. It forgets
+// the comments already seen in the thread, so that the next recycle starts over.
+// It returns OK on success or an error in case of the following:
+// - invalid section name -> 404 NOT_FOUND
+// - storage failure ------> INTERNAL_FAILURE
+func (r *Router) handleResetComments(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	sectionId := vars["section"]
+	if _, ok := r.sections[sectionId]; !ok {
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
+		return
 	}
+	r.resetPagination(w, req, pagination.KindThreadComments, vars["thread"])
 }
 
 // Save thread "/{section}/{thread}/save" handler. It adds the thread id
@@ -210,41 +203,39 @@ func (r *Router) handleSave(userId string, w http.ResponseWriter, req *http.Requ
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
 	threadCtx := formatContextThread(sectionId, thread)
 
+	ctx, cancel := sectionContext(req, section)
+	defer cancel()
+	if err := r.saveThread(ctx, userId, threadCtx, section.Client); err != nil {
+		replyError(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// saveThread adds the thread to the list of saved threads of the given user. It
+// returns an error in case of the following:
+// - invalid section name or thread id -> 404 NOT_FOUND
+// - section or thread are unavailable -> SECTION_UNAVAILABLE
+// - network failures ------------------> INTERNAL_FAILURE
+func (r *Router) saveThread(ctx context.Context, userId string,
+	threadCtx *pbContext.Thread, section pbApi.CrudCheropatillaClient) error {
 	request := &pbApi.SaveThreadRequest{
 		UserId: userId,
 		Thread: threadCtx,
 	}
-	_, err := section.Client.SaveThread(context.Background(), request)
+	_, err := section.SaveThread(ctx, request)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				// log for debugging
-				log.Printf("Invalid section id %s or thread id %s\n", sectionId, thread)
-				http.NotFound(w, req)
-				return
-			case codes.Unavailable:
-				http.Error(w, "SECTION_UNAVAILABLE", http.StatusNoContent)
-				return
-			default:
-				log.Printf("Unknown code %v: %v\n", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-		return
+		return sectionErrors.translate(ctx, "SaveThread", err)
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	return nil
 }
 
 // Undo save thread "/{section}/{thread}/undosave" handler. It removes the thread
@@ -259,38 +250,38 @@ func (r *Router) handleUndoSave(userId string, w http.ResponseWriter, req *http.
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
 	threadCtx := formatContextThread(sectionId, thread)
 
+	ctx, cancel := sectionContext(req, section)
+	defer cancel()
+	if err := r.undoSaveThread(ctx, userId, threadCtx, section.Client); err != nil {
+		replyError(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// undoSaveThread removes the thread from the list of saved threads of the given
+// user. It returns an error in case of the following:
+// - invalid section name or thread id -> 404 NOT_FOUND
+// - network failures ------------------> INTERNAL_FAILURE
+func (r *Router) undoSaveThread(ctx context.Context, userId string,
+	threadCtx *pbContext.Thread, section pbApi.CrudCheropatillaClient) error {
 	undoSaveRequest := &pbApi.UndoSaveThreadRequest{
 		UserId: userId,
 		Thread: threadCtx,
 	}
-	_, err := section.Client.UndoSaveThread(context.Background(), undoSaveRequest)
+	_, err := section.UndoSaveThread(ctx, undoSaveRequest)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				// log for debugging
-				log.Printf("Invalid section id %s or thread id %s\n", sectionId, thread)
-				http.NotFound(w, req)
-				return
-			default:
-				log.Printf("Unknown code %v: %v\n", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-		return
+		return sectionErrors.translate(ctx, "UndoSaveThread", err)
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	return nil
 }
 
 // Delete Thread "/{section}/{thread}/delete/" handler. It deletes the thread
@@ -308,8 +299,8 @@ func (r *Router) handleDeleteThread(userId string, w http.ResponseWriter,
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
@@ -319,7 +310,7 @@ func (r *Router) handleDeleteThread(userId string, w http.ResponseWriter,
 		UserId:         userId,
 		ContentContext: &pbApi.DeleteContentRequest_ThreadCtx{threadCtx},
 	}
-	r.handleDelete(w, req, deleteRequest, section.Client)
+	r.handleDelete(w, req, deleteRequest, section)
 }
 
 // Post Upvote "/{section}/{thread}/upvote/" handler. It leverages the operation of
@@ -336,8 +327,8 @@ func (r *Router) handleUpvoteThread(userId string, w http.ResponseWriter,
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s is not in Router's sections map.\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
@@ -348,7 +339,7 @@ func (r *Router) handleUpvoteThread(userId string, w http.ResponseWriter,
 		ContentContext: &pbApi.UpvoteRequest_ThreadCtx{threadCtx},
 	}
 
-	r.handleUpvote(w, req, upvoteRequest, section.Client)
+	r.handleUpvote(w, req, upvoteRequest, section)
 }
 
 // Post upvote undoing "/{section}/{thread}/undoupvote/" handler. It leverages
@@ -365,8 +356,8 @@ func (r *Router) handleUndoUpvoteThread(userId string, w http.ResponseWriter,
 	// Get section client.
 	section, ok := r.sections[sectionId]
 	if !ok {
-		log.Printf("Section %s not found\n", sectionId)
-		http.NotFound(w, req)
+		logFor(req).Debug("Section not found", "section", sectionId)
+		replyError(w, req, errNotFound)
 		return
 	}
 
@@ -377,5 +368,5 @@ func (r *Router) handleUndoUpvoteThread(userId string, w http.ResponseWriter,
 		ContentContext: &pbApi.UndoUpvoteRequest_ThreadCtx{threadCtx},
 	}
 
-	r.handleUndoUpvote(w, req, undoUpvoteRequest, section.Client)
+	r.handleUndoUpvote(w, req, undoUpvoteRequest, section)
 }
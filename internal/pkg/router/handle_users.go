@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"log"
 	"math/rand"
 	"net/http"
 	"path"
@@ -12,9 +11,11 @@ import (
 	"strings"
 
 	"github.com/gorilla/mux"
-	"github.com/gorilla/sessions"
 	pbApi "github.com/luisguve/cheroproto-go/cheroapi"
 	pbUsers "github.com/luisguve/cheroproto-go/userapi"
+	"github.com/luisguve/cherosite/internal/pkg/livedata"
+	"github.com/luisguve/cherosite/internal/pkg/logging"
+	"github.com/luisguve/cherosite/internal/pkg/metrics"
 	"github.com/luisguve/cherosite/internal/pkg/pagination"
 	"github.com/luisguve/cherosite/internal/pkg/templates"
 	"google.golang.org/grpc/codes"
@@ -31,23 +32,15 @@ func (r *Router) handleReadNotifs(userId string, w http.ResponseWriter,
 	request := &pbUsers.ReadNotifsRequest{
 		UserId: userId,
 	}
-	_, err := r.usersClient.MarkAllAsRead(context.Background(), request)
+	ctx, cancel := r.usersContext(req)
+	defer cancel()
+	_, err := r.usersClient.MarkAllAsRead(ctx, request)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				log.Println(resErr.Message())
-				http.Error(w, "USER_UNREGISTERED", http.StatusNotFound)
-				return
-			default:
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, currentUserErrors.translate(ctx, "MarkAllAsRead", err))
 		return
 	}
+	// Let the live notifications of the user know, in every device.
+	r.hub.Acknowledge(userId, livedata.Ack{For: livedata.TypeMarkRead, Ok: true})
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
@@ -62,23 +55,14 @@ func (r *Router) handleClearNotifs(userId string, w http.ResponseWriter,
 	request := &pbUsers.ClearNotifsRequest{
 		UserId: userId,
 	}
-	_, err := r.usersClient.ClearNotifs(context.Background(), request)
+	ctx, cancel := r.usersContext(req)
+	defer cancel()
+	_, err := r.usersClient.ClearNotifs(ctx, request)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				log.Println(resErr.Message())
-				http.Error(w, "USER_UNREGISTERED", http.StatusNotFound)
-				return
-			default:
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, currentUserErrors.translate(ctx, "ClearNotifs", err))
 		return
 	}
+	r.hub.Acknowledge(userId, livedata.Ack{For: livedata.TypeClear, Ok: true})
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
@@ -93,35 +77,32 @@ func (r *Router) handleClearNotifs(userId string, w http.ResponseWriter,
 func (r *Router) handleFollow(userId string, w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	username := vars["username"]
+	ctx, cancel := r.usersContext(req)
+	defer cancel()
+	if err := r.followUser(ctx, userId, username); err != nil {
+		replyError(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// followUser updates the given user to follow the user with the given username.
+// It returns an error in case of the following:
+// - username not found ----> 404 NOT_FOUND
+// - user following itself -> SELF_FOLLOW
+// - user is unregistered --> USER_UNREGISTERED
+// - network failures ------> INTERNAL_FAILURE
+func (r *Router) followUser(ctx context.Context, userId, username string) error {
 	request := &pbUsers.FollowUserRequest{
 		UserId:       userId,
 		UserToFollow: username,
 	}
-	_, err := r.usersClient.FollowUser(context.Background(), request)
+	_, err := r.usersClient.FollowUser(ctx, request)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				http.NotFound(w, req)
-				return
-			case codes.InvalidArgument:
-				http.Error(w, "SELF_FOLLOW", http.StatusBadRequest)
-				return
-			case codes.Unauthenticated:
-				http.Error(w, "USER_UNREGISTERED", http.StatusUnauthorized)
-				return
-			default:
-				log.Printf("Unknown code %v: %v\n", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-		return
+		return followErrors.translate(ctx, "FollowUser", err)
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	return nil
 }
 
 // Unfollow User "/unfollow?username={username}" handler. It updates the current user
@@ -134,35 +115,32 @@ func (r *Router) handleFollow(userId string, w http.ResponseWriter, req *http.Re
 func (r *Router) handleUnfollow(userId string, w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	username := vars["username"]
+	ctx, cancel := r.usersContext(req)
+	defer cancel()
+	if err := r.unfollowUser(ctx, userId, username); err != nil {
+		replyError(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// unfollowUser updates the given user to unfollow the user with the given
+// username. It returns an error in case of the following:
+// - username not found ------> 404 NOT_FOUND
+// - user unfollowing itself -> SELF_UNFOLLOW
+// - user is unregistered ----> USER_UNREGISTERED
+// - network failures --------> INTERNAL_FAILURE
+func (r *Router) unfollowUser(ctx context.Context, userId, username string) error {
 	request := &pbUsers.UnfollowUserRequest{
 		UserId:         userId,
 		UserToUnfollow: username,
 	}
-	_, err := r.usersClient.UnfollowUser(context.Background(), request)
+	_, err := r.usersClient.UnfollowUser(ctx, request)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				http.NotFound(w, req)
-				return
-			case codes.InvalidArgument:
-				http.Error(w, "SELF_UNFOLLOW", http.StatusBadRequest)
-				return
-			case codes.Unauthenticated:
-				http.Error(w, "USER_UNREGISTERED", http.StatusUnauthorized)
-				return
-			default:
-				log.Printf("Unknown code %v: %v\n", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-		return
+		return unfollowErrors.translate(ctx, "UnfollowUser", err)
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	return nil
 }
 
 // View Users "/viewusers" handler. It returns a list of user data containing basic
@@ -178,8 +156,8 @@ func (r *Router) handleViewUsers(w http.ResponseWriter, req *http.Request) {
 
 	offset, err := strconv.Atoi(vars["offset"])
 	if err != nil || offset < 0 {
-		log.Printf("offset (%v) is not valid\n", offset)
-		http.Error(w, "INVALID_OFFSET", http.StatusBadRequest)
+		logFor(req).Debug("Invalid offset", "offset", vars["offset"])
+		replyError(w, req, errInvalidOffset)
 		return
 	}
 	// ctx should be either "following" or "followers"
@@ -187,7 +165,7 @@ func (r *Router) handleViewUsers(w http.ResponseWriter, req *http.Request) {
 	case "followers":
 	case "following":
 	default:
-		http.Error(w, "INVALID_CONTEXT", http.StatusBadRequest)
+		replyError(w, req, errInvalidContext)
 		return
 	}
 	request := &pbUsers.ViewUsersRequest{
@@ -195,30 +173,16 @@ func (r *Router) handleViewUsers(w http.ResponseWriter, req *http.Request) {
 		Context: ctx,
 		Offset:  uint32(offset),
 	}
-	users, err := r.usersClient.ViewUsers(context.Background(), request)
+	rpcCtx, cancel := r.usersContext(req)
+	defer cancel()
+	users, err := r.usersClient.ViewUsers(rpcCtx, request)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.OutOfRange:
-				http.Error(w, "OFFSET_OOR", http.StatusBadRequest)
-				return
-			case codes.NotFound:
-				// user not found
-				http.NotFound(w, req)
-				return
-			default:
-				log.Printf("Unknown code %v: %v", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, viewUsersErrors.translate(rpcCtx, "ViewUsers", err))
 		return
 	}
 	if err := json.NewEncoder(w).Encode(users); err != nil {
-		log.Printf("Could not encode users: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		logFor(req).Error("Could not encode users", "err", err)
+		replyError(w, req, errInternalFailure)
 	}
 }
 
@@ -229,18 +193,21 @@ func (r *Router) handleViewUsers(w http.ResponseWriter, req *http.Request) {
 // - template rendering ---> TEMPLATE_ERROR
 func (r *Router) handleMyProfile(userId string, w http.ResponseWriter,
 	req *http.Request) {
-	userData, s, err := r.getBasicUserData(userId)
+	userData, err := r.getBasicUserData(req, userId)
 	if err != nil {
-		http.Error(w, err.Error(), s)
+		replyError(w, req, err)
 		return
 	}
-	userHeader := r.getUserHeaderData(w, userId)
+	code := http.StatusOK
+	userHeader := r.getUserHeaderData(req, userId, &code)
 
 	profileView := templates.DataToMyProfileView(userData, userHeader)
+	profileView.CSRFToken = r.csrfToken(req)
 
+	w.WriteHeader(code)
 	if err := r.templates.ExecuteTemplate(w, "myprofile.html", profileView); err != nil {
-		log.Printf("Could not execute template myprofile.html: %v", err)
-		http.Error(w, "TEMPLATE_ERROR", http.StatusInternalServerError)
+		logFor(req).Error("Could not execute template", "template", "myprofile.html", "err", err)
+		replyError(w, req, errTemplate)
 	}
 }
 
@@ -255,12 +222,12 @@ func (r *Router) handleUpdateMyProfile(userId string, w http.ResponseWriter,
 	alias := req.FormValue("alias")
 	username := req.FormValue("username")
 	description := req.FormValue("description")
-	newPicUrl, err, s := getAndSaveFile(req, "pic_url")
+	newPicUrl, err := getAndSaveFile(req, "pic_url")
 	if err != nil {
 		// It's ok to get an errMissingFile, but if it's not such an error, it is
 		// an internal failure.
 		if !errors.Is(err, errMissingFile) {
-			http.Error(w, err.Error(), s)
+			replyError(w, req, err)
 			return
 		}
 	}
@@ -271,24 +238,11 @@ func (r *Router) handleUpdateMyProfile(userId string, w http.ResponseWriter,
 		Description: description,
 		PicUrl:      newPicUrl,
 	}
-	_, err = r.usersClient.UpdateBasicUserData(context.Background(), request)
+	ctx, cancel := r.usersContext(req)
+	defer cancel()
+	_, err = r.usersClient.UpdateBasicUserData(ctx, request)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.AlreadyExists:
-				http.Error(w, "USERNAME_UNAVAILABLE", http.StatusOK)
-				return
-			case codes.InvalidArgument:
-				http.Error(w, "INVALID_USERNAME", http.StatusBadRequest)
-				return
-			default:
-				log.Printf("Unknown code %v: %v\n", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, updateUserErrors.translate(ctx, "UpdateBasicUserData", err))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -307,21 +261,11 @@ func (r *Router) handleViewUserProfile(w http.ResponseWriter, req *http.Request)
 	request := &pbUsers.ViewUserByUsernameRequest{
 		Username: username,
 	}
-	userData, err := r.usersClient.ViewUserByUsername(context.Background(), request)
+	ctx, cancel := r.usersContext(req)
+	defer cancel()
+	userData, err := r.usersClient.ViewUserByUsername(ctx, request)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				http.NotFound(w, req)
-				return
-			default:
-				log.Printf("Unknown code %v: %v\n", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, userErrors.translate(ctx, "ViewUserByUsername", err))
 		return
 	}
 
@@ -332,16 +276,19 @@ func (r *Router) handleViewUserProfile(w http.ResponseWriter, req *http.Request)
 		// ignore DiscardIds; do not discard any activity
 	}
 	var feed templates.ContentsFeed
+	code := http.StatusOK
 
-	stream, err := r.generalClient.RecycleActivity(context.Background(), activityPattern)
+	ctx, cancel = r.generalContext(req)
+	defer cancel()
+	stream, err := r.generalClient.RecycleActivity(ctx, activityPattern)
 	if err != nil {
-		log.Printf("Could not send request: %v\n", err)
-		w.WriteHeader(http.StatusPartialContent)
+		logFor(req).Warn("Could not send request", "err", err)
+		code = http.StatusPartialContent
 	} else {
-		feed, err = getFeed(stream)
+		feed, err = getFeed(stream, feedUserActivity)
 		if err != nil {
-			log.Printf("An error occurred while getting feed: %v\n", err)
-			w.WriteHeader(http.StatusPartialContent)
+			logFor(req).Warn("An error occurred while getting feed", "err", err)
+			code = http.StatusPartialContent
 		}
 	}
 
@@ -350,13 +297,14 @@ func (r *Router) handleViewUserProfile(w http.ResponseWriter, req *http.Request)
 	var userHeader *pbUsers.UserHeaderData
 	if userId != "" {
 		// A user is logged in. Get its data.
-		userHeader = r.getUserHeaderData(w, userId)
+		userHeader = r.getUserHeaderData(req, userId, &code)
 	}
 	// update session only if there is content.
 	if len(feed.Contents) > 0 {
 		r.updateDiscardIdsSession(req, w, func(d *pagination.DiscardIds) {
 			pActivity := feed.GetUserPaginationActivity()
 			id := userData.UserId
+			d.Reset(pagination.KindUserActivity, id)
 			a := d.UserActivity[id]
 			a.ThreadsCreated = pActivity.ThreadsCreated
 			a.Comments = pActivity.Comments
@@ -365,25 +313,29 @@ func (r *Router) handleViewUserProfile(w http.ResponseWriter, req *http.Request)
 		})
 	}
 	profileView := templates.DataToProfileView(userData, userHeader, feed.Contents, userId)
+	profileView.CSRFToken = r.csrfToken(req)
 
+	w.WriteHeader(code)
 	err = r.templates.ExecuteTemplate(w, "viewuserprofile.html", profileView)
 	if err != nil {
-		log.Printf("Could not execute template viewuserprofile.html: %v", err)
-		http.Error(w, "TEMPLATE_ERROR", http.StatusInternalServerError)
+		logFor(req).Error("Could not execute template", "template", "viewuserprofile.html", "err", err)
+		replyError(w, req, errTemplate)
 	}
 }
 
 // Recycle user activity "/profile/recycle?userid={userid}" handler. It returns a
-// new feed of recent activity for the user in HTML format. It may return an error
-// in case of the following:
-// - user not found ---------------> 404 NOT_FOUND
-// - network or encoding failures -> INTERNAL_FAILURE
+// new feed of recent activity for the user in HTML format, or in JSON format if
+// the client accepts application/json. It may return an error in case of the
+// following:
+// - user not found -----------------> 404 NOT_FOUND
+// - no more contents are available -> EXHAUSTED
+// - network or encoding failures ---> INTERNAL_FAILURE
+// Note: EXHAUSTED is returned along with a 200 status code; see writeExhausted.
 func (r *Router) handleRecycleUserActivity(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	userId := vars["userid"]
 
-	session, _ := r.store.Get(req, "session")
-	discardIds := getDiscardIds(session)
+	discardIds := r.getDiscardIds(req)
 
 	activityPattern := &pbApi.ActivityPattern{
 		DiscardIds: discardIds.FormatUserActivity(userId),
@@ -392,34 +344,30 @@ func (r *Router) handleRecycleUserActivity(w http.ResponseWriter, req *http.Requ
 	}
 	var feed templates.ContentsFeed
 
+	code := http.StatusOK
 	// get user activity
-	stream, err := r.generalClient.RecycleActivity(context.Background(), activityPattern)
+	ctx, cancel := r.generalContext(req)
+	defer cancel()
+	stream, err := r.generalClient.RecycleActivity(ctx, activityPattern)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				http.NotFound(w, req)
-				return
-			default:
-				log.Printf("Unknown code %v: %v\n", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, userErrors.translate(ctx, "RecycleActivity", err))
 		return
 	} else {
-		feed, err = getFeed(stream)
+		feed, err = getFeed(stream, feedUserActivity)
+		if exhausted(feed, err) {
+			writeExhausted(w, req, "/profile/recycle/reset?userid="+userId)
+			return
+		}
 		if err != nil {
-			log.Printf("An error occurred while getting feed: %v\n", err)
-			w.WriteHeader(http.StatusPartialContent)
+			logFor(req).Warn("An error occurred while getting feed", "err", err)
+			code = http.StatusPartialContent
 		}
 	}
 	// update session only if there is content.
 	if len(feed.Contents) > 0 {
 		r.updateDiscardIdsSession(req, w, func(d *pagination.DiscardIds) {
 			pActivity := feed.GetUserPaginationActivity()
+			d.Touch(pagination.KindUserActivity, userId)
 			a := d.UserActivity[userId]
 			a.ThreadsCreated = append(a.ThreadsCreated, pActivity.ThreadsCreated...)
 			a.Comments = append(a.Comments, pActivity.Comments...)
@@ -430,56 +378,79 @@ func (r *Router) handleRecycleUserActivity(w http.ResponseWriter, req *http.Requ
 	// Get current user id.
 	userId = r.currentUser(req)
 
-	res := templates.FeedToBytes(feed.Contents, userId, true)
-
-	contentLength := strconv.Itoa(len(res))
-	w.Header().Set("Content-Length", contentLength)
-	w.Header().Set("Content-Type", "text/html")
-	if _, err = w.Write(res); err != nil {
-		log.Println("Recycle activity: could not send response:", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+	err = writeFeed(w, req, code, feed, userId, true, templates.FeedToBytes)
+	if err != nil {
+		logFor(req).Error("Recycle activity: could not send response", "err", err)
+		replyError(w, req, errInternalFailure)
 	}
 }
 
+// Reset user activity "/profile/recycle/reset?userid={userid}" handler. It
+// forgets the activity of the user already seen in its profile, so that the
+// next recycle starts over. It returns OK on success or an error in case of the
+// following:
+// - storage failure -> INTERNAL_FAILURE
+func (r *Router) handleResetUserActivity(w http.ResponseWriter, req *http.Request) {
+	r.resetPagination(w, req, pagination.KindUserActivity, mux.Vars(req)["userid"])
+}
+
 // Login "/login" handler. It returns OK on successful login or an error in case of the
 // following:
 // - invalid username or password -> 401 UNAUTHORIZED
+// - too many failed logins -------> LOGIN_LOCKED
 // - network failure --------------> INTERNAL_FAILURE
 // - unable to set cookie ---------> COOKIE_ERROR
 func (r *Router) handleLogin(w http.ResponseWriter, req *http.Request) {
 	username := req.FormValue("username")
 	password := req.FormValue("password")
+	ctx, cancel := r.usersContext(req)
+	defer cancel()
+	userId, err := r.login(ctx, username, password)
+	if err != nil {
+		replyError(w, req, err)
+		return
+	}
+	// Log the user in a new session, so that the session id used before the
+	// login can not be used to impersonate the user.
+	if err := r.startSession(req, w, userId); err != nil {
+		logFor(req).Error("Could not save session", "err", err)
+		replyError(w, req, errCookie)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// login checks the given credentials. It returns the id of the user or an error
+// in case of the following:
+// - invalid username or password -> INVALID_CREDENTIALS
+// - too many failed logins -------> LOGIN_LOCKED
+// - network failure --------------> INTERNAL_FAILURE
+// The logins of a username are locked out after repeated INVALID_CREDENTIALS
+// failures, according to the login lockout policy of the router.
+func (r *Router) login(ctx context.Context, username, password string) (string, error) {
+	key := strings.ToLower(username)
+	if wait := r.loginLockout.Locked(key); wait > 0 {
+		return "", &retryError{errLoginLocked, wait}
+	}
 	request := &pbUsers.LoginRequest{
 		Username: username,
 		Password: password,
 	}
-	res, err := r.usersClient.Login(context.Background(), request)
+	res, err := r.usersClient.Login(ctx, request)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.PermissionDenied:
-				http.Error(w, "INVALID_CREDENTIALS", http.StatusUnauthorized)
-				return
-			default:
-				log.Printf("Unknown code %v: %v\n", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
+		e := loginErrors.translate(ctx, "Login", err)
+		if e == errInvalidCredentials {
+			if wait := r.loginLockout.Fail(key); wait > 0 {
+				metrics.LoginLockouts.Inc()
+				logging.FromContext(ctx).Warn("Locked out logins after repeated failures",
+					"username", username, "duration", wait)
 			}
 		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-		return
-	}
-	// Set session cookie
-	session, _ := r.store.Get(req, "session")
-	session.Values["user_id"] = res.UserId
-	if err := session.Save(req, w); err != nil {
-		log.Printf("Could not save session because... %v\n", err)
-		http.Error(w, "COOKIE_ERROR", http.StatusServiceUnavailable)
-		return
+		return "", e
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	r.loginLockout.Reset(key)
+	return res.UserId, nil
 }
 
 // Sign in "/signin" handler. It returns OK on successful sign in or an error in case
@@ -496,12 +467,12 @@ func (r *Router) handleSignin(w http.ResponseWriter, req *http.Request) {
 	about := req.FormValue("about")
 	username := req.FormValue("username")
 	password := req.FormValue("password")
-	picUrl, err, s := getAndSaveFile(req, "pic_url")
+	picUrl, err := getAndSaveFile(req, "pic_url")
 	if err != nil {
 		// It's ok to get an errMissingFile, but if it's not such an error,
 		// it is an internal failure.
 		if !errors.Is(err, errMissingFile) {
-			http.Error(w, err.Error(), s)
+			replyError(w, req, err)
 			return
 		}
 		idx := rand.Intn(len(defaultPics))
@@ -520,32 +491,28 @@ func (r *Router) handleSignin(w http.ResponseWriter, req *http.Request) {
 		About:    about,
 		Password: password,
 	}
-	res, err := r.usersClient.RegisterUser(context.Background(), request)
+	ctx, cancel := r.usersContext(req)
+	defer cancel()
+	res, err := r.usersClient.RegisterUser(ctx, request)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.AlreadyExists:
-				// could be email or username already in use
-				http.Error(w, resErr.Message(), http.StatusConflict)
-				return
-			case codes.InvalidArgument:
-				http.Error(w, "INVALID_USERNAME", http.StatusBadRequest)
-				return
-			default:
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
+		// The message of AlreadyExists errors tells whether the email or the
+		// username is already in use.
+		if resErr, ok := status.FromError(err); ok && resErr.Code() == codes.AlreadyExists {
+			if resErr.Message() == errEmailExists.Code {
+				replyError(w, req, errEmailExists)
+			} else {
+				replyError(w, req, errUsernameExists)
 			}
+			return
 		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+		replyError(w, req, registerErrors.translate(ctx, "RegisterUser", err))
 		return
 	}
-	// Set session cookie
-	session, _ := r.store.Get(req, "session")
-	session.Values["user_id"] = res.UserId
-	if err = session.Save(req, w); err != nil {
-		log.Printf("Could not save session because... %v\n", err)
-		http.Error(w, "COOKIE_ERROR", http.StatusServiceUnavailable)
+	// Log the user in a new session, so that the session id used before the
+	// login can not be used to impersonate the user.
+	if err := r.startSession(req, w, res.UserId); err != nil {
+		logFor(req).Error("Could not save session", "err", err)
+		replyError(w, req, errCookie)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -558,20 +525,53 @@ func (r *Router) handleSignin(w http.ResponseWriter, req *http.Request) {
 // - unable to set cookie -> COOKIE_ERROR
 func (r *Router) handleLogout(_ string, w http.ResponseWriter, req *http.Request) {
 	if err := r.deleteSession(req, w); err != nil {
-		log.Printf("Could not save session because... %v\n", err)
-		http.Error(w, "COOKIE_ERROR", http.StatusServiceUnavailable)
+		logFor(req).Error("Could not save session", "err", err)
+		replyError(w, req, errCookie)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
 
-// Delete cookie and update session.
+// Logout all "/logout/all" handler. It revokes every session and API token of
+// the user, including the sessions in other browsers and devices, and removes
+// the current one. It returns OK on success or an error in case of the following:
+// - storage failure ------> INTERNAL_FAILURE
+// - unable to set cookie -> COOKIE_ERROR
+func (r *Router) handleLogoutAll(userId string, w http.ResponseWriter, req *http.Request) {
+	if err := r.revokeTokens(userId); err != nil {
+		logFor(req).Error("Could not revoke sessions", "err", err)
+		replyError(w, req, errInternalFailure)
+		return
+	}
+	if err := r.deleteSession(req, w); err != nil {
+		logFor(req).Error("Could not save session", "err", err)
+		replyError(w, req, errCookie)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// Delete cookie, unregister the session and forget the contents seen in the
+// session.
 func (r *Router) deleteSession(req *http.Request, w http.ResponseWriter) error {
 	session, _ := r.store.Get(req, "session")
-	session.Options = &sessions.Options{
-		// MaxAge < 0 means delete cookie immediately
-		MaxAge: -1,
+	if key, ok := session.Values["seen_key"].(string); ok {
+		if err := r.seen.Delete(key); err != nil {
+			logFor(req).Error("Could not delete seen contents", "err", err)
+		}
+	}
+	userId, _ := session.Values["user_id"].(string)
+	if sid, ok := session.Values["sid"].(string); ok && userId != "" {
+		if err := r.registry.Remove(userId, sid); err != nil {
+			logFor(req).Error("Could not unregister session", "err", err)
+		}
+		r.hub.Kick(userId, sid, kickLoggedOut)
 	}
+	opts := *session.Options
+	// MaxAge < 0 means delete cookie immediately
+	opts.MaxAge = -1
+	session.Options = &opts
 	return session.Save(req, w)
 }
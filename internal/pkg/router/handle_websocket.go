@@ -1,39 +1,121 @@
 package router
 
 import (
-	"log"
 	"net/http"
-
-	pbDataFormat "github.com/luisguve/cheroproto-go/dataformat"
-	"github.com/luisguve/cherosite/internal/pkg/livedata"
+	"time"
 )
 
 // Register new clients into the hub.
-// Send notifications to registered and logged in users and receive signal
-// to mark all notifications as read via websocket.
+// Send notifications to registered and logged in users and receive their
+// requests via websocket; see livedata.TypeNotif for the protocol. If the query
+// parameter "since" is set to an RFC 3339 time, e.g. the time of the last
+// notification received before reconnecting, the notifications after it are
+// replayed right away, as a resume_since message would.
+// Connections are only accepted from the pages of the allowed origins, up to
+// the limit of connections per user. The session is checked periodically while
+// the connection is open, and the connection is closed once the session ends.
 func (r *Router) handleLiveNotifs(w http.ResponseWriter, req *http.Request) {
-	userId := r.currentUser(req)
+	if !r.checkOrigin(req) {
+		rejectLiveConn(w, req, "origin", "origin not allowed", http.StatusForbidden)
+		return
+	}
+	userId, sid := r.currentSession(req)
 	if userId == "" {
 		// user has not logged in.
 		http.Error(w, "not logged in", http.StatusForbidden)
 		return
 	}
+	var since time.Time
+	if s := req.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	if !r.acquireLiveConn(userId) {
+		rejectLiveConn(w, req, "limit", "too many connections", http.StatusTooManyRequests)
+		return
+	}
 	conn, err := r.upgrader.Upgrade(w, req, nil)
 	if err != nil {
-		log.Printf("Could not upgrade connection: %v\n", err)
-		http.Error(w, "an error occurred", http.StatusInternalServerError)
+		// The upgrader already replied with an error.
+		logFor(req).Error("Could not upgrade connection", "err", err)
+		r.releaseLiveConn(userId)
 		return
 	}
-	client := &livedata.Client{
-		Hub:  r.hub,
-		Conn: conn,
-		User: &livedata.User{
-			Id:        userId,
-			SendNotif: make(chan *pbDataFormat.Notif, 256),
-			SendOk:    make(chan bool),
-		},
-	}
+	client := r.hub.NewClient(conn, userId)
+	client.User.Session = sid
 	client.Hub.Register <- client.User
+	if !since.IsZero() {
+		client.Resume(since)
+	}
 	go client.WritePump()
 	go client.ReadPump()
+	go r.watchSession(client.User)
+}
+
+// DefaultStreamDuration is the time a stream of live notifications is served for
+// by a Router that sets none. It is shorter than the write timeout of the
+// server, 15 seconds, which would otherwise cut the stream.
+const DefaultStreamDuration = 10 * time.Second
+
+// Register new streams into the hub.
+// Send notifications to registered and logged in users as Server-Sent Events,
+// for the clients whose websockets are blocked; see livedata.Stream. Clients
+// reconnect once the stream ends, and get the notifications since the header
+// Last-Event-ID, or since the query parameter "since" as in handleLiveNotifs,
+// replayed. They mark their notifications as read through "/readnotifs". Every
+// query parameter "topic" subscribes the stream to the events of the topic, e.g.
+// those of the thread being viewed; see livedata.ThreadTopic. Anonymous users
+// may open streams of topics only. Streams are limited as the websockets of
+// handleLiveNotifs, those of anonymous users by address; their session is
+// checked on every reconnection.
+func (r *Router) handleLiveNotifsStream(w http.ResponseWriter, req *http.Request) {
+	if !r.checkOrigin(req) {
+		rejectLiveConn(w, req, "origin", "origin not allowed", http.StatusForbidden)
+		return
+	}
+	topics := req.URL.Query()["topic"]
+	userId, sid := r.currentSession(req)
+	if userId == "" && len(topics) == 0 {
+		// user has not logged in, and there is nothing else to stream.
+		http.Error(w, "not logged in", http.StatusForbidden)
+		return
+	}
+	var since time.Time
+	s := req.Header.Get("Last-Event-ID")
+	if s == "" {
+		s = req.URL.Query().Get("since")
+	}
+	if s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	limitKey := userId
+	if userId == "" {
+		limitKey = "ip:" + r.clientIP(req)
+	}
+	if !r.acquireLiveConn(limitKey) {
+		rejectLiveConn(w, req, "limit", "too many connections", http.StatusTooManyRequests)
+		return
+	}
+	defer r.releaseLiveConn(limitKey)
+	stream := r.hub.NewStream(userId)
+	stream.User.Session = sid
+	stream.Hub.Register <- stream.User
+	// The hub replays nothing without asking the users service if since is
+	// recent and no notification came afterwards, as on most reconnections.
+	if userId != "" && !since.IsZero() {
+		stream.Resume(since)
+	}
+	for _, topic := range topics {
+		stream.Subscribe(topic)
+	}
+	if err := stream.Serve(req.Context(), w, r.streamDur); err != nil {
+		logFor(req).Error("Could not stream live notifications", "err", err)
+	}
 }
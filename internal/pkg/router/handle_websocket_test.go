@@ -0,0 +1,63 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luisguve/cherosite/internal/pkg/livedata"
+	"github.com/luisguve/cherosite/internal/pkg/sessionstore"
+)
+
+func TestAnonymousStream(t *testing.T) {
+	backend := sessionstore.NewMemoryBackend()
+	r := &Router{
+		store:        sessionstore.New(backend, []byte("0123456789abcdef0123456789abcdef")),
+		registry:     sessionstore.NewRegistry(backend),
+		sessLifetime: time.Hour,
+		hub:          livedata.NewHub(nil, time.Second, nil, livedata.Options{}),
+		streamDur:    50 * time.Millisecond,
+		maxLiveConns: 1,
+		liveConns:    make(map[string]int),
+	}
+	go r.hub.Run()
+	defer r.hub.Shutdown(context.Background())
+
+	stream := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/livenotifs/stream"+query, nil)
+		req.Header.Set("Last-Event-ID", time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+		w := httptest.NewRecorder()
+		r.handleLiveNotifsStream(w, req)
+		return w
+	}
+
+	// There are no notifications for anonymous users.
+	if w := stream(""); w.Code != http.StatusForbidden {
+		t.Errorf("stream without topics: status = %d, want 403", w.Code)
+	}
+
+	// A stream of topics is served, with no replay of notifications, which
+	// would ask the users service.
+	topic := livedata.ThreadTopic("s", "t")
+	w := stream("?topic=" + topic)
+	if w.Code != http.StatusOK {
+		t.Fatalf("stream of topics: status = %d, want 200", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `"for":"subscribe","ok":true`) {
+		t.Errorf("subscription not acked: %q", body)
+	}
+	if strings.Contains(body, "resume_since") {
+		t.Errorf("notifications replayed to an anonymous user: %q", body)
+	}
+	// The connection of the address was released.
+	if len(r.liveConns) != 0 {
+		t.Errorf("live connections = %v, want none", r.liveConns)
+	}
+}
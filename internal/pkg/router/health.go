@@ -0,0 +1,126 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Status of the site and of every backend in the readiness report.
+const (
+	statusReady       = "ready"
+	statusDegraded    = "degraded"
+	statusUnavailable = "unavailable"
+	statusUp          = "up"
+	statusDown        = "down"
+	statusUnknown     = "unknown"
+)
+
+// backendStatus is the status of the connection to a gRPC service.
+type backendStatus struct {
+	// State is the connectivity state of the connection, e.g. "READY".
+	State  string `json:"state"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// readinessReport is the body of the response of "/readyz".
+type readinessReport struct {
+	Status   string                   `json:"status"`
+	Users    backendStatus            `json:"users"`
+	General  backendStatus            `json:"general"`
+	Sections map[string]backendStatus `json:"sections"`
+}
+
+// Healthz "/healthz" handler. It replies OK as long as the process is able to
+// serve requests.
+func (r *Router) handleHealthz(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("OK"))
+}
+
+// Readyz "/readyz" handler. It checks the connections to the users, general and
+// section services and replies with a readinessReport in JSON format. The status
+// code is 503 if either the users or the general service is down; sections that
+// are down only turn the status of the report to "degraded".
+func (r *Router) handleReadyz(w http.ResponseWriter, req *http.Request) {
+	var (
+		report = readinessReport{Sections: make(map[string]backendStatus)}
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+	)
+	wg.Add(2 + len(r.sections))
+	go func() {
+		defer wg.Done()
+		ctx, cancel := r.usersContext(req)
+		defer cancel()
+		report.Users = r.checkBackend(ctx, r.usersConn)
+	}()
+	go func() {
+		defer wg.Done()
+		ctx, cancel := r.generalContext(req)
+		defer cancel()
+		report.General = r.checkBackend(ctx, r.generalConn)
+	}()
+	for id, section := range r.sections {
+		go func(id string, section Section) {
+			defer wg.Done()
+			ctx, cancel := sectionContext(req, section)
+			defer cancel()
+			st := r.checkBackend(ctx, section.Conn)
+			mu.Lock()
+			report.Sections[id] = st
+			mu.Unlock()
+		}(id, section)
+	}
+	wg.Wait()
+
+	report.Status = statusReady
+	for _, st := range report.Sections {
+		if st.Status == statusDown {
+			report.Status = statusDegraded
+		}
+	}
+	status := http.StatusOK
+	if report.Users.Status == statusDown || report.General.Status == statusDown {
+		report.Status = statusUnavailable
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// checkBackend returns the status of the given connection. If health checks are
+// enabled, the service is asked for its status through the gRPC health checking
+// protocol; otherwise, only the connectivity state is taken into account. A nil
+// connection is reported as unknown.
+func (r *Router) checkBackend(ctx context.Context, conn *grpc.ClientConn) backendStatus {
+	if conn == nil {
+		return backendStatus{State: statusUnknown, Status: statusUnknown}
+	}
+	state := conn.GetState()
+	st := backendStatus{State: state.String(), Status: statusUp}
+	switch state {
+	case connectivity.Connecting, connectivity.TransientFailure, connectivity.Shutdown:
+		st.Status = statusDown
+	}
+	if !r.healthCheck || state == connectivity.Shutdown {
+		return st
+	}
+	res, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		st.Status = statusDown
+		st.Error = err.Error()
+		return st
+	}
+	st.State = conn.GetState().String()
+	if res.Status == healthpb.HealthCheckResponse_SERVING {
+		st.Status = statusUp
+	} else {
+		st.Status = statusDown
+		st.Error = res.Status.String()
+	}
+	return st
+}
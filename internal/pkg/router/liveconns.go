@@ -0,0 +1,133 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	pbUsers "github.com/luisguve/cheroproto-go/userapi"
+	"github.com/luisguve/cherosite/internal/pkg/livedata"
+	"github.com/luisguve/cherosite/internal/pkg/metrics"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultMaxLiveConns is the number of live connections a user may open at once
+// on an instance of a Router that sets none.
+const DefaultMaxLiveConns = 10
+
+// DefaultSessionCheckInterval is the time between the checks of the session of
+// every websocket of a Router that sets none.
+const DefaultSessionCheckInterval = time.Minute
+
+// Reasons the live connections of a user are closed with.
+const (
+	kickLoggedOut    = "logged out"
+	kickSessionEnded = "session ended"
+	kickUserDeleted  = "user deleted"
+)
+
+// checkOrigin reports whether the live connections may be opened from the page
+// of the header Origin of the request: either a page of the site itself or of
+// one of the allowed origins. Requests without the header do not come from a
+// browser, so they are allowed.
+func (r *Router) checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if r.allowedOrigins[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Host)
+}
+
+// currentSession returns the id of the user logged in the session of the
+// request and the id of the session, or empty strings if no user is logged in.
+func (r *Router) currentSession(req *http.Request) (userId, sid string) {
+	userId = r.currentUser(req)
+	if userId == "" {
+		return "", ""
+	}
+	// Get always returns a session, even if empty
+	session, _ := r.store.Get(req, "session")
+	sid, _ = session.Values["sid"].(string)
+	return userId, sid
+}
+
+// acquireLiveConn counts a new live connection of the user. It returns false if
+// the user already has as many connections as allowed.
+func (r *Router) acquireLiveConn(userId string) bool {
+	r.liveConnsMu.Lock()
+	defer r.liveConnsMu.Unlock()
+	if r.maxLiveConns > 0 && r.liveConns[userId] >= r.maxLiveConns {
+		return false
+	}
+	r.liveConns[userId]++
+	return true
+}
+
+// releaseLiveConn discounts a live connection of the user once it is closed.
+func (r *Router) releaseLiveConn(userId string) {
+	r.liveConnsMu.Lock()
+	defer r.liveConnsMu.Unlock()
+	r.liveConns[userId]--
+	if r.liveConns[userId] <= 0 {
+		delete(r.liveConns, userId)
+	}
+}
+
+// watchSession checks the session of the given connection periodically until
+// the connection is unregistered, kicking it if the session is no longer valid
+// or the user was deleted, and then releases the connection.
+func (r *Router) watchSession(user *livedata.User) {
+	defer r.releaseLiveConn(user.Id)
+	ticker := time.NewTicker(r.sessCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-user.Done():
+			return
+		case <-ticker.C:
+			if reason := r.checkLiveSession(user.Id, user.Session); reason != "" {
+				r.hub.Kick(user.Id, user.Session, reason)
+			}
+		}
+	}
+}
+
+// checkLiveSession returns the reason to close the connections of the given
+// session of the user, or an empty string if it is still valid. Connections are
+// not closed because of failures of the registry or the users service.
+func (r *Router) checkLiveSession(userId, sid string) string {
+	ok, err := r.registry.Contains(userId, sid)
+	if err != nil {
+		r.log.Error("Could not check session of live connection", "user", userId, "err", err)
+		return ""
+	}
+	if !ok {
+		return kickSessionEnded
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.usersTimeout)
+	defer cancel()
+	request := &pbUsers.GetBasicUserDataRequest{UserId: userId}
+	if _, err = r.usersClient.GetBasicUserData(ctx, request); status.Code(err) == codes.NotFound {
+		return kickUserDeleted
+	}
+	return ""
+}
+
+// rejectLiveConn replies with the given status and message to a request for a
+// live connection that is refused for the given reason.
+func rejectLiveConn(w http.ResponseWriter, req *http.Request, reason, msg string, code int) {
+	metrics.RejectedConns.WithLabelValues(reason).Inc()
+	logFor(req).Warn("Live connection refused", "reason", reason,
+		"origin", req.Header.Get("Origin"))
+	http.Error(w, msg, code)
+}
@@ -0,0 +1,64 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/luisguve/cherosite/internal/pkg/logging"
+	"google.golang.org/grpc/metadata"
+)
+
+// requestIDHeader is the header carrying the id of a request, both in the
+// requests and in the responses. The id is also sent to the services in the
+// metadata of the gRPC requests under the key requestIDKey.
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "x-request-id"
+	// maxRequestIDLength is the maximum length of the ids set by clients.
+	maxRequestIDLength = 128
+)
+
+// withRequestID returns the request with a context that carries its id and a
+// logger that adds the id to every entry. The id is taken from the header
+// X-Request-ID, or generated if the header is not set or is not valid. It is set
+// in the header X-Request-ID of the response.
+func (r *Router) withRequestID(w http.ResponseWriter, req *http.Request) *http.Request {
+	id := req.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, id)
+	ctx := logging.NewContext(req.Context(), r.log.With("request_id", id))
+	ctx = metadata.AppendToOutgoingContext(ctx, requestIDKey, id)
+	return req.WithContext(ctx)
+}
+
+// validRequestID reports whether id is not empty, is not too long and is made
+// only of printable ASCII characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request id.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// logFor returns the logger of the given request, which adds the request id to
+// every entry.
+func logFor(req *http.Request) *logging.Logger {
+	return logging.FromContext(req.Context())
+}
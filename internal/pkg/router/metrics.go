@@ -0,0 +1,69 @@
+package router
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/luisguve/cherosite/internal/pkg/metrics"
+)
+
+// MetricsAccess holds the clients that may get the metrics at "/metrics".
+type MetricsAccess struct {
+	// Nets are the networks of the clients allowed. Only the clients on the
+	// loopback interface are allowed if it is empty. A proxy on the same host
+	// would make every client look like one of them, so in that case the
+	// requests forwarded by a proxy that is not trusted, i.e. with the header
+	// X-Forwarded-For or Forwarded, are refused unless Username is set.
+	Nets []*net.IPNet
+	// Username and Password are required with basic authentication if
+	// Username is set.
+	Username string
+	Password string
+}
+
+// allows reports whether the client with the given IP address may get the
+// metrics.
+func (m *MetricsAccess) allows(ip net.IP) bool {
+	if len(m.Nets) == 0 {
+		return ip.IsLoopback()
+	}
+	for _, n := range m.Nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedByProxy reports whether the request was forwarded by a proxy whose
+// header X-Forwarded-For the router does not trust.
+func (r *Router) forwardedByProxy(req *http.Request) bool {
+	if r.trustProxy {
+		return false
+	}
+	return req.Header.Get("X-Forwarded-For") != "" || req.Header.Get("Forwarded") != ""
+}
+
+// metricsHandler returns the handler of "/metrics". Clients that are not
+// allowed are replied 404 NOT_FOUND, as if the route did not exist.
+func (r *Router) metricsHandler() http.Handler {
+	h := metrics.Handler()
+	if r.metricsAccess.Username != "" {
+		h = metrics.BasicAuth(h, r.metricsAccess.Username, r.metricsAccess.Password)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := r.clientIP(req)
+		if addr := net.ParseIP(ip); addr == nil || !r.metricsAccess.allows(addr) {
+			logFor(req).Warn("Metrics refused", "ip", ip)
+			replyError(w, req, errNotFound)
+			return
+		}
+		access := r.metricsAccess
+		if len(access.Nets) == 0 && access.Username == "" && r.forwardedByProxy(req) {
+			logFor(req).Warn("Metrics refused through an untrusted proxy", "ip", ip)
+			replyError(w, req, errNotFound)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
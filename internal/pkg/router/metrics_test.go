@@ -0,0 +1,77 @@
+package router
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsAccess(t *testing.T) {
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	tests := []struct {
+		name       string
+		access     MetricsAccess
+		remoteAddr string
+		user, pass string
+		want       int
+	}{
+		{"loopback by default", MetricsAccess{}, "127.0.0.1:5000", "", "", http.StatusOK},
+		{"others refused by default", MetricsAccess{}, "192.0.2.1:5000", "", "", http.StatusNotFound},
+		{"allowed network", MetricsAccess{Nets: []*net.IPNet{private}}, "10.1.2.3:5000", "", "", http.StatusOK},
+		{"loopback outside the networks", MetricsAccess{Nets: []*net.IPNet{private}}, "127.0.0.1:5000", "", "", http.StatusNotFound},
+		{"missing credentials", MetricsAccess{Username: "prom", Password: "pw"}, "127.0.0.1:5000", "", "", http.StatusUnauthorized},
+		{"wrong password", MetricsAccess{Username: "prom", Password: "pw"}, "127.0.0.1:5000", "prom", "nope", http.StatusUnauthorized},
+		{"credentials", MetricsAccess{Username: "prom", Password: "pw"}, "127.0.0.1:5000", "prom", "pw", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access := tt.access
+			r := &Router{metricsAccess: &access}
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			w := httptest.NewRecorder()
+			r.metricsHandler().ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsAccessBehindProxy(t *testing.T) {
+	tests := []struct {
+		name          string
+		access        MetricsAccess
+		trust         bool
+		header, value string
+		want          int
+	}{
+		{"forwarded by default", MetricsAccess{}, false, "X-Forwarded-For", "192.0.2.1", http.StatusNotFound},
+		{"forwarded by default, RFC 7239", MetricsAccess{}, false, "Forwarded", "for=192.0.2.1", http.StatusNotFound},
+		{"forwarded with credentials", MetricsAccess{Username: "prom", Password: "pw"}, false, "X-Forwarded-For", "192.0.2.1", http.StatusOK},
+		{"trusted proxy, remote client", MetricsAccess{}, true, "X-Forwarded-For", "192.0.2.1", http.StatusNotFound},
+		{"trusted proxy, local client", MetricsAccess{}, true, "X-Forwarded-For", "127.0.0.1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access := tt.access
+			r := &Router{metricsAccess: &access, trustProxy: tt.trust}
+			// The proxy runs on the same host as the site.
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			req.RemoteAddr = "127.0.0.1:5000"
+			req.Header.Set(tt.header, tt.value)
+			if access.Username != "" {
+				req.SetBasicAuth(access.Username, access.Password)
+			}
+			w := httptest.NewRecorder()
+			r.metricsHandler().ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package router
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/luisguve/cherosite/internal/pkg/metrics"
+	"github.com/luisguve/cherosite/internal/pkg/ratelimit"
+)
+
+// Classes of routes that share a rate limit.
+const (
+	// ClassAuth holds the routes to log in and sign in, including the request
+	// of API tokens.
+	ClassAuth = "auth"
+	// ClassRecycle holds the routes to get more contents, comments or users,
+	// and to start the pagination over.
+	ClassRecycle = "recycle"
+	// ClassVote holds the routes to upvote and undo upvotes.
+	ClassVote = "vote"
+	// ClassWrite holds the rest of the routes that change the state of the
+	// site: posting, deleting, saving, following and updating the profile.
+	ClassWrite = "write"
+)
+
+// RateLimit is the rate limit of a class of routes. The requests are limited
+// both by the IP address of the client and by the user logged in, if any.
+type RateLimit struct {
+	PerIP   ratelimit.Policy
+	PerUser ratelimit.Policy
+}
+
+// perMinute returns the policy that allows n requests per minute in bursts of
+// up to burst requests.
+func perMinute(n float64, burst int) ratelimit.Policy {
+	return ratelimit.Policy{Rate: n / 60, Burst: burst}
+}
+
+// DefaultRateLimits are the rate limits of the classes of routes of a Router
+// that sets none.
+var DefaultRateLimits = map[string]RateLimit{
+	ClassAuth:    {PerIP: perMinute(10, 10)},
+	ClassRecycle: {PerIP: perMinute(120, 30), PerUser: perMinute(60, 20)},
+	ClassVote:    {PerIP: perMinute(60, 20), PerUser: perMinute(30, 10)},
+	ClassWrite:   {PerIP: perMinute(60, 20), PerUser: perMinute(30, 10)},
+}
+
+// DefaultLoginLockout locks out the logins of a username for 15 minutes after
+// 5 failures within 15 minutes.
+var DefaultLoginLockout = ratelimit.LockoutPolicy{
+	MaxFailures: 5,
+	Window:      15 * time.Minute,
+	Duration:    15 * time.Minute,
+}
+
+// limiters are the limiters of a class of routes.
+type limiters struct {
+	ip   *ratelimit.Limiter
+	user *ratelimit.Limiter
+}
+
+// newLimiters returns the limiters of the classes of routes with the given
+// rate limits.
+func newLimiters(limits map[string]RateLimit) map[string]limiters {
+	ls := make(map[string]limiters, len(limits))
+	for class, limit := range limits {
+		ls[class] = limiters{
+			ip:   ratelimit.NewLimiter(limit.PerIP),
+			user: ratelimit.NewLimiter(limit.PerUser),
+		}
+	}
+	return ls
+}
+
+// limit middleware replies with a TOO_MANY_REQUESTS error and the header
+// Retry-After if the client exceeded the rate limit of the given class of
+// routes, either from its IP address or as the user logged in, otherwise it
+// executes the next handler.
+func (r *Router) limit(class string, next http.HandlerFunc) http.HandlerFunc {
+	l, ok := r.limiters[class]
+	if !ok || (l.ip == nil && l.user == nil) {
+		return next
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		allowed, wait := l.ip.Allow(r.clientIP(req))
+		if allowed && l.user != nil {
+			if userId := r.requestUser(req); userId != "" {
+				allowed, wait = l.user.Allow(userId)
+			}
+		}
+		if !allowed {
+			metrics.RateLimited.WithLabelValues(class).Inc()
+			logFor(req).Warn("Rate limit exceeded", "class", class, "retry_after", wait)
+			replyError(w, req, &retryError{errTooManyRequests, wait})
+			return
+		}
+		next(w, req)
+	}
+}
+
+// clientIP returns the IP address of the client of the request. It is taken
+// from the last address in the header X-Forwarded-For if the router trusts it,
+// that is, if the site is served behind a proxy that sets it.
+func (r *Router) clientIP(req *http.Request) string {
+	if r.trustProxy {
+		if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+			addrs := strings.Split(fwd, ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// requestUser returns the id of the user making the request, either with a
+// bearer token for the API or with the session for the rest of the routes, or
+// an empty string if no user is logged in.
+func (r *Router) requestUser(req *http.Request) string {
+	if strings.HasPrefix(req.URL.Path, apiPrefix+"/") {
+		// The limits only tell users apart; revoked tokens are rejected by
+		// onlyAPIUsers.
+		claims, _ := r.decodeToken(req)
+		return claims.UserId
+	}
+	return r.currentUser(req)
+}
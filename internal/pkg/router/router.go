@@ -1,23 +1,38 @@
 package router
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/gorilla/websocket"
 	pbApi "github.com/luisguve/cheroproto-go/cheroapi"
 	pbUsers "github.com/luisguve/cheroproto-go/userapi"
 	"github.com/luisguve/cherosite/internal/pkg/livedata"
+	"github.com/luisguve/cherosite/internal/pkg/logging"
+	"github.com/luisguve/cherosite/internal/pkg/metrics"
+	"github.com/luisguve/cherosite/internal/pkg/pagination"
+	"github.com/luisguve/cherosite/internal/pkg/ratelimit"
+	"github.com/luisguve/cherosite/internal/pkg/sessionstore"
+	"google.golang.org/grpc"
 )
 
 type Section struct {
 	Client pbApi.CrudCheropatillaClient
 	Id     string
 	Name   string
+	// Timeout is the deadline for the requests to the section service.
+	Timeout time.Duration
+	// Conn is the connection to the section service, whose status is reported
+	// at "/readyz". The status is unknown if it is nil.
+	Conn *grpc.ClientConn
 }
 
 func (s Section) preventDefault() error {
@@ -30,22 +45,126 @@ func (s Section) preventDefault() error {
 	if s.Id == "" {
 		return fmt.Errorf("Got an empty section id.")
 	}
+	if s.Timeout <= 0 {
+		return fmt.Errorf("Section %s timeout must be positive.", s.Id)
+	}
 	return nil
 }
 
+// Options holds the settings of a Router that are not required to serve
+// pages.
+type Options struct {
+	// TokenKey is the secret key used to sign the bearer tokens of the API.
+	TokenKey []byte
+	// TokenLifetime is the time an API token is valid for after it is issued.
+	TokenLifetime time.Duration
+	// UsersTimeout and GeneralTimeout are the deadlines for the requests to the
+	// users and general services.
+	UsersTimeout   time.Duration
+	GeneralTimeout time.Duration
+	// UsersConn and GeneralConn are the connections to the users and general
+	// services, whose status is reported at "/readyz".
+	UsersConn   *grpc.ClientConn
+	GeneralConn *grpc.ClientConn
+	// HealthCheck enables asking the services for their status through the
+	// gRPC health checking protocol at "/readyz".
+	HealthCheck bool
+	// Logger is the logger of the requests. It defaults to logging.Default().
+	Logger *logging.Logger
+	// Seen stores the ids of the contents already seen in every session. It
+	// defaults to an in-memory store of pagination.DefaultSeenCapacity sessions
+	// whose entries expire after pagination.DefaultSeenTTL.
+	Seen pagination.SeenStore
+	// DiscardLimits bounds the ids of the contents seen in every session. It
+	// defaults to pagination.DefaultLimits.
+	DiscardLimits *pagination.Limits
+	// Registry keeps the sessions of the logged in users. It defaults to a
+	// registry kept in memory.
+	Registry sessionstore.Registry
+	// SessionLifetime is the time a user stays logged in a session after the
+	// login. It defaults to DefaultSessionLifetime.
+	SessionLifetime time.Duration
+	// SessionIdleTimeout is the time a user stays logged in a session that is
+	// not used. It defaults to DefaultSessionIdleTimeout; a negative value
+	// disables it.
+	SessionIdleTimeout time.Duration
+	// RateLimits are the rate limits of every class of routes; see ClassAuth,
+	// ClassRecycle, ClassVote and ClassWrite. It defaults to DefaultRateLimits.
+	// The classes not in the map are not limited.
+	RateLimits map[string]RateLimit
+	// LoginLockout sets when the logins of a username are locked out after
+	// repeated failures. It defaults to DefaultLoginLockout; a policy with no
+	// MaxFailures disables it.
+	LoginLockout *ratelimit.LockoutPolicy
+	// TrustForwardedFor takes the IP address of the clients from the header
+	// X-Forwarded-For, which must be set if the site is served behind a proxy
+	// and must not be set otherwise, since clients could forge it.
+	TrustForwardedFor bool
+	// StreamDuration is the time a stream of live notifications at
+	// "/livenotifs/stream" is served for before the client is told to
+	// reconnect. It must be shorter than the write timeout of the server. It
+	// defaults to DefaultStreamDuration.
+	StreamDuration time.Duration
+	// AllowedOrigins are the origins, e.g. "https://example.com", of the pages
+	// other than those of the site that may open live connections. Pages of
+	// the site itself are always allowed.
+	AllowedOrigins []string
+	// MaxLiveConns is the number of live connections, either websockets or
+	// streams, a user may open at once on an instance. It defaults to
+	// DefaultMaxLiveConns; a negative value disables the limit.
+	MaxLiveConns int
+	// SessionCheckInterval is the time between the checks of the session of
+	// every websocket, which is closed once the session ends or the user is
+	// deleted. It defaults to DefaultSessionCheckInterval.
+	SessionCheckInterval time.Duration
+	// Metrics sets the clients that may get the metrics at "/metrics". The
+	// route is not served if it is nil, e.g. because the metrics are served on
+	// a separate listener.
+	Metrics *MetricsAccess
+}
+
 type Router struct {
-	handler       *mux.Router
-	upgrader      websocket.Upgrader
-	templates     *template.Template
-	store         sessions.Store
-	hub           *livedata.Hub
-	sections      map[string]Section
-	usersClient   pbUsers.CrudUsersClient
-	generalClient pbApi.CrudGeneralClient
+	handler        *mux.Router
+	log            *logging.Logger
+	apiTokens      *securecookie.SecureCookie
+	tokenLifetime  time.Duration
+	usersTimeout   time.Duration
+	generalTimeout time.Duration
+	healthCheck    bool
+	metricsAccess  *MetricsAccess
+	upgrader       websocket.Upgrader
+	templates      *template.Template
+	store          sessions.Store
+	registry       sessionstore.Registry
+	sessLifetime   time.Duration
+	sessIdle       time.Duration
+	limiters       map[string]limiters
+	loginLockout   *ratelimit.Lockout
+	trustProxy     bool
+	seen           pagination.SeenStore
+	discardLimits  pagination.Limits
+	hub            *livedata.Hub
+	streamDur      time.Duration
+	allowedOrigins map[string]bool
+	maxLiveConns   int
+	sessCheck      time.Duration
+	sections       map[string]Section
+	usersClient    pbUsers.CrudUsersClient
+	generalClient  pbApi.CrudGeneralClient
+	usersConn      *grpc.ClientConn
+	generalConn    *grpc.ClientConn
+	broadcasts     sync.WaitGroup
+	// liveConns counts the live connections of every user.
+	liveConns   map[string]int
+	liveConnsMu sync.Mutex
+	// sessionLocks serialize the updates of the sessions that must not race;
+	// see sessionLock.
+	sessionLocks [64]sync.Mutex
 }
 
 func New(t *template.Template, users pbUsers.CrudUsersClient, general pbApi.CrudGeneralClient,
-	sections []Section, s sessions.Store, hub *livedata.Hub, patillavatars []string) *Router {
+	sections []Section, s sessions.Store, hub *livedata.Hub, patillavatars []string,
+	opts Options) *Router {
 	if t == nil {
 		log.Fatal("Missing templates.")
 	}
@@ -67,20 +186,90 @@ func New(t *template.Template, users pbUsers.CrudUsersClient, general pbApi.Crud
 	if len(patillavatars) == 0 {
 		log.Fatal("No default patillavatars.")
 	}
+	if len(opts.TokenKey) == 0 {
+		log.Fatal("Missing API token key.")
+	}
+	if opts.TokenLifetime <= 0 {
+		log.Fatal("API token lifetime must be positive.")
+	}
+	if opts.UsersTimeout <= 0 || opts.GeneralTimeout <= 0 {
+		log.Fatal("Users and general services timeouts must be positive.")
+	}
+	if opts.Logger == nil {
+		opts.Logger = logging.Default()
+	}
+	if opts.Seen == nil {
+		opts.Seen = pagination.NewMemorySeenStore(pagination.DefaultSeenCapacity,
+			pagination.DefaultSeenTTL)
+	}
+	if opts.DiscardLimits == nil {
+		opts.DiscardLimits = &pagination.DefaultLimits
+	}
+	if opts.Registry == nil {
+		opts.Registry = sessionstore.NewRegistry(sessionstore.NewMemoryBackend())
+	}
+	if opts.SessionLifetime == 0 {
+		opts.SessionLifetime = DefaultSessionLifetime
+	}
+	if opts.SessionIdleTimeout == 0 {
+		opts.SessionIdleTimeout = DefaultSessionIdleTimeout
+	}
+	if opts.RateLimits == nil {
+		opts.RateLimits = DefaultRateLimits
+	}
+	if opts.LoginLockout == nil {
+		opts.LoginLockout = &DefaultLoginLockout
+	}
+	if opts.StreamDuration == 0 {
+		opts.StreamDuration = DefaultStreamDuration
+	}
+	if opts.MaxLiveConns == 0 {
+		opts.MaxLiveConns = DefaultMaxLiveConns
+	}
+	if opts.SessionCheckInterval <= 0 {
+		opts.SessionCheckInterval = DefaultSessionCheckInterval
+	}
+	allowedOrigins := make(map[string]bool, len(opts.AllowedOrigins))
+	for _, origin := range opts.AllowedOrigins {
+		allowedOrigins[origin] = true
+	}
 	defaultPics = patillavatars
 
 	router := &Router{
-		sections:      make(map[string]Section),
-		templates:     t,
-		store:         s,
-		hub:           hub,
-		usersClient:   users,
-		generalClient: general,
-		handler:       mux.NewRouter(),
-		upgrader:      websocket.Upgrader{
-			ReadBufferSize:  livedata.ReadBufferSize,
-			WriteBufferSize: livedata.WriteBufferSize,
-		},
+		sections:       make(map[string]Section),
+		templates:      t,
+		store:          s,
+		registry:       opts.Registry,
+		sessLifetime:   opts.SessionLifetime,
+		sessIdle:       opts.SessionIdleTimeout,
+		limiters:       newLimiters(opts.RateLimits),
+		loginLockout:   ratelimit.NewLockout(*opts.LoginLockout),
+		trustProxy:     opts.TrustForwardedFor,
+		seen:           opts.Seen,
+		discardLimits:  *opts.DiscardLimits,
+		hub:            hub,
+		streamDur:      opts.StreamDuration,
+		allowedOrigins: allowedOrigins,
+		maxLiveConns:   opts.MaxLiveConns,
+		sessCheck:      opts.SessionCheckInterval,
+		liveConns:      make(map[string]int),
+		usersClient:    users,
+		generalClient:  general,
+		handler:        mux.NewRouter(),
+		log:            opts.Logger,
+		apiTokens:      newTokenCodec(opts.TokenKey, opts.TokenLifetime),
+		tokenLifetime:  opts.TokenLifetime,
+		usersTimeout:   opts.UsersTimeout,
+		generalTimeout: opts.GeneralTimeout,
+		healthCheck:    opts.HealthCheck,
+		metricsAccess:  opts.Metrics,
+		usersConn:      opts.UsersConn,
+		generalConn:    opts.GeneralConn,
+	}
+	router.upgrader = websocket.Upgrader{
+		ReadBufferSize:  livedata.ReadBufferSize,
+		WriteBufferSize: livedata.WriteBufferSize,
+		CheckOrigin:     router.checkOrigin,
 	}
 
 	for _, s := range sections {
@@ -93,12 +282,41 @@ func New(t *template.Template, users pbUsers.CrudUsersClient, general pbApi.Crud
 }
 
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	r.handler.ServeHTTP(w, req)
+	r.handler.ServeHTTP(w, r.withRequestID(w, req))
+}
+
+// Shutdown waits for the notifications of the requests already replied to be
+// broadcasted and then shuts the hub down, closing the connections of every
+// user. It returns the context's error if ctx is done before they finish.
+// It must be called once the server stopped accepting requests.
+func (r *Router) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.broadcasts.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		r.log.Warn("Some notifications were not broadcasted before shutdown")
+	}
+	return r.hub.Shutdown(ctx)
 }
 
 func (r *Router) SetupRoutes(upload, static string) {
 	uploadDir = upload
+	r.handler.Use(metrics.Middleware)
+	// The API, the health checks and the metrics must be set up before the
+	// root, since "/{section}" would catch any request to them.
+	r.setupAPIRoutes()
+	r.handler.HandleFunc("/healthz", r.handleHealthz).Methods("GET")
+	r.handler.HandleFunc("/readyz", r.handleReadyz).Methods("GET")
+	if r.metricsAccess != nil {
+		r.handler.Handle("/metrics", r.metricsHandler()).Methods("GET")
+	}
+
 	root := r.handler.PathPrefix("/").Subrouter().StrictSlash(true)
+	root.Use(r.withSession, r.checkCSRF)
 	// favicon (not found)
 	root.Handle("/favicon.ico", http.NotFoundHandler())
 	// serve assets
@@ -107,96 +325,108 @@ func (r *Router) SetupRoutes(upload, static string) {
 	//
 	// WEBSOCKET
 	//
-	root.HandleFunc("/livenotifs", r.handleLiveNotifs).Methods("GET").Headers("X-Requested-With", "XMLHttpRequest")
+	root.HandleFunc("/livenotifs", r.handleLiveNotifs).Methods("GET")
+	// Server-Sent Events, for the clients whose websockets are blocked.
+	root.HandleFunc("/livenotifs/stream", r.handleLiveNotifsStream).Methods("GET")
 
 	// handlers for homepage "/" features
 	root.HandleFunc("/", r.onlyUsers(r.handleRoot)).Methods("GET")
 
-	root.HandleFunc("/recyclefeed", r.onlyUsers(r.handleRecycleFeed)).Methods("GET").Headers("X-Requested-With", "XMLHttpRequest")
+	root.HandleFunc("/recyclefeed", r.limit(ClassRecycle, r.onlyUsers(r.handleRecycleFeed))).Methods("GET").Headers("X-Requested-With", "XMLHttpRequest")
+	root.HandleFunc("/recyclefeed/reset", r.limit(ClassRecycle, r.onlyUsers(r.handleResetFeed))).Methods("POST")
 
-	root.HandleFunc("/recycleactivity", r.onlyUsers(r.handleRecycleMyActivity)).Methods("GET").Headers("X-Requested-With", "XMLHttpRequest")
+	root.HandleFunc("/recycleactivity", r.limit(ClassRecycle, r.onlyUsers(r.handleRecycleMyActivity))).Methods("GET").Headers("X-Requested-With", "XMLHttpRequest")
+	root.HandleFunc("/recycleactivity/reset", r.limit(ClassRecycle, r.onlyUsers(r.handleResetMyActivity))).Methods("POST")
 
-	root.HandleFunc("/recyclesaved", r.onlyUsers(r.handleRecycleMySaved)).Methods("GET").Headers("X-Requested-With", "XMLHttpRequest")
+	root.HandleFunc("/recyclesaved", r.limit(ClassRecycle, r.onlyUsers(r.handleRecycleMySaved))).Methods("GET").Headers("X-Requested-With", "XMLHttpRequest")
+	root.HandleFunc("/recyclesaved/reset", r.limit(ClassRecycle, r.onlyUsers(r.handleResetMySaved))).Methods("POST")
 
 	// explore page
 	root.HandleFunc("/explore", r.handleExplore).Methods("GET")
-	root.HandleFunc("/explore/recycle", r.handleExploreRecycle).Methods("GET").Headers("X-Requested-With", "XMLHttpRequest")
+	root.HandleFunc("/explore/recycle", r.limit(ClassRecycle, r.handleExploreRecycle)).Methods("GET").Headers("X-Requested-With", "XMLHttpRequest")
+	root.HandleFunc("/explore/recycle/reset", r.limit(ClassRecycle, r.handleExploreReset)).Methods("POST")
 
 	// notifications
-	root.HandleFunc("/readnotifs", r.onlyUsers(r.handleReadNotifs)).Methods("GET").Headers("X-Requested-With", "XMLHttpRequest")
-	root.HandleFunc("/clearnotifs", r.onlyUsers(r.handleClearNotifs)).Methods("GET").Headers("X-Requested-With", "XMLHttpRequest")
+	root.HandleFunc("/readnotifs", r.onlyUsers(r.handleReadNotifs)).Methods("POST")
+	root.HandleFunc("/clearnotifs", r.onlyUsers(r.handleClearNotifs)).Methods("POST")
 
 	// follow event
-	root.HandleFunc("/follow", r.onlyUsers(r.handleFollow)).Methods("POST").Queries("username", "{username:[a-zA-Z0-9_]+}")
+	root.HandleFunc("/follow", r.limit(ClassWrite, r.onlyUsers(r.handleFollow))).Methods("POST").Queries("username", "{username:[a-zA-Z0-9_]+}")
 	// unfollow event
-	root.HandleFunc("/unfollow", r.onlyUsers(r.handleUnfollow)).Methods("POST").Queries("username", "{username:[a-zA-Z0-9_]+}")
+	root.HandleFunc("/unfollow", r.limit(ClassWrite, r.onlyUsers(r.handleUnfollow))).Methods("POST").Queries("username", "{username:[a-zA-Z0-9_]+}")
 
 	// get basic info of users either following or followers
-	root.HandleFunc("/viewusers", r.handleViewUsers).Methods("GET").Queries("context", "{context:[a-z]+}", "userid", "{userid:[a-zA-Z0-9-]+}", "offset", "{offset:[0-9]+}").Headers("X-Requested-With", "XMLHttpRequest")
+	root.HandleFunc("/viewusers", r.limit(ClassRecycle, r.handleViewUsers)).Methods("GET").Queries("context", "{context:[a-z]+}", "userid", "{userid:[a-zA-Z0-9-]+}", "offset", "{offset:[0-9]+}").Headers("X-Requested-With", "XMLHttpRequest")
 
 	// current user's profile page
 	root.HandleFunc("/myprofile", r.onlyUsers(r.handleMyProfile)).Methods("GET")
-	root.HandleFunc("/myprofile/update", r.onlyUsers(r.handleUpdateMyProfile)).Methods("PUT")
+	root.HandleFunc("/myprofile/update", r.limit(ClassWrite, r.onlyUsers(r.handleUpdateMyProfile))).Methods("PUT")
 
 	// show other user's profile
 	root.HandleFunc("/profile", r.handleViewUserProfile).Methods("GET").Queries("username", "{username:[a-zA-Z0-9_]+}")
 	// recycle other user's activity
-	root.HandleFunc("/profile/recycle", r.handleRecycleUserActivity).Methods("GET").Queries("userid", "{userid:[a-zA-Z0-9-]+}").Headers("X-Requested-With", "XMLHttpRequest")
+	root.HandleFunc("/profile/recycle", r.limit(ClassRecycle, r.handleRecycleUserActivity)).Methods("GET").Queries("userid", "{userid:[a-zA-Z0-9-]+}").Headers("X-Requested-With", "XMLHttpRequest")
+	root.HandleFunc("/profile/recycle/reset", r.limit(ClassRecycle, r.handleResetUserActivity)).Methods("POST").Queries("userid", "{userid:[a-zA-Z0-9-]+}")
 
-	root.HandleFunc("/login", r.handleLogin).Methods("POST")
-	root.HandleFunc("/signin", r.handleSignin).Methods("POST")
-	root.HandleFunc("/logout", r.onlyUsers(r.handleLogout)).Methods("GET")
+	root.HandleFunc("/login", r.limit(ClassAuth, r.handleLogin)).Methods("POST")
+	root.HandleFunc("/signin", r.limit(ClassAuth, r.handleSignin)).Methods("POST")
+	root.HandleFunc("/logout", r.onlyUsers(r.handleLogout)).Methods("POST")
+	root.HandleFunc("/logout/all", r.onlyUsers(r.handleLogoutAll)).Methods("POST")
 
 	// handlers for sections
 	section := root.PathPrefix("/{section}").Subrouter()
 
 	section.HandleFunc("", r.handleViewSection).Methods("GET")
 	// create a thread
-	section.HandleFunc("/new", r.onlyUsers(r.handleNewThread)).Methods("POST")
+	section.HandleFunc("/new", r.limit(ClassWrite, r.onlyUsers(r.handleNewThread))).Methods("POST")
 	// recycle section threads
-	section.HandleFunc("/recycle", r.handleRecycleSection).Methods("GET")
+	section.HandleFunc("/recycle", r.limit(ClassRecycle, r.handleRecycleSection)).Methods("GET")
+	// start over the pagination of section threads
+	section.HandleFunc("/recycle/reset", r.limit(ClassRecycle, r.handleResetSection)).Methods("POST")
 
 	// handlers for threads
 	thread := section.PathPrefix("/{thread}").Subrouter()
 	thread.HandleFunc("", r.handleViewThread).Methods("GET")
 	// recycle thread comments
-	thread.HandleFunc("/recycle", r.handleRecycleComments).Methods("GET")
+	thread.HandleFunc("/recycle", r.limit(ClassRecycle, r.handleRecycleComments)).Methods("GET")
+	// start over the pagination of thread comments
+	thread.HandleFunc("/recycle/reset", r.limit(ClassRecycle, r.handleResetComments)).Methods("POST")
 	// save thread "/{section}/{thread}/save"
-	thread.HandleFunc("/save", r.onlyUsers(r.handleSave)).Methods("POST")
+	thread.HandleFunc("/save", r.limit(ClassWrite, r.onlyUsers(r.handleSave))).Methods("POST")
 	// undo save thread "/{section}/{thread}/undosave"
-	thread.HandleFunc("/undosave", r.onlyUsers(r.handleUndoSave)).Methods("POST")
+	thread.HandleFunc("/undosave", r.limit(ClassWrite, r.onlyUsers(r.handleUndoSave))).Methods("POST")
 	// delete thread "/{section}/{thread}/delete"
-	thread.HandleFunc("/delete", r.onlyUsers(r.handleDeleteThread)).Methods("DELETE")
+	thread.HandleFunc("/delete", r.limit(ClassWrite, r.onlyUsers(r.handleDeleteThread))).Methods("DELETE")
 
 	// handlers for comments
 	comments := thread.PathPrefix("/comment").Subrouter()
 	// get 10 subcomments
-	comments.HandleFunc("/", r.handleGetSubcomments).Methods("GET").Headers("X-Requested-With", "XMLHttpRequest").Queries("c_id", "{c_id:[a-zA-Z0-9]+}", "offset", "{offset:[0-9]+}")
+	comments.HandleFunc("/", r.limit(ClassRecycle, r.handleGetSubcomments)).Methods("GET").Headers("X-Requested-With", "XMLHttpRequest").Queries("c_id", "{c_id:[a-zA-Z0-9]+}", "offset", "{offset:[0-9]+}")
 	// post a subcomment
-	comments.HandleFunc("/", r.onlyUsers(r.handlePostSubcomment)).Methods("POST").Queries("c_id", "{c_id:[a-zA-Z0-9]+}")
+	comments.HandleFunc("/", r.limit(ClassWrite, r.onlyUsers(r.handlePostSubcomment))).Methods("POST").Queries("c_id", "{c_id:[a-zA-Z0-9]+}")
 	// delete a subcomment
 	// "/{section}/{thread}/comment/delete?c_id={c_id}&sc_id={sc_id}"
-	comments.HandleFunc("/delete", r.onlyUsers(r.handleDeleteSubcomment)).Methods("DELETE").Queries("c_id", "{c_id:[a-zA-Z0-9]+}", "sc_id", "{sc_id:[a-zA-Z0-9]+}")
+	comments.HandleFunc("/delete", r.limit(ClassWrite, r.onlyUsers(r.handleDeleteSubcomment))).Methods("DELETE").Queries("c_id", "{c_id:[a-zA-Z0-9]+}", "sc_id", "{sc_id:[a-zA-Z0-9]+}")
 	// post a comment
-	comments.HandleFunc("/", r.onlyUsers(r.handlePostComment)).Methods("POST")
+	comments.HandleFunc("/", r.limit(ClassWrite, r.onlyUsers(r.handlePostComment))).Methods("POST")
 	// delete a comment "/{section}/{thread}/comment/delete?c_id={c_id}"
-	comments.HandleFunc("/delete", r.onlyUsers(r.handleDeleteComment)).Methods("DELETE").Queries("c_id", "{c_id:[a-zA-Z0-9]+}")
+	comments.HandleFunc("/delete", r.limit(ClassWrite, r.onlyUsers(r.handleDeleteComment))).Methods("DELETE").Queries("c_id", "{c_id:[a-zA-Z0-9]+}")
 
 	// handlers for upvotes
 	upvotes := thread.PathPrefix("/upvote").Subrouter()
 	// upvote a subcomment
-	upvotes.HandleFunc("/", r.onlyUsers(r.handleUpvoteSubcomment)).Methods("POST").Queries("c_id", "{c_id:[a-zA-Z0-9]+}", "sc_id", "{sc_id:[a-zA-Z0-9]+}")
+	upvotes.HandleFunc("/", r.limit(ClassVote, r.onlyUsers(r.handleUpvoteSubcomment))).Methods("POST").Queries("c_id", "{c_id:[a-zA-Z0-9]+}", "sc_id", "{sc_id:[a-zA-Z0-9]+}")
 	// upvote a comment
-	upvotes.HandleFunc("/", r.onlyUsers(r.handleUpvoteComment)).Methods("POST").Queries("c_id", "{c_id:[a-zA-Z0-9]+}")
+	upvotes.HandleFunc("/", r.limit(ClassVote, r.onlyUsers(r.handleUpvoteComment))).Methods("POST").Queries("c_id", "{c_id:[a-zA-Z0-9]+}")
 	// upvote a thread
-	upvotes.HandleFunc("/", r.onlyUsers(r.handleUpvoteThread)).Methods("POST")
+	upvotes.HandleFunc("/", r.limit(ClassVote, r.onlyUsers(r.handleUpvoteThread))).Methods("POST")
 
 	// handlers for undoing upvotes
 	undoUpvotes := thread.PathPrefix("/undoupvote").Subrouter()
 	// undo upvote on a subcomment
-	undoUpvotes.HandleFunc("/", r.onlyUsers(r.handleUndoUpvoteSubcomment)).Methods("POST").Queries("c_id", "{c_id:[a-zA-Z0-9]+}", "sc_id", "{sc_id:[a-zA-Z0-9]+}")
+	undoUpvotes.HandleFunc("/", r.limit(ClassVote, r.onlyUsers(r.handleUndoUpvoteSubcomment))).Methods("POST").Queries("c_id", "{c_id:[a-zA-Z0-9]+}", "sc_id", "{sc_id:[a-zA-Z0-9]+}")
 	// undo upvote on a comment
-	undoUpvotes.HandleFunc("/", r.onlyUsers(r.handleUndoUpvoteComment)).Methods("POST").Queries("c_id", "{c_id:[a-zA-Z0-9]+}")
+	undoUpvotes.HandleFunc("/", r.limit(ClassVote, r.onlyUsers(r.handleUndoUpvoteComment))).Methods("POST").Queries("c_id", "{c_id:[a-zA-Z0-9]+}")
 	// undo upvote on a thread
-	undoUpvotes.HandleFunc("/", r.onlyUsers(r.handleUndoUpvoteThread)).Methods("POST")
+	undoUpvotes.HandleFunc("/", r.limit(ClassVote, r.onlyUsers(r.handleUndoUpvoteThread))).Methods("POST")
 }
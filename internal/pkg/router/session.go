@@ -0,0 +1,123 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// Default lifetimes of the sessions of logged in users.
+const (
+	DefaultSessionLifetime    = 30 * 24 * time.Hour
+	DefaultSessionIdleTimeout = 7 * 24 * time.Hour
+)
+
+// touchInterval is the minimum time between updates of the last time a session
+// was seen, so that sessions are not saved on every request.
+const touchInterval = time.Minute
+
+// sessionUserKey is the key of the context of a request under which the id of
+// the user logged in the session of the request is kept by withSession.
+type sessionUserKey struct{}
+
+// startSession logs the user in a new session, with a new id, a new session key
+// and a new CSRF token, and saves it. The previous session of the request, if any, is deleted, so
+// that a session id planted by an attacker before the login is useless. The new
+// session is registered until its absolute lifetime expires.
+func (r *Router) startSession(req *http.Request, w http.ResponseWriter, userId string) error {
+	// Get always returns a session, even if empty
+	old, _ := r.store.Get(req, "session")
+	opts := *old.Options
+	if !old.IsNew {
+		if err := r.deleteSession(req, w); err != nil {
+			return err
+		}
+	}
+	sid := randToken(32)
+	now := time.Now()
+	if err := r.registry.Add(userId, sid, now.Add(r.sessLifetime)); err != nil {
+		return err
+	}
+	session := sessions.NewSession(r.store, "session")
+	session.Options = &opts
+	session.IsNew = true
+	session.Values["user_id"] = userId
+	session.Values["sid"] = sid
+	session.Values["csrf_token"] = randToken(32)
+	session.Values["created"] = now.Unix()
+	session.Values["last_seen"] = now.Unix()
+	return session.Save(req, w)
+}
+
+// sessionUser returns the id of the user logged in the given session, or an
+// empty string if no user is logged in or the session is no longer valid, that
+// is, its absolute lifetime or its idle timeout expired or it was revoked.
+func (r *Router) sessionUser(req *http.Request, session *sessions.Session) string {
+	userId, ok := session.Values["user_id"].(string)
+	if !ok {
+		return ""
+	}
+	sid, _ := session.Values["sid"].(string)
+	created, _ := session.Values["created"].(int64)
+	lastSeen, _ := session.Values["last_seen"].(int64)
+	// Sessions created by older versions are not registered.
+	if sid == "" {
+		return ""
+	}
+	now := time.Now()
+	if now.Sub(time.Unix(created, 0)) > r.sessLifetime {
+		return ""
+	}
+	if r.sessIdle > 0 && now.Sub(time.Unix(lastSeen, 0)) > r.sessIdle {
+		return ""
+	}
+	ok, err := r.registry.Contains(userId, sid)
+	if err != nil {
+		logFor(req).Error("Could not check session", "err", err)
+		return ""
+	}
+	if !ok {
+		return ""
+	}
+	return userId
+}
+
+// withSession middleware checks the session of the request once and keeps the
+// id of the user logged in it in the context of the request, for currentUser.
+// It also updates the last time the session was seen, so that it does not
+// expire while it is in use.
+func (r *Router) withSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Get always returns a session, even if empty
+		session, _ := r.store.Get(req, "session")
+		userId := r.sessionUser(req, session)
+		lastSeen, _ := session.Values["last_seen"].(int64)
+		if userId != "" && time.Since(time.Unix(lastSeen, 0)) > touchInterval {
+			if err := r.touchSession(req, w, session); err != nil {
+				logFor(req).Error("Could not save session", "err", err)
+			}
+		}
+		ctx := context.WithValue(req.Context(), sessionUserKey{}, userId)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// touchSession sets the last time the given session, which is the session of
+// the request, was seen to now and saves it. As in setSeenKey, the session is
+// saved holding its lock and with the values saved in the store, so that the
+// values set by concurrent requests are not lost.
+func (r *Router) touchSession(req *http.Request, w http.ResponseWriter,
+	session *sessions.Session) error {
+	mu := r.sessionLock(session.ID)
+	mu.Lock()
+	defer mu.Unlock()
+	if saved, err := r.store.New(req, "session"); err == nil && !saved.IsNew {
+		for k, v := range saved.Values {
+			session.Values[k] = v
+		}
+	}
+	session.Values["last_seen"] = time.Now().Unix()
+	return session.Save(req, w)
+}
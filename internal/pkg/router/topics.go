@@ -0,0 +1,205 @@
+package router
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	pbApi "github.com/luisguve/cheroproto-go/cheroapi"
+	pbContext "github.com/luisguve/cheroproto-go/context"
+	pbMetadata "github.com/luisguve/cheroproto-go/metadata"
+	"github.com/luisguve/cherosite/internal/pkg/livedata"
+	"github.com/luisguve/cherosite/internal/pkg/logging"
+	"github.com/luisguve/cherosite/internal/pkg/templates"
+)
+
+// Events published to the viewers of the threads and the sections; see
+// livedata.TypeEvent.
+const (
+	// eventComment carries a commentEvent to the viewers of the thread.
+	eventComment = "comment"
+	// eventCounters carries a countersEvent to the viewers of the thread, and
+	// to the viewers of its section if the counters are those of the thread.
+	eventCounters = "counters"
+)
+
+// commentEvent is a new comment on a thread. HTML is the comment rendered as in
+// the thread page; it is empty if the comment could not be loaded, in which
+// case the viewers are expected to load the comments again.
+type commentEvent struct {
+	Section string `json:"section"`
+	Thread  string `json:"thread"`
+	Comment string `json:"comment,omitempty"`
+	HTML    string `json:"html,omitempty"`
+}
+
+// countersEvent is a change of the upvotes or the replies of a thread, comment
+// or subcomment, given by the ids that are set. The counters are deltas, since
+// the comments cannot be loaded one by one.
+type countersEvent struct {
+	Section      string `json:"section"`
+	Thread       string `json:"thread"`
+	Comment      string `json:"comment,omitempty"`
+	Subcomment   string `json:"subcomment,omitempty"`
+	UpvotesDelta int    `json:"upvotes_delta,omitempty"`
+	RepliesDelta int    `json:"replies_delta,omitempty"`
+}
+
+// newCommentsPattern is the pattern of the comments loaded to find a comment
+// just posted.
+var newCommentsPattern = []pbMetadata.ContentStatus{
+	pbMetadata.ContentStatus_NEW,
+	pbMetadata.ContentStatus_NEW,
+	pbMetadata.ContentStatus_NEW,
+	pbMetadata.ContentStatus_NEW,
+	pbMetadata.ContentStatus_NEW,
+	pbMetadata.ContentStatus_NEW,
+	pbMetadata.ContentStatus_NEW,
+	pbMetadata.ContentStatus_NEW,
+	pbMetadata.ContentStatus_NEW,
+	pbMetadata.ContentStatus_NEW,
+}
+
+// publishCounters publishes the counters to the viewers of the thread, and to
+// the viewers of the section if they are the counters of the thread. The
+// connections of the user skip are left out, since its pages already show the
+// change.
+func (r *Router) publishCounters(counters countersEvent, skip string) {
+	topics := []string{livedata.ThreadTopic(counters.Section, counters.Thread)}
+	if counters.Comment == "" {
+		topics = append(topics, livedata.SectionTopic(counters.Section))
+	}
+	for _, topic := range topics {
+		r.hub.Publish(&livedata.Event{
+			Topic: topic,
+			Name:  eventCounters,
+			Data:  counters,
+			Skip:  skip,
+		})
+	}
+}
+
+// publishUpvote publishes the counters changed by the given upvote, or by its
+// undoing if delta is negative.
+func (r *Router) publishUpvote(contentCtx interface{}, userId string, delta int) {
+	var counters countersEvent
+	switch c := contentCtx.(type) {
+	case *pbApi.UpvoteRequest_ThreadCtx:
+		counters = threadCounters(c.ThreadCtx.SectionCtx.Id, c.ThreadCtx.Id)
+	case *pbApi.UndoUpvoteRequest_ThreadCtx:
+		counters = threadCounters(c.ThreadCtx.SectionCtx.Id, c.ThreadCtx.Id)
+	case *pbApi.UpvoteRequest_CommentCtx:
+		counters = commentCounters(c.CommentCtx.ThreadCtx.SectionCtx.Id,
+			c.CommentCtx.ThreadCtx.Id, c.CommentCtx.Id)
+	case *pbApi.UndoUpvoteRequest_CommentCtx:
+		counters = commentCounters(c.CommentCtx.ThreadCtx.SectionCtx.Id,
+			c.CommentCtx.ThreadCtx.Id, c.CommentCtx.Id)
+	case *pbApi.UpvoteRequest_SubcommentCtx:
+		counters = subcommentCounters(c.SubcommentCtx)
+	case *pbApi.UndoUpvoteRequest_SubcommentCtx:
+		counters = subcommentCounters(c.SubcommentCtx)
+	default:
+		return
+	}
+	counters.UpvotesDelta = delta
+	r.publishCounters(counters, userId)
+}
+
+// publishComment publishes the given comment to the viewers of the thread, along
+// with the replies counter of the thread or of the comment replied to. It takes
+// a while to load a comment just posted, so it must be called from its own
+// goroutine. The comment is loaded with a deadline of its own, since the request
+// that posted it may have used up most of its deadline.
+func (r *Router) publishComment(req *http.Request, commentRequest *pbApi.CommentRequest,
+	section Section) {
+	switch commentCtx := commentRequest.ContentContext.(type) {
+	case *pbApi.CommentRequest_ThreadCtx:
+		thread := commentCtx.ThreadCtx
+		event := commentEvent{Section: thread.SectionCtx.Id, Thread: thread.Id}
+		ctx, cancel := detachedContext(req, section.Timeout)
+		rule, err := findComment(ctx, commentRequest, section)
+		cancel()
+		if err != nil {
+			logging.FromContext(ctx).Warn("Could not load the comment to publish",
+				"err", err)
+		}
+		if rule != nil {
+			event.HTML = string(templates.FeedToContentBytes([]*pbApi.ContentRule{rule},
+				"", false))
+			if c, ok := rule.ContentContext.(*pbApi.ContentRule_CommentCtx); ok {
+				event.Comment = c.CommentCtx.Id
+			}
+		}
+		r.hub.Publish(&livedata.Event{
+			Topic: livedata.ThreadTopic(event.Section, event.Thread),
+			Name:  eventComment,
+			Data:  event,
+		})
+		counters := threadCounters(event.Section, event.Thread)
+		counters.RepliesDelta = 1
+		r.publishCounters(counters, "")
+	case *pbApi.CommentRequest_CommentCtx:
+		comment := commentCtx.CommentCtx
+		counters := commentCounters(comment.ThreadCtx.SectionCtx.Id, comment.ThreadCtx.Id,
+			comment.Id)
+		counters.RepliesDelta = 1
+		r.publishCounters(counters, "")
+	}
+}
+
+// findComment looks for the comment of the given request among the newest
+// comments of the thread. It returns nil if the comment is not among them.
+func findComment(ctx context.Context, commentRequest *pbApi.CommentRequest,
+	section Section) (*pbApi.ContentRule, error) {
+	threadCtx := commentRequest.ContentContext.(*pbApi.CommentRequest_ThreadCtx)
+	stream, err := section.Client.RecycleContent(ctx, &pbApi.ContentPattern{
+		Pattern:        newCommentsPattern,
+		ContentContext: &pbApi.ContentPattern_ThreadCtx{threadCtx.ThreadCtx},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for {
+		rule, err := stream.Recv()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isComment(rule, commentRequest) {
+			return rule, nil
+		}
+	}
+}
+
+// isComment reports whether the content rule is the comment posted with the
+// given request.
+func isComment(rule *pbApi.ContentRule, commentRequest *pbApi.CommentRequest) bool {
+	data := rule.Data
+	if data == nil || data.Author == nil || data.Content == nil ||
+		data.Content.PublishDate == nil || commentRequest.PublishDate == nil {
+		return false
+	}
+	return data.Author.Id == commentRequest.UserId &&
+		data.Content.PublishDate.Seconds == commentRequest.PublishDate.Seconds &&
+		data.Content.Content == commentRequest.Content
+}
+
+func threadCounters(section, thread string) countersEvent {
+	return countersEvent{Section: section, Thread: thread}
+}
+
+func commentCounters(section, thread, comment string) countersEvent {
+	return countersEvent{Section: section, Thread: thread, Comment: comment}
+}
+
+func subcommentCounters(subcomment *pbContext.Subcomment) countersEvent {
+	comment := subcomment.CommentCtx
+	return countersEvent{
+		Section:    comment.ThreadCtx.SectionCtx.Id,
+		Thread:     comment.ThreadCtx.Id,
+		Comment:    comment.Id,
+		Subcomment: subcomment.Id,
+	}
+}
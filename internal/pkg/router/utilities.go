@@ -3,24 +3,30 @@ package router
 import (
 	"context"
 	"crypto/rand"
-	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
-	"log"
 	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/sessions"
 	pbApi "github.com/luisguve/cheroproto-go/cheroapi"
 	pbUsers "github.com/luisguve/cheroproto-go/userapi"
 	pbContext "github.com/luisguve/cheroproto-go/context"
 	pbDataFormat "github.com/luisguve/cheroproto-go/dataformat"
+	"github.com/luisguve/cherosite/internal/pkg/logging"
+	"github.com/luisguve/cherosite/internal/pkg/metrics"
 	"github.com/luisguve/cherosite/internal/pkg/pagination"
 	"github.com/luisguve/cherosite/internal/pkg/templates"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -34,14 +40,6 @@ var (
 )
 
 var (
-	errMissingFile      = errors.New("MISSING_ft_file_INPUT")
-	errInternalFailure  = errors.New("INTERNAL_FAILURE")
-	errFileTooBig       = errors.New("FILE_TOO_BIG")
-	errInvalidFile      = errors.New("INVALID_FILE")
-	errInvalidFileType  = errors.New("INVALID_FILE_TYPE")
-	errCantReadFileType = errors.New("CANT_READ_FILE_TYPE")
-	errCantWriteFile    = errors.New("CANT_WRITE_FILE")
-	errUnregistered     = errors.New("USER_UNREGISTERED")
 	// Default patillavatar pics
 	defaultPics []string
 )
@@ -58,9 +56,22 @@ type streamFeed interface {
 	Recv() (*pbApi.ContentRule, error)
 }
 
+// Types of feed, as labeled in the metrics of the number of contents returned.
+const (
+	feedDashboard    = "dashboard"
+	feedActivity     = "activity"
+	feedSaved        = "saved"
+	feedExplore      = "explore"
+	feedSection      = "section"
+	feedComments     = "comments"
+	feedSubcomments  = "subcomments"
+	feedUserActivity = "user_activity"
+)
+
 // getFeed continuously receive content rules from the given stream and returns a
-// templates.ContentsFeed and any error encountered.
-func getFeed(stream streamFeed) (templates.ContentsFeed, error) {
+// templates.ContentsFeed and any error encountered. The number of contents
+// received is recorded under the given type of feed.
+func getFeed(stream streamFeed, feedType string) (templates.ContentsFeed, error) {
 	var (
 		feed        templates.ContentsFeed
 		err         error
@@ -82,73 +93,224 @@ INF_LOOP:
 					break INF_LOOP
 				}
 			}
-			log.Printf("Error receiving response from stream: %v\n", err)
+			// The error is returned to the caller, which logs it.
 			break
 		}
 		feed.Contents = append(feed.Contents, contentRule)
 	}
+	metrics.FeedItems.WithLabelValues(feedType).Observe(float64(len(feed.Contents)))
 	return feed, err
 }
 
-// getDiscardIds returns the id of contents to be discarded from loads of new feeds
-func getDiscardIds(sess *sessions.Session) (discard *pagination.DiscardIds) {
-	discardIds := sess.Values["discard_ids"]
-	var ok bool
-	if discard, ok = discardIds.(*pagination.DiscardIds); !ok {
-		// This session value has not been set before.
-		discard = &pagination.DiscardIds{
-			UserActivity:   make(map[string]pagination.Activity),
-			FeedActivity:   make(map[string]pagination.Activity),
-			SavedThreads:   make(map[string][]string),
-			SectionThreads: make(map[string][]string),
-			ThreadComments: make(map[string][]string),
-			GeneralThreads: make(map[string][]string),
-		}
+// getDiscardIds returns the id of contents to be discarded from loads of new
+// feeds. They are kept in the SeenStore of the router under the key held by the
+// session, and are bounded by the discard limits of the router, so that the
+// contexts not accessed for long start over.
+func (r *Router) getDiscardIds(req *http.Request) *pagination.DiscardIds {
+	// Get always returns a session, even if empty
+	session, _ := r.store.Get(req, "session")
+	key, ok := session.Values["seen_key"].(string)
+	if !ok {
+		// No content has been seen in this session.
+		return pagination.NewDiscardIds()
+	}
+	discard, err := r.seen.Get(key)
+	if err != nil {
+		logFor(req).Error("Could not get seen contents", "err", err)
 	}
+	if discard == nil {
+		return pagination.NewDiscardIds()
+	}
+	discard.Prune(r.discardLimits)
 	return discard
 }
 
-// updateDiscardIdsSession replaces ids of contents already set in the session
-// with the provided templates.ContentsFeed and saves the cookie.
+// updateDiscardIdsSession replaces ids of contents already seen in the session
+// through setDiscardIds, which must touch or reset the contexts it updates, and
+// prunes them according to the discard limits of the router. The SeenStore
+// applies setDiscardIds to the latest ids of the session, so that concurrent
+// recycles of the same session do not lose each other's ids. The cookie is
+// saved only if the session had no key to the SeenStore of the router yet.
 func (r *Router) updateDiscardIdsSession(req *http.Request, w http.ResponseWriter,
 	setDiscardIds func(*pagination.DiscardIds)) {
 	// Get always returns a session, even if empty
 	session, _ := r.store.Get(req, "session")
-	// Get id of contents to be discarded
-	discard := getDiscardIds(session)
+	key, ok := session.Values["seen_key"].(string)
+	// Sessions created by older versions hold the ids themselves.
+	_, legacy := session.Values["discard_ids"]
+	if !ok || legacy {
+		var err error
+		if key, err = r.setSeenKey(req, w, session); err != nil {
+			logFor(req).Error("Could not save session", "err", err)
+			return
+		}
+	}
 	// Replace content already seen by the user with the new feed
-	setDiscardIds(discard)
-	session.Values["discard_ids"] = discard
-	if err := session.Save(req, w); err != nil {
-		log.Printf("Could not save session because... %v\n", err)
+	err := r.seen.Update(key, func(d *pagination.DiscardIds) {
+		// Drop the expired contexts before they are updated.
+		d.Prune(r.discardLimits)
+		setDiscardIds(d)
+		d.Prune(r.discardLimits)
+	})
+	if err != nil {
+		logFor(req).Error("Could not update seen contents", "err", err)
+	}
+}
+
+// setSeenKey sets a key to the SeenStore of the router in the given session,
+// which is the session of the request, and saves it. Concurrent requests of a
+// session without key would otherwise set different keys, and all but the key
+// saved last would be lost along with their ids. Hence the key is set holding
+// the lock of the session, and if the session saved in the store already has a
+// key, it is used instead of a new one.
+func (r *Router) setSeenKey(req *http.Request, w http.ResponseWriter,
+	session *sessions.Session) (string, error) {
+	if !session.IsNew {
+		mu := r.sessionLock(session.ID)
+		mu.Lock()
+		defer mu.Unlock()
+		// New reads the session from the store rather than from the registry
+		// of the request, which holds the values it had when it was first read.
+		if saved, err := r.store.New(req, "session"); err == nil {
+			if key, ok := saved.Values["seen_key"].(string); ok {
+				session.Values["seen_key"] = key
+				if _, legacy := session.Values["discard_ids"]; !legacy {
+					return key, nil
+				}
+			}
+		}
+	}
+	key, ok := session.Values["seen_key"].(string)
+	if !ok {
+		key = randToken(16)
 	}
+	session.Values["seen_key"] = key
+	delete(session.Values, "discard_ids")
+	return key, session.Save(req, w)
+}
+
+// sessionLock returns the lock of the session with the given id. Sessions share
+// a fixed number of locks.
+func (r *Router) sessionLock(id string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &r.sessionLocks[h.Sum32()%uint32(len(r.sessionLocks))]
+}
+
+// exhausted reports whether a recycle that returned the given feed and error ran
+// out of contents, that is, every content available was already seen in the
+// pagination context.
+func exhausted(feed templates.ContentsFeed, err error) bool {
+	if len(feed.Contents) > 0 {
+		return false
+	}
+	return err == nil || status.Code(err) == codes.OutOfRange
+}
+
+// writeExhausted replies to a recycle request that ran out of contents with
+// EXHAUSTED and a 200 status code. The link to reset the pagination context is
+// set in the Link header with the relation "reset". JSON clients get an empty
+// feed with exhausted set and the link in reset instead.
+func writeExhausted(w http.ResponseWriter, req *http.Request, reset string) {
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Link", "<"+reset+`>; rel="reset"`)
+	if acceptsJSON(req) {
+		writeJSON(w, http.StatusOK, templates.FeedJSON{
+			Version:   templates.FeedSchemaVersion,
+			Contents:  []templates.ContentJSON{},
+			Exhausted: true,
+			Reset:     reset,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("EXHAUSTED"))
+}
+
+// resetPagination drops the ids of the contents seen in the given pagination
+// context, so that the next recycle starts over, and replies OK. It replies
+// INTERNAL_FAILURE if the SeenStore of the router fails.
+func (r *Router) resetPagination(w http.ResponseWriter, req *http.Request, kind, id string) {
+	// Get always returns a session, even if empty
+	session, _ := r.store.Get(req, "session")
+	if key, ok := session.Values["seen_key"].(string); ok {
+		err := r.seen.Update(key, func(d *pagination.DiscardIds) {
+			d.Reset(kind, id)
+		})
+		if err != nil {
+			logFor(req).Error("Could not reset seen contents", "err", err)
+			replyError(w, req, errInternalFailure)
+			return
+		}
+	}
+	w.Write([]byte("OK"))
+}
+
+// acceptsJSON reports whether the client asked for a JSON response through the
+// Accept header.
+func acceptsJSON(req *http.Request) bool {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.Split(accept, ";")[0])
+		if mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFeed sends the given feed to the client with the given status code, in
+// JSON format if it was asked so in the Accept header, or in HTML format
+// otherwise, using toBytes to render the contents. The headers set before, such
+// as the cookie of the session, are sent along with it.
+func writeFeed(w http.ResponseWriter, req *http.Request, code int,
+	feed templates.ContentsFeed, userId string, showSection bool,
+	toBytes func([]*pbApi.ContentRule, string, bool) []byte) error {
+	var (
+		res         []byte
+		contentType string
+		err         error
+	)
+	if acceptsJSON(req) {
+		res, err = templates.FeedToJSON(feed.Contents, userId)
+		if err != nil {
+			return err
+		}
+		contentType = "application/json"
+	} else {
+		res = toBytes(feed.Contents, userId, showSection)
+		contentType = "text/html"
+	}
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Content-Length", strconv.Itoa(len(res)))
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(code)
+	_, err = w.Write(res)
+	return err
 }
 
 // getAndSaveFile gets the file identified by formName coming in the request,
 // verifies that it does not exceeds the file size limit, and saves it to the
 // disk assigning to it a unique, random name.
 // On success, it should return the filepath under which it was stored. If there
-// are any errors, it will return an empty string, the error message and the
-// http status code, which can be StatusBadRequest, StatusInternalServerError or
-// StatusOK.
-func getAndSaveFile(req *http.Request, formName string) (string, error, int) {
+// are any errors, it will return an empty string and the error.
+func getAndSaveFile(req *http.Request, formName string) (string, error) {
 	file, fileHeader, err := req.FormFile(formName)
 	if err != nil {
 		if err == http.ErrMissingFile {
-			return "", errMissingFile, http.StatusBadRequest
+			return "", errMissingFile
 		}
-		log.Printf("Could not read file because... %v\n", err)
-		return "", errInternalFailure, http.StatusInternalServerError
+		logFor(req).Error("Could not read file", "err", err)
+		return "", errInternalFailure
 	}
 	defer file.Close()
 	// Validate file size
 	if fileHeader.Size > maxUploadSize {
-		return "", errFileTooBig, http.StatusBadRequest
+		return "", errFileTooBig
 	}
 	fileBytes, err := ioutil.ReadAll(file)
 	if err != nil {
-		log.Printf("Could not read all file: %s\n", err)
-		return "", errInvalidFile, http.StatusBadRequest
+		logFor(req).Error("Could not read all file", "err", err)
+		return "", errInvalidFile
 	}
 
 	// Check file type, DetectContentType only needs the first 512 bytes
@@ -159,13 +321,13 @@ func getAndSaveFile(req *http.Request, formName string) (string, error, int) {
 	case "application/pdf":
 		break
 	default:
-		return "", errInvalidFileType, http.StatusBadRequest
+		return "", errInvalidFileType
 	}
 	fileName := randToken(12)
 	fileEndings, err := mime.ExtensionsByType(detectedFileType)
 	if err != nil {
-		log.Printf("Can't read filetype: %v\n", err)
-		return "", errCantReadFileType, http.StatusInternalServerError
+		logFor(req).Error("Can't read filetype", "err", err)
+		return "", errCantReadFileType
 	}
 	filepathOS := filepath.Join(uploadDir, fileName+fileEndings[0])
 	fileURL := fmt.Sprintf("%s/%s", uploadPath, fileName+fileEndings[0])
@@ -173,156 +335,156 @@ func getAndSaveFile(req *http.Request, formName string) (string, error, int) {
 	// Write file to disk
 	newFile, err := os.Create(filepathOS)
 	if err != nil {
-		log.Printf("Could not create file: %s\n", err)
-		return "", errCantWriteFile, http.StatusInternalServerError
+		logFor(req).Error("Could not create file", "err", err)
+		return "", errCantWriteFile
 	}
 	defer newFile.Close() // idempotent, okay to call twice
 	if _, err = newFile.Write(fileBytes); err != nil || newFile.Close() != nil {
-		return "", errCantWriteFile, http.StatusInternalServerError
+		return "", errCantWriteFile
 	}
-	return fileURL, nil, http.StatusOK
+	return fileURL, nil
 }
 
 // getUserHeaderData returns username, alias, both read and unread notifs of the given
-// user. It sets the corresponding error header given any error while getting user
-// header data.
-func (r *Router) getUserHeaderData(w http.ResponseWriter, userId string) *pbUsers.UserHeaderData {
-	userData, err := r.usersClient.GetUserHeaderData(context.Background(),
+// user. It sets code to the status of any error while getting user header data,
+// so that the page is written with it along with the rest of its headers.
+func (r *Router) getUserHeaderData(req *http.Request, userId string,
+	code *int) *pbUsers.UserHeaderData {
+	ctx, cancel := r.usersContext(req)
+	defer cancel()
+	userData, err := r.usersClient.GetUserHeaderData(ctx,
 		&pbUsers.GetBasicUserDataRequest{UserId: userId})
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				log.Printf("User %s unregistered\n", userId)
-				w.WriteHeader(http.StatusUnauthorized)
-			case codes.Internal:
-				log.Printf("Internal error: %v\n", resErr.Message())
-				w.WriteHeader(http.StatusInternalServerError)
-			default:
-				log.Printf("Unknown error code %v: %v\n", resErr.Code(),
-					resErr.Message())
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-		} else {
-			log.Printf("Could not send request: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+		*code = currentUserErrors.translate(ctx, "GetUserHeaderData", err).Status
 	}
 	return userData
 }
 
 // getBasicUserData returns a user's basic data: alias, username, pic_url and
-// description, along with a status code and any error encountered.
-func (r *Router) getBasicUserData(userId string) (*pbDataFormat.BasicUserData, int, error) {
+// description, along with any error encountered.
+func (r *Router) getBasicUserData(req *http.Request,
+	userId string) (*pbDataFormat.BasicUserData, error) {
 	request := &pbUsers.GetBasicUserDataRequest{
 		UserId: userId,
 	}
-	userData, err := r.usersClient.GetBasicUserData(context.Background(), request)
+	ctx, cancel := r.usersContext(req)
+	defer cancel()
+	userData, err := r.usersClient.GetBasicUserData(ctx, request)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				log.Printf("User %v unregistered\n", userId)
-				return nil, http.StatusNotFound, errUnregistered
-			default:
-				log.Printf("Unknown code %v: %v\n", resErr.Code(), resErr.Message())
-				return nil, http.StatusInternalServerError, errInternalFailure
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		return nil, http.StatusInternalServerError, errInternalFailure
+		return nil, currentUserErrors.translate(ctx, "GetBasicUserData", err)
 	}
-	return userData, http.StatusOK, nil
+	return userData, nil
 }
 
 // handleUpvote is an utility method to help reduce the repetition of similar code in
 // other handlers that perform the same operation, in this case, an upvote,  since
 // all the handlers that are called in an upvote event share the same upvote request
 // object. The duties of returning a response to the client are also delegated to
-// postUpvote, which returns OK on success or an error in case of the following:
+// handleUpvote, which returns OK on success or the error returned by postUpvote.
+func (r *Router) handleUpvote(w http.ResponseWriter, req *http.Request,
+	upvoteRequest *pbApi.UpvoteRequest, section Section) {
+	if err := r.postUpvote(req, upvoteRequest, section); err != nil {
+		replyError(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// postUpvote submits the upvote to the section, broadcasts the resulting
+// notifications and publishes the new counters to the viewers of the content.
+// It returns an error in case of the following:
 // - invalid section name, thread id or comment -> 404 NOT_FOUND
 // - section, thread or comment are unavailable -> SECTION_UNAVAILABLE
 // - network failures ---------------------------> INTERNAL_FAILURE
-func (r *Router) handleUpvote(w http.ResponseWriter, req *http.Request,
-	upvoteRequest *pbApi.UpvoteRequest, section pbApi.CrudCheropatillaClient) {
-	stream, err := section.Upvote(context.Background(), upvoteRequest)
+func (r *Router) postUpvote(req *http.Request, upvoteRequest *pbApi.UpvoteRequest,
+	section Section) error {
+	// The notifications are received after the response is sent, so the request
+	// is not canceled along with the http request.
+	ctx, cancel := detachedContext(req, section.Timeout)
+	stream, err := section.Client.Upvote(ctx, upvoteRequest)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				// section or thread not found
-				http.NotFound(w, req)
-				return
-			case codes.Unavailable:
-				http.Error(w, "SECTION_UNAVAILABLE", http.StatusNoContent)
-				return
-			default:
-				log.Printf("Unknown code %v: %v\n", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-		return
+		cancel()
+		return sectionErrors.translate(ctx, "Upvote", err)
 	}
 	// Call broadcastNotifs in a separate goroutine to collect the garbage in this
 	// handler
-	go r.broadcastNotifs(stream)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	r.broadcasts.Add(1)
+	go func() {
+		defer r.broadcasts.Done()
+		defer cancel()
+		if r.broadcastNotifs(ctx, stream) == nil {
+			r.publishUpvote(upvoteRequest.ContentContext, upvoteRequest.UserId, 1)
+		}
+	}()
+	return nil
 }
 
 // handleComment is an utility method to help reduce the repetition of similar code in
 // other handlers that perform the same operation, in this case, a comment post, since
 // all the handlers that are called in a comment event share the same comment request
 // object. The duties of returning a response to the client are also delegated to
-// postComment, which returns OK on success or an error in case of the following:
+// handleComment, which returns OK on success or the error returned by postComment.
+func (r *Router) handleComment(w http.ResponseWriter, req *http.Request,
+	commentRequest *pbApi.CommentRequest, section Section) {
+	if err := r.postComment(req, commentRequest, section); err != nil {
+		replyError(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// postComment submits the comment to the section, broadcasts the resulting
+// notifications and publishes the comment to the viewers of the thread. It
+// returns an error in case of the following:
 // - invalid section name, thread id or comment -> 404 NOT_FOUND
+// - section, thread or comment are unavailable -> SECTION_UNAVAILABLE
 // - network failures ---------------------------> INTERNAL_FAILURE
-func (r *Router) handleComment(w http.ResponseWriter, req *http.Request,
-	commentRequest *pbApi.CommentRequest, section pbApi.CrudCheropatillaClient) {
-	stream, err := section.Comment(context.Background(), commentRequest)
+func (r *Router) postComment(req *http.Request, commentRequest *pbApi.CommentRequest,
+	section Section) error {
+	// The notifications are received after the response is sent, so the request
+	// is not canceled along with the http request.
+	ctx, cancel := detachedContext(req, section.Timeout)
+	stream, err := section.Client.Comment(ctx, commentRequest)
 	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				// section, thread or comment not found
-				log.Printf("Could not find content: %v", resErr.Message())
-				http.NotFound(w, req)
-				return
-			default:
-				log.Printf("Unknown code %v: %s\n", resErr.Code(), resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-		return
+		cancel()
+		return sectionErrors.translate(ctx, "Comment", err)
 	}
 	// Call broadcastNotifs in a separate goroutine to collect the garbage in this
 	// handler
-	go r.broadcastNotifs(stream)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	r.broadcasts.Add(1)
+	go func() {
+		defer r.broadcasts.Done()
+		defer cancel()
+		if r.broadcastNotifs(ctx, stream) == nil {
+			r.publishComment(req, commentRequest, section)
+		}
+	}()
+	return nil
 }
 
-func (r *Router) broadcastNotifs(stream streamNotifs) {
+// broadcastNotifs sends the notifications received from the stream to the users
+// they are for. It returns the error that ended the stream, if any, in which
+// case the operation that started the stream may have failed. The notifications
+// are sent before it returns, so that Shutdown, which waits for its callers,
+// does not shut the hub down before they are sent.
+func (r *Router) broadcastNotifs(ctx context.Context, stream streamNotifs) error {
 	// Continuously receive notifications and the user ids they are for.
 	for {
 		notifyUser, err := stream.Recv()
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
-			log.Printf("Error receiving response from stream: %v\n", err)
-			break
+			logging.FromContext(ctx).Error("Error receiving notifications from stream",
+				"err", err)
+			return err
 		}
 		userId := notifyUser.UserId
 		notification := notifyUser.Notification
 		// send notification
-		go r.hub.Broadcast(userId, notification)
+		r.hub.Broadcast(userId, notification)
 	}
 }
 
@@ -330,88 +492,105 @@ func (r *Router) broadcastNotifs(stream streamNotifs) {
 // other handlers that perform the same operation, in this case, a content deletion, since
 // all the handlers that are called in a delete event share the same delete request
 // object. The duties of returning a response to the client are also delegated to
-// handleDelete, which returns OK on success or an error in case of the following:
-// - invalid section name or thread id ---> 404 NOT_FOUND
-// - user id and author id are not equal -> UNAUTHORIZED
-// - network failures --------------------> INTERNAL_FAILURE
+// handleDelete, which returns OK on success or the error returned by deleteContent.
 func (r *Router) handleDelete(w http.ResponseWriter, req *http.Request,
-	deleteRequest *pbApi.DeleteContentRequest, section pbApi.CrudCheropatillaClient) {
-	_, err := section.DeleteContent(context.Background(), deleteRequest)
-	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				// log for debugging
-				log.Printf("Could not find resource: %v\n", resErr.Message())
-				http.NotFound(w, req)
-				return
-			case codes.Unauthenticated:
-				log.Println(resErr.Message())
-				http.Error(w, "USER_UNAUTHORIZED", http.StatusUnauthorized)
-				return
-			default:
-				log.Printf("Unknown error code %v: %v", resErr.Code(),
-					resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+	deleteRequest *pbApi.DeleteContentRequest, section Section) {
+	ctx, cancel := sectionContext(req, section)
+	defer cancel()
+	if err := r.deleteContent(ctx, deleteRequest, section.Client); err != nil {
+		replyError(w, req, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
 
+// deleteContent submits the content deletion to the section. It returns an error
+// in case of the following:
+// - invalid section name or thread id ---> 404 NOT_FOUND
+// - user id and author id are not equal -> USER_UNAUTHORIZED
+// - network failures --------------------> INTERNAL_FAILURE
+func (r *Router) deleteContent(ctx context.Context,
+	deleteRequest *pbApi.DeleteContentRequest, section pbApi.CrudCheropatillaClient) error {
+	_, err := section.DeleteContent(ctx, deleteRequest)
+	if err != nil {
+		return deleteErrors.translate(ctx, "DeleteContent", err)
+	}
+	return nil
+}
+
 // handleUndoUpvote is an utility method to help reduce the repetition of similar code in
 // other handlers that perform the same operation, in this case, a content upvote undoing,
 // since all the handlers that are called in an unupvote event share the same unupvote
 // request object. The duties of returning a response to the client are also delegated to
-// handleUnupvote, which returns OK on success or an error in case of the following:
-// - invalid section name or thread id ------> 404 NOT_FOUND
-// - user did not upvote the content before -> NOT_UPVOTED
-// - network failures -----------------------> INTERNAL_FAILURE
+// handleUndoUpvote, which returns OK on success or the error returned by undoUpvote.
 func (r *Router) handleUndoUpvote(w http.ResponseWriter, req *http.Request,
-	undoUpvoteRequest *pbApi.UndoUpvoteRequest, section pbApi.CrudCheropatillaClient) {
-	_, err := section.UndoUpvote(context.Background(), undoUpvoteRequest)
-	if err != nil {
-		if resErr, ok := status.FromError(err); ok {
-			switch resErr.Code() {
-			case codes.NotFound:
-				// log for debugging
-				log.Printf("Could not find resource: %v\n", resErr.Message())
-				http.NotFound(w, req)
-				return
-			case codes.FailedPrecondition:
-				log.Println(resErr.Message())
-				http.Error(w, "NOT_UPVOTED", http.StatusBadRequest)
-				return
-			default:
-				log.Printf("Unknown error code %v: %v", resErr.Code(),
-					resErr.Message())
-				http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
-				return
-			}
-		}
-		log.Printf("Could not send request: %v\n", err)
-		http.Error(w, "INTERNAL_FAILURE", http.StatusInternalServerError)
+	undoUpvoteRequest *pbApi.UndoUpvoteRequest, section Section) {
+	ctx, cancel := sectionContext(req, section)
+	defer cancel()
+	if err := r.undoUpvote(ctx, undoUpvoteRequest, section.Client); err != nil {
+		replyError(w, req, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
 
+// undoUpvote submits the upvote undoing to the section and publishes the new
+// counters to the viewers of the content. It returns an error in case of the
+// following:
+// - invalid section name or thread id ------> 404 NOT_FOUND
+// - user did not upvote the content before -> NOT_UPVOTED
+// - network failures -----------------------> INTERNAL_FAILURE
+func (r *Router) undoUpvote(ctx context.Context,
+	undoUpvoteRequest *pbApi.UndoUpvoteRequest, section pbApi.CrudCheropatillaClient) error {
+	_, err := section.UndoUpvote(ctx, undoUpvoteRequest)
+	if err != nil {
+		return undoUpvoteErrors.translate(ctx, "UndoUpvote", err)
+	}
+	r.publishUpvote(undoUpvoteRequest.ContentContext, undoUpvoteRequest.UserId, -1)
+	return nil
+}
+
 // currentUser returns a string containing the current user id or an empty
-// string if the user is not logged in.
+// string if the user is not logged in or the session is no longer valid.
 func (r *Router) currentUser(req *http.Request) string {
+	// The session was already checked by the withSession middleware.
+	if userId, ok := req.Context().Value(sessionUserKey{}).(string); ok {
+		return userId
+	}
 	session, _ := r.store.Get(req, "session")
-	userId, ok := session.Values["user_id"].(string)
-	if !ok {
-		// User not logged in
-		return ""
+	return r.sessionUser(req, session)
+}
+
+// usersContext and generalContext return a context for a request to the users or
+// general service on behalf of the given http request. It is canceled if the
+// client goes away or the deadline of the service expires, and it must be
+// canceled as soon as the request to the service completes.
+func (r *Router) usersContext(req *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(req.Context(), r.usersTimeout)
+}
+
+func (r *Router) generalContext(req *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(req.Context(), r.generalTimeout)
+}
+
+// sectionContext returns a context for a request to the given section on behalf
+// of the given http request, as usersContext does.
+func sectionContext(req *http.Request, section Section) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(req.Context(), section.Timeout)
+}
+
+// detachedContext returns a context for a request to a service that outlives
+// the given http request. It carries the logger and the request id of req, but
+// it is not canceled along with it.
+func detachedContext(req *http.Request, timeout time.Duration) (context.Context,
+	context.CancelFunc) {
+	ctx := logging.NewContext(context.Background(), logFor(req))
+	if md, ok := metadata.FromOutgoingContext(req.Context()); ok {
+		ctx = metadata.NewOutgoingContext(ctx, md)
 	}
-	return userId
+	return context.WithTimeout(ctx, timeout)
 }
 
 // onlyUsers middleware displays the login page if the user has not logged in yet,
@@ -422,9 +601,16 @@ func (r *Router) onlyUsers(next func(string, http.ResponseWriter, *http.Request)
 		userId := r.currentUser(req)
 		if userId == "" {
 			// user has not logged in.
-			if err := r.templates.ExecuteTemplate(w, "login.html", nil); err != nil {
-				log.Printf("Could not execute template login.html: %v\n", err)
-				http.Error(w, "TEMPLATE_ERROR", http.StatusInternalServerError)
+			token, err := r.issueCSRFToken(req, w)
+			if err != nil {
+				logFor(req).Error("Could not save session", "err", err)
+				replyError(w, req, errCookie)
+				return
+			}
+			loginView := templates.LoginView{CSRFToken: token}
+			if err := r.templates.ExecuteTemplate(w, "login.html", loginView); err != nil {
+				logFor(req).Error("Could not execute template", "template", "login.html", "err", err)
+				replyError(w, req, errTemplate)
 			}
 			return
 		}
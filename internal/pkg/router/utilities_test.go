@@ -0,0 +1,250 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	pbTime "github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/gorilla/sessions"
+	pbApi "github.com/luisguve/cheroproto-go/cheroapi"
+	pbContext "github.com/luisguve/cheroproto-go/context"
+	pbDataFormat "github.com/luisguve/cheroproto-go/dataformat"
+	pbMetadata "github.com/luisguve/cheroproto-go/metadata"
+	pbUsers "github.com/luisguve/cheroproto-go/userapi"
+	"github.com/luisguve/cherosite/internal/pkg/livedata"
+	"github.com/luisguve/cherosite/internal/pkg/pagination"
+	"github.com/luisguve/cherosite/internal/pkg/templates"
+	"google.golang.org/grpc"
+)
+
+func TestWriteFeedHeaders(t *testing.T) {
+	toBytes := func([]*pbApi.ContentRule, string, bool) []byte {
+		return []byte("<div></div>")
+	}
+	tests := []struct {
+		name        string
+		accept      string
+		code        int
+		contentType string
+	}{
+		{"json partial", "application/json", http.StatusPartialContent, "application/json"},
+		{"html partial", "text/html", http.StatusPartialContent, "text/html"},
+		{"json ok", "application/json;q=0.9", http.StatusOK, "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/explore/recycle", nil)
+			req.Header.Set("Accept", tt.accept)
+			// The cookie of the session is set before the feed is written, as
+			// updateDiscardIdsSession does.
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "v"})
+
+			err := writeFeed(w, req, tt.code, templates.ContentsFeed{}, "", true, toBytes)
+			if err != nil {
+				t.Fatalf("writeFeed: %v", err)
+			}
+			res := w.Result()
+			if res.StatusCode != tt.code {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.code)
+			}
+			if got := res.Header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if got := res.Header.Get("Vary"); got != "Accept" {
+				t.Errorf("Vary = %q, want Accept", got)
+			}
+			if res.Header.Get("Content-Length") == "" {
+				t.Error("Content-Length not set")
+			}
+			if len(res.Cookies()) != 1 {
+				t.Errorf("cookies = %v, want the cookie of the session", res.Cookies())
+			}
+		})
+	}
+}
+
+// fakeSection is a section service that recycles threads it has not returned
+// before and records the threads it is told to discard.
+type fakeSection struct {
+	pbApi.CrudCheropatillaClient
+	sectionId string
+	// arrivals, if set, holds the recycles until all of them arrived.
+	arrivals *sync.WaitGroup
+
+	mu       sync.Mutex
+	returned map[string]bool
+	next     int
+	// unknown are the discarded threads that were never returned.
+	unknown []string
+	// discarded are the threads discarded by the last recycle.
+	discarded []string
+}
+
+func (f *fakeSection) RecycleContent(ctx context.Context, in *pbApi.ContentPattern,
+	opts ...grpc.CallOption) (pbApi.CrudCheropatilla_RecycleContentClient, error) {
+	if f.arrivals != nil {
+		f.arrivals.Done()
+		f.arrivals.Wait()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, id := range in.DiscardIds {
+		if !f.returned[id] {
+			f.unknown = append(f.unknown, id)
+		}
+	}
+	f.discarded = in.DiscardIds
+	stream := &feedStream{}
+	for i := 0; i < 3; i++ {
+		f.next++
+		id := fmt.Sprintf("t%d", f.next)
+		f.returned[id] = true
+		stream.contents = append(stream.contents, &pbApi.ContentRule{
+			Data: &pbApi.ContentData{
+				Content: &pbApi.Content{
+					Title:       id,
+					PublishDate: &pbTime.Timestamp{},
+				},
+				Author: &pbDataFormat.BasicUserData{},
+				Metadata: &pbMetadata.Content{
+					Id:        id,
+					SectionId: f.sectionId,
+				},
+			},
+			ContentContext: &pbApi.ContentRule_ThreadCtx{&pbContext.Thread{
+				Id:         id,
+				SectionCtx: &pbContext.Section{Id: f.sectionId},
+			}},
+		})
+	}
+	return stream, nil
+}
+
+// feedStream is a stream of the contents of a feed.
+type feedStream struct {
+	grpc.ClientStream
+	contents []*pbApi.ContentRule
+}
+
+func (s *feedStream) Recv() (*pbApi.ContentRule, error) {
+	if len(s.contents) == 0 {
+		return nil, io.EOF
+	}
+	c := s.contents[0]
+	s.contents = s.contents[1:]
+	return c, nil
+}
+
+type fakeUsers struct{ pbUsers.CrudUsersClient }
+
+type fakeGeneral struct{ pbApi.CrudGeneralClient }
+
+func TestConcurrentRecycles(t *testing.T) {
+	const (
+		sectionId = "mylife"
+		recycles  = 16
+	)
+	section := &fakeSection{sectionId: sectionId, returned: make(map[string]bool)}
+	store := sessions.NewFilesystemStore(t.TempDir(),
+		[]byte("0123456789abcdef0123456789abcdef"))
+	users := fakeUsers{}
+	r := New(template.New("cherosite"), users, fakeGeneral{},
+		[]Section{{
+			Client:  section,
+			Id:      sectionId,
+			Name:    "My Life",
+			Timeout: time.Second,
+		}},
+		store, livedata.NewHub(users, time.Second, nil, livedata.Options{}), []string{"pic.png"},
+		Options{
+			TokenKey:       []byte("0123456789abcdef0123456789abcdef"),
+			TokenLifetime:  time.Hour,
+			UsersTimeout:   time.Second,
+			GeneralTimeout: time.Second,
+			DiscardLimits: &pagination.Limits{
+				MaxIds:      10 * recycles,
+				MaxContexts: 10,
+				MaxAge:      time.Hour,
+			},
+		})
+	r.SetupRoutes("upload", "static")
+
+	// The session exists, but has no key to the SeenStore yet, so every
+	// recycle races to set one once all of them read the session.
+	req := httptest.NewRequest("GET", "/"+sectionId, nil)
+	w := httptest.NewRecorder()
+	session, _ := store.Get(req, "session")
+	if err := session.Save(req, w); err != nil {
+		t.Fatal(err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	recycle := func() {
+		req := httptest.NewRequest("GET", "/"+sectionId+"/recycle", nil)
+		req.Header.Set("Accept", "application/json")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("recycle: status = %d, want 200", w.Code)
+		}
+	}
+	var wg sync.WaitGroup
+	section.arrivals = new(sync.WaitGroup)
+	section.arrivals.Add(recycles)
+	for i := 0; i < recycles; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recycle()
+		}()
+	}
+	wg.Wait()
+	if len(section.unknown) > 0 {
+		t.Errorf("discarded threads never returned: %v", section.unknown)
+	}
+
+	// The next recycle must discard every thread returned so far.
+	section.arrivals = nil
+	want := make(map[string]bool)
+	for id := range section.returned {
+		want[id] = true
+	}
+	recycle()
+	seen := make(map[string]bool)
+	for _, id := range section.discarded {
+		if seen[id] {
+			t.Errorf("thread %s discarded twice", id)
+		}
+		seen[id] = true
+	}
+	for id := range want {
+		if !seen[id] {
+			t.Errorf("thread %s lost", id)
+		}
+	}
+}
+
+func TestSessionLock(t *testing.T) {
+	r := &Router{}
+	if r.sessionLock("a") != r.sessionLock("a") {
+		t.Error("the same session got different locks")
+	}
+	// Sessions share a fixed number of locks, so some ids collide, but not
+	// all of them.
+	locks := make(map[*sync.Mutex]bool)
+	for i := 0; i < 1000; i++ {
+		locks[r.sessionLock(fmt.Sprint(i))] = true
+	}
+	if len(locks) < 2 || len(locks) > len(r.sessionLocks) {
+		t.Errorf("%d distinct locks for 1000 sessions", len(locks))
+	}
+}
@@ -0,0 +1,86 @@
+package sessionstore
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileBackend is a Backend that keeps every entry in a file in a directory,
+// named after the hex encoding of its id. Expired entries are removed when they
+// are loaded.
+type FileBackend struct {
+	dir string
+}
+
+// NewFileBackend returns a FileBackend that keeps the entries in dir, creating
+// it if it does not exist.
+func NewFileBackend(dir string) (*FileBackend, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileBackend{dir: dir}, nil
+}
+
+// Every file starts with the expiration time of the entry, in nanoseconds since
+// the Unix epoch, or zero if it never expires.
+const expiresLen = 8
+
+func (f *FileBackend) Load(id string) ([]byte, error) {
+	b, err := ioutil.ReadFile(f.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(b) < expiresLen {
+		return nil, nil
+	}
+	expires := int64(binary.BigEndian.Uint64(b))
+	if expires != 0 && time.Now().UnixNano() > expires {
+		if err := os.Remove(f.path(id)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return b[expiresLen:], nil
+}
+
+func (f *FileBackend) Save(id string, data []byte, ttl time.Duration) error {
+	b := make([]byte, expiresLen, expiresLen+len(data))
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(b, uint64(time.Now().Add(ttl).UnixNano()))
+	}
+	b = append(b, data...)
+	// Write to a temporary file and rename it, so that the entry is never left
+	// half written.
+	tmp, err := ioutil.TempFile(f.dir, "tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path(id))
+}
+
+func (f *FileBackend) Delete(id string) error {
+	if err := os.Remove(f.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *FileBackend) path(id string) string {
+	return filepath.Join(f.dir, hex.EncodeToString([]byte(id)))
+}
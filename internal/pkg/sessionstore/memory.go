@@ -0,0 +1,77 @@
+package sessionstore
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is the number of saves between sweeps of the expired sessions
+// of a MemoryBackend.
+const sweepInterval = 1000
+
+// MemoryBackend is a Backend that keeps the sessions in memory. The sessions are
+// lost when the process exits and are not shared with other instances of the
+// site, so it is only suitable for development and single instances.
+type MemoryBackend struct {
+	mu       sync.Mutex
+	sessions map[string]memorySession
+	saves    int
+}
+
+type memorySession struct {
+	data []byte
+	// expires is zero if the session never expires.
+	expires time.Time
+}
+
+// NewMemoryBackend returns an empty MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{sessions: make(map[string]memorySession)}
+}
+
+func (m *MemoryBackend) Load(id string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	if s.expired(time.Now()) {
+		delete(m.sessions, id)
+		return nil, nil
+	}
+	return s.data, nil
+}
+
+func (m *MemoryBackend) Save(id string, data []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := memorySession{data: append([]byte(nil), data...)}
+	if ttl > 0 {
+		s.expires = time.Now().Add(ttl)
+	}
+	m.sessions[id] = s
+
+	// Remove the expired sessions that are never loaded again.
+	m.saves++
+	if m.saves%sweepInterval == 0 {
+		now := time.Now()
+		for id, s := range m.sessions {
+			if s.expired(now) {
+				delete(m.sessions, id)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+func (s memorySession) expired(now time.Time) bool {
+	return !s.expires.IsZero() && now.After(s.expires)
+}
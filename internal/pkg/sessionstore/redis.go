@@ -0,0 +1,124 @@
+package sessionstore
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/luisguve/cherosite/internal/pkg/resp"
+)
+
+// RedisOptions holds the settings of a RedisBackend.
+type RedisOptions struct {
+	// Addr is the address of the server, e.g. "localhost:6379".
+	Addr string
+	// Password is sent with AUTH if it is not empty.
+	Password string
+	// DB is the number of the database selected with SELECT.
+	DB int
+	// Prefix is added to the session ids to make the keys, e.g. "session:".
+	Prefix string
+	// Timeout is the deadline of every command, including dialing. It defaults
+	// to 5 seconds.
+	Timeout time.Duration
+	// MaxIdle is the maximum number of idle connections kept. It defaults to 8.
+	MaxIdle int
+}
+
+// RedisBackend is a Backend that keeps the sessions in a server that speaks the
+// Redis protocol (RESP), such as Redis, KeyDB or Valkey. It only uses the
+// commands GET, SET with PX, DEL, AUTH and SELECT.
+type RedisBackend struct {
+	opts RedisOptions
+	idle chan *resp.Conn
+}
+
+// NewRedisBackend returns a RedisBackend with the given options. Connections are
+// opened when they are needed.
+func NewRedisBackend(opts RedisOptions) *RedisBackend {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = 8
+	}
+	return &RedisBackend{
+		opts: opts,
+		idle: make(chan *resp.Conn, opts.MaxIdle),
+	}
+}
+
+func (b *RedisBackend) Load(id string) ([]byte, error) {
+	res, err := b.do("GET", b.opts.Prefix+id)
+	if err != nil || res == nil {
+		return nil, err
+	}
+	data, ok := res.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply to GET: %T", res)
+	}
+	return data, nil
+}
+
+func (b *RedisBackend) Save(id string, data []byte, ttl time.Duration) error {
+	args := []string{"SET", b.opts.Prefix + id, string(data)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	}
+	_, err := b.do(args...)
+	return err
+}
+
+func (b *RedisBackend) Delete(id string) error {
+	_, err := b.do("DEL", b.opts.Prefix+id)
+	return err
+}
+
+// Close closes the idle connections.
+func (b *RedisBackend) Close() error {
+	for {
+		select {
+		case c := <-b.idle:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do sends the command made of args through an idle connection, or a new one if
+// there is none, and returns the reply.
+func (b *RedisBackend) do(args ...string) (interface{}, error) {
+	var c *resp.Conn
+	select {
+	case c = <-b.idle:
+	default:
+		var err error
+		if c, err = b.dial(); err != nil {
+			return nil, err
+		}
+	}
+	res, err := c.Do(b.opts.Timeout, args...)
+	var redisErr resp.Error
+	if err != nil && !errors.As(err, &redisErr) {
+		// The state of the connection is unknown.
+		c.Close()
+		return nil, err
+	}
+	select {
+	case b.idle <- c:
+	default:
+		c.Close()
+	}
+	return res, err
+}
+
+func (b *RedisBackend) dial() (*resp.Conn, error) {
+	return resp.Dial(resp.Options{
+		Addr:     b.opts.Addr,
+		Password: b.opts.Password,
+		DB:       b.opts.DB,
+		Timeout:  b.opts.Timeout,
+	})
+}
@@ -0,0 +1,238 @@
+package sessionstore
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/luisguve/cherosite/internal/pkg/resp"
+	"github.com/luisguve/cherosite/internal/pkg/resp/resptest"
+)
+
+func newRedisBackend(t *testing.T) (*RedisBackend, *resptest.Server) {
+	t.Helper()
+	s, err := resptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Password = "secret"
+	b := NewRedisBackend(RedisOptions{
+		Addr:     s.Addr,
+		Password: "secret",
+		DB:       2,
+		Prefix:   "session:",
+		Timeout:  time.Second,
+	})
+	t.Cleanup(func() {
+		b.Close()
+		s.Close()
+	})
+	return b, s
+}
+
+func TestRedisBackend(t *testing.T) {
+	b, s := newRedisBackend(t)
+
+	if data, err := b.Load("id"); err != nil || data != nil {
+		t.Fatalf("Load of a missing session = %q, %v", data, err)
+	}
+	if err := b.Save("id", []byte("values"), time.Minute); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if v, ok := s.Get(2, "session:id"); !ok || v != "values" {
+		t.Fatalf("key in DB 2 = %q, %v; want the values under the prefix", v, ok)
+	}
+	if ttl := s.TTL(2, "session:id"); ttl != time.Minute {
+		t.Errorf("TTL = %v, want 1m", ttl)
+	}
+	if data, err := b.Load("id"); err != nil || string(data) != "values" {
+		t.Fatalf("Load = %q, %v", data, err)
+	}
+
+	// A session saved without ttl never expires.
+	if err := b.Save("forever", []byte("v"), 0); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	s.FastForward(time.Hour)
+	if data, err := b.Load("id"); err != nil || data != nil {
+		t.Errorf("Load of an expired session = %q, %v", data, err)
+	}
+	if data, err := b.Load("forever"); err != nil || string(data) != "v" {
+		t.Errorf("Load = %q, %v", data, err)
+	}
+
+	if err := b.Delete("forever"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if data, err := b.Load("forever"); err != nil || data != nil {
+		t.Errorf("Load of a deleted session = %q, %v", data, err)
+	}
+	if err := b.Delete("missing"); err != nil {
+		t.Errorf("Delete of a missing session: %v", err)
+	}
+
+	// The connection is authenticated and selects the DB once, and then it is
+	// reused.
+	auths := 0
+	for _, cmd := range s.Commands() {
+		if cmd == "AUTH" || cmd == "SELECT" {
+			auths++
+		}
+	}
+	if auths != 2 {
+		t.Errorf("commands = %v, want a single connection", s.Commands())
+	}
+}
+
+func TestRedisBackendErrors(t *testing.T) {
+	b, s := newRedisBackend(t)
+
+	s.Fail("SET", "OOM command not allowed when used memory > 'maxmemory'")
+	err := b.Save("id", []byte("values"), time.Minute)
+	var redisErr resp.Error
+	if !errors.As(err, &redisErr) {
+		t.Fatalf("Save = %v, want the error replied", err)
+	}
+	s.Fail("SET", "")
+	// The connection of an error reply is still usable.
+	if err := b.Save("id", []byte("values"), time.Minute); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// A lost connection fails the command and is replaced by the next one.
+	s.CloseConns()
+	if _, err := b.Load("id"); err == nil {
+		t.Fatal("Load through a lost connection succeeded")
+	}
+	if data, err := b.Load("id"); err != nil || string(data) != "values" {
+		t.Errorf("Load after the connection was lost = %q, %v", data, err)
+	}
+
+	wrong := NewRedisBackend(RedisOptions{Addr: s.Addr, Password: "wrong", Timeout: time.Second})
+	defer wrong.Close()
+	if _, err := wrong.Load("id"); !errors.As(err, &redisErr) {
+		t.Errorf("Load with the wrong password = %v, want the error replied", err)
+	}
+}
+
+func TestRedisRegistry(t *testing.T) {
+	b, s := newRedisBackend(t)
+	r := NewRegistry(b)
+	now := time.Now()
+
+	if err := r.Add("u1", "s1", now.Add(time.Minute)); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := r.Add("u1", "s2", now.Add(time.Hour)); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := r.Add("u2", "s3", now.Add(time.Hour)); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	contains := func(userId, sid string) bool {
+		t.Helper()
+		ok, err := r.Contains(userId, sid)
+		if err != nil {
+			t.Fatalf("Contains: %v", err)
+		}
+		return ok
+	}
+	if !contains("u1", "s1") || !contains("u1", "s2") || !contains("u2", "s3") {
+		t.Fatal("registered session not contained")
+	}
+	if contains("u1", "s3") {
+		t.Error("session contained for another user")
+	}
+	// The sessions of a user are kept until the last of them expires.
+	if ttl := s.TTL(2, "session:user:u1"); ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("TTL = %v, want about 1h", ttl)
+	}
+
+	// An expired session is no longer contained, even if the key lives on.
+	if err := r.Add("u1", "old", now.Add(-time.Second)); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if contains("u1", "old") {
+		t.Error("expired session contained")
+	}
+
+	if err := r.Remove("u1", "s1"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if contains("u1", "s1") || !contains("u1", "s2") {
+		t.Error("Remove removed the wrong sessions")
+	}
+	if err := r.RemoveAll("u1"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	if contains("u1", "s2") || !contains("u2", "s3") {
+		t.Error("RemoveAll removed the wrong sessions")
+	}
+
+	// The key expires along with the last session.
+	s.FastForward(time.Hour)
+	if _, ok := s.Get(2, "session:user:u2"); ok {
+		t.Error("key of the sessions of u2 outlived them")
+	}
+}
+
+func TestRedisKeyRotation(t *testing.T) {
+	b, _ := newRedisBackend(t)
+	oldKey := []byte("old key of the sessions, 32 byte")
+	newKey := []byte("new key of the sessions, 32 byte")
+
+	old := New(b, oldKey, nil)
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	session, err := old.New(req, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["user_id"] = "u1"
+	if err := session.Save(req, w); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cookie := w.Result().Cookies()[0]
+	oldSession := session
+
+	load := func(s *Store) (*sessions.Session, error) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(cookie)
+		session, err := s.New(req, "session")
+		if err != nil {
+			return nil, err
+		}
+		if session.IsNew || session.Values["user_id"] != "u1" {
+			return nil, errors.New("session not found")
+		}
+		return session, nil
+	}
+
+	// The new key signs the cookies and the old one is still accepted.
+	rotated := New(b, newKey, nil, oldKey, nil)
+	session, err = load(rotated)
+	if err != nil {
+		t.Fatalf("cookie signed with the old key: %v", err)
+	}
+	w = httptest.NewRecorder()
+	if err := session.Save(req, w); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	resigned := w.Result().Cookies()[0]
+	if _, err := load(New(b, newKey, nil)); err == nil {
+		t.Error("cookie signed with the old key accepted after the key was removed")
+	}
+
+	// The session saved again keeps its id and is signed with the new key.
+	cookie = resigned
+	if session, err := load(New(b, newKey, nil)); err != nil {
+		t.Errorf("cookie signed with the new key: %v", err)
+	} else if session.ID != oldSession.ID {
+		t.Errorf("session id = %q, want %q", session.ID, oldSession.ID)
+	}
+	if _, err := load(old); err == nil {
+		t.Error("cookie signed with the new key accepted by the old key")
+	}
+}
@@ -0,0 +1,126 @@
+package sessionstore
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Registry keeps the sessions logged in by every user, so that a session is
+// valid only while it is registered and the sessions of a user can be revoked
+// all at once, whatever store keeps their values.
+type Registry interface {
+	// Add registers the session sid of the user until it expires.
+	Add(userId, sid string, expires time.Time) error
+	// Contains reports whether the session sid of the user is registered and
+	// has not expired.
+	Contains(userId, sid string) (bool, error)
+	// Remove unregisters the session sid of the user, if it is registered.
+	Remove(userId, sid string) error
+	// RemoveAll unregisters every session of the user.
+	RemoveAll(userId string) error
+}
+
+// BackendRegistry is a Registry that keeps the sessions of every user in a
+// Backend. The sessions of a user are updated by reading and writing them back,
+// so updates of the same user from several instances of the site sharing the
+// backend may race; the updates of a single instance are serialized.
+type BackendRegistry struct {
+	mu      sync.Mutex
+	backend Backend
+}
+
+// NewRegistry returns a Registry that keeps the sessions of every user in b,
+// under the key "user:" followed by the id of the user.
+func NewRegistry(b Backend) *BackendRegistry {
+	return &BackendRegistry{backend: b}
+}
+
+func (r *BackendRegistry) Add(userId, sid string, expires time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions, err := r.load(userId)
+	if err != nil {
+		return err
+	}
+	sessions[sid] = expires
+	return r.save(userId, sessions)
+}
+
+func (r *BackendRegistry) Contains(userId, sid string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions, err := r.load(userId)
+	if err != nil {
+		return false, err
+	}
+	_, ok := sessions[sid]
+	return ok, nil
+}
+
+func (r *BackendRegistry) Remove(userId, sid string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions, err := r.load(userId)
+	if err != nil {
+		return err
+	}
+	if _, ok := sessions[sid]; !ok {
+		return nil
+	}
+	delete(sessions, sid)
+	return r.save(userId, sessions)
+}
+
+func (r *BackendRegistry) RemoveAll(userId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.backend.Delete(registryKey(userId))
+}
+
+// load returns the sessions of the user that have not expired, by session id.
+// r.mu must be held.
+func (r *BackendRegistry) load(userId string) (map[string]time.Time, error) {
+	sessions := make(map[string]time.Time)
+	data, err := r.backend.Load(registryKey(userId))
+	if err != nil || data == nil {
+		return sessions, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&sessions); err != nil {
+		return nil, fmt.Errorf("could not decode sessions of user: %w", err)
+	}
+	now := time.Now()
+	for sid, expires := range sessions {
+		if now.After(expires) {
+			delete(sessions, sid)
+		}
+	}
+	return sessions, nil
+}
+
+// save saves the sessions of the user until the last of them expires, or
+// deletes them if there are none. r.mu must be held.
+func (r *BackendRegistry) save(userId string, sessions map[string]time.Time) error {
+	key := registryKey(userId)
+	var last time.Time
+	for _, expires := range sessions {
+		if expires.After(last) {
+			last = expires
+		}
+	}
+	ttl := time.Until(last)
+	if ttl <= 0 {
+		return r.backend.Delete(key)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(sessions); err != nil {
+		return fmt.Errorf("could not encode sessions of user: %w", err)
+	}
+	return r.backend.Save(key, buf.Bytes(), ttl)
+}
+
+func registryKey(userId string) string {
+	return "user:" + userId
+}
@@ -0,0 +1,151 @@
+// Package sessionstore implements a gorilla/sessions store that keeps the values
+// of the sessions on the server, in a pluggable Backend, and only a signed
+// session id in the cookie, so that several instances of the site can share the
+// sessions.
+package sessionstore
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Backend keeps the encoded values of the sessions by session id.
+type Backend interface {
+	// Load returns the data saved under id, or nil if there is none or it has
+	// expired.
+	Load(id string) ([]byte, error)
+	// Save saves data under id. It expires after ttl, or never if ttl is zero.
+	Save(id string, data []byte, ttl time.Duration) error
+	// Delete removes the data saved under id, if any.
+	Delete(id string) error
+}
+
+// defaultMaxAge is the max age of the cookies of the sessions, in seconds.
+const defaultMaxAge = 86400 * 30
+
+// Store is a sessions.Store backed by a Backend.
+type Store struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	backend Backend
+}
+
+// New returns a Store that keeps the sessions in b and signs the cookies with
+// the given key pairs, as in sessions.NewCookieStore: every pair is made of a
+// hash key and an optional block key. The first pair is used to sign the
+// cookies and every pair is tried to verify them, so keys can be rotated by
+// adding the new pair first.
+func New(b Backend, keyPairs ...[]byte) *Store {
+	s := &Store{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: defaultMaxAge,
+		},
+		backend: b,
+	}
+	s.MaxAge(s.Options.MaxAge)
+	return s
+}
+
+// Get returns the session of the given name registered for the request, reading
+// it from the backend the first time.
+func (s *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New reads the session of the given name from the backend. It returns a new
+// session if the request has no cookie or the session expired, and a new session
+// along with an error if the cookie is not valid or the backend fails.
+func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, c.Value, &id, s.Codecs...); err != nil {
+		return session, err
+	}
+	data, err := s.backend.Load(id)
+	if err != nil || data == nil {
+		return session, err
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+// Save saves the values of the session in the backend and sets the cookie with
+// its id. If the max age of the session is negative, the session is removed
+// from the backend and the cookie is deleted.
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.Delete(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	if session.ID == "" {
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+	data, err := (securecookie.GobEncoder{}).Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if ttl == 0 {
+		// The cookie lasts as long as the browser session; keep the values as
+		// long as the cookies that set a max age.
+		ttl = time.Duration(s.Options.MaxAge) * time.Second
+	}
+	if err := s.backend.Save(session.ID, data, ttl); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// MaxAge sets the max age of the cookies and of the signatures of the session
+// ids, in seconds.
+func (s *Store) MaxAge(age int) {
+	s.Options.MaxAge = age
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+// newID returns a random session id.
+func newID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(b), "="), nil
+}
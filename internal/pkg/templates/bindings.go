@@ -2,7 +2,6 @@ package templates
 
 import (
 	"fmt"
-	"log"
 	"strings"
 	"sync"
 	"time"
@@ -156,7 +155,7 @@ func SubcommentsToBytes(feed []*pbApi.ContentRule, userId string) []byte {
 
 	for idx, pbRule := range feed {
 		if pbRule.Data == nil {
-			log.Println("SubcommentsToBytes: pbRule has no content.")
+			logger.Warn("SubcommentsToBytes: pbRule has no content")
 			continue
 		}
 		wg.Add(1)
@@ -185,7 +184,7 @@ func FeedToBytes(feed []*pbApi.ContentRule, userId string, showSection bool) []b
 
 	for idx, pbRule := range feed {
 		if pbRule.Data == nil {
-			log.Println("FeedToBytes: pbRule has no content.")
+			logger.Warn("FeedToBytes: pbRule has no content")
 			continue
 		}
 		wg.Add(1)
@@ -214,7 +213,7 @@ func FeedToContentBytes(feed []*pbApi.ContentRule, userId string, showSection bo
 
 	for idx, pbRule := range feed {
 		if pbRule.Data == nil {
-			log.Println("FeedToBytes: pbRule has no content.")
+			logger.Warn("FeedToBytes: pbRule has no content")
 			continue
 		}
 		wg.Add(1)
@@ -393,7 +392,7 @@ func setBasicUserData(userData *pbDataFormat.BasicUserData) BasicUserData {
 
 func contentToContentRenderer(pbData *pbApi.ContentData, userId string) ContentRenderer {
 	if pbData == nil {
-		log.Println("pbData has no data")
+		logger.Warn("pbData has no data")
 		return &NoContent{}
 	}
 	pbRule := &pbApi.ContentRule{
@@ -482,7 +481,7 @@ func commentsToOverviewRendererSet(pbRuleSet []*pbApi.ContentRule, userId string
 			defer wg.Done()
 			ovwRenderer, err := formatCommentContent(pbRule, userId)
 			if err != nil {
-				log.Println(err)
+				logger.Error("Could not format comment", "err", err)
 				ovwRenderer = &NoContent{}
 			}
 			ovwRendererSet[idx] = ovwRenderer
@@ -494,7 +493,7 @@ func commentsToOverviewRendererSet(pbRuleSet []*pbApi.ContentRule, userId string
 
 func contentToPageOverviewRenderer(pbRule *pbApi.ContentRule, userId string) OverviewRenderer {
 	if pbRule.Data == nil {
-		log.Println("pbRule has no content")
+		logger.Warn("pbRule has no content")
 		return &NoContent{}
 	}
 
@@ -570,7 +569,7 @@ func contentToPageOverviewRenderer(pbRule *pbApi.ContentRule, userId string) Ove
 
 func contentToOverviewRenderer(pbRule *pbApi.ContentRule, userId string) OverviewRenderer {
 	if pbRule.Data == nil {
-		log.Println("pbRule has no content")
+		logger.Warn("pbRule has no content")
 		return &NoContent{}
 	}
 
@@ -641,7 +640,7 @@ func contentToOverviewRenderer(pbRule *pbApi.ContentRule, userId string) Overvie
 
 func subcommentToContentRenderer(pbRule *pbApi.ContentRule, userId string) ContentRenderer {
 	if pbRule.Data == nil {
-		log.Println("pbRule has no content")
+		logger.Warn("pbRule has no content")
 		return &NoContent{}
 	}
 
@@ -655,7 +654,8 @@ func subcommentToContentRenderer(pbRule *pbApi.ContentRule, userId string) Conte
 	// subcomment context
 	ctx, ok := pbRule.ContentContext.(*pbApi.ContentRule_SubcommentCtx)
 	if !ok {
-		log.Printf("Failed type assertion to *pbApi.ContentRule_SubcommentCtx: %t\n", pbRule.ContentContext)
+		logger.Error("Failed type assertion to *pbApi.ContentRule_SubcommentCtx",
+			"type", fmt.Sprintf("%T", pbRule.ContentContext))
 		return &NoContent{}
 	}
 	subcCtx := ctx.SubcommentCtx
@@ -694,7 +694,7 @@ func contentsToOverviewRendererSet(pbRuleSet []*pbApi.ContentRule, userId string
 // *pbApi.ContentRule. userId is used to check whether the user has upvoted the content.
 func setBasicContent(pbRule *pbApi.ContentRule, userId string) *BasicContent {
 	if pbRule.Data == nil {
-		log.Println("pbRule has no data")
+		logger.Warn("pbRule has no data")
 		return &BasicContent{}
 	}
 	author := pbRule.Data.Author
@@ -0,0 +1,153 @@
+package templates
+
+import (
+	"encoding/json"
+
+	pbApi "github.com/luisguve/cheroproto-go/cheroapi"
+)
+
+// FeedSchemaVersion is the version of the JSON representation of feeds. It must
+// be increased whenever a field is removed or changes its meaning; adding new
+// fields does not require a new version.
+const FeedSchemaVersion = 1
+
+// FeedJSON is the JSON representation of a page feed.
+type FeedJSON struct {
+	Version  int           `json:"version"`
+	Contents []ContentJSON `json:"contents"`
+	// Exhausted is set if every content available was already seen, in which
+	// case Reset is the link to start the pagination over.
+	Exhausted bool   `json:"exhausted,omitempty"`
+	Reset     string `json:"reset,omitempty"`
+}
+
+// ContentJSON is the JSON representation of a thread, a comment or a subcomment.
+type ContentJSON struct {
+	Kind        string      `json:"kind"` // thread, comment or subcomment
+	Id          string      `json:"id"`
+	ThreadId    string      `json:"thread_id"`
+	CommentId   string      `json:"comment_id,omitempty"` // only for subcomments
+	Status      string      `json:"status"`               // NEW, REL or TOP
+	Title       string      `json:"title"`
+	Content     string      `json:"content"`
+	Thumbnail   string      `json:"thumbnail,omitempty"`
+	Permalink   string      `json:"permalink"`
+	PublishDate int64       `json:"publish_date"` // Unix time in seconds
+	Upvotes     uint32      `json:"upvotes"`
+	Upvoted     bool        `json:"upvoted"`
+	Replies     uint32      `json:"replies"`
+	Saved       bool        `json:"saved"`
+	Section     SectionJSON `json:"section"`
+	Author      AuthorJSON  `json:"author"`
+	Links       LinksJSON   `json:"links"`
+}
+
+type SectionJSON struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type AuthorJSON struct {
+	Id       string `json:"id"`
+	Alias    string `json:"alias"`
+	Username string `json:"username"`
+}
+
+// LinksJSON holds the URLs to interact with a content. Links that do not apply
+// to the kind of content, such as save links for comments, are omitted.
+type LinksJSON struct {
+	Thread     string `json:"thread"`
+	Section    string `json:"section"`
+	Upvote     string `json:"upvote"`
+	UndoUpvote string `json:"undo_upvote"`
+	Save       string `json:"save,omitempty"`
+	UndoSave   string `json:"undo_save,omitempty"`
+	Reply      string `json:"reply,omitempty"`
+}
+
+// FeedToJSON converts the feed into its JSON representation. userId is used to
+// check whether the user has upvoted or saved each content.
+func FeedToJSON(feed []*pbApi.ContentRule, userId string) ([]byte, error) {
+	result := FeedJSON{
+		Version:  FeedSchemaVersion,
+		Contents: make([]ContentJSON, 0, len(feed)),
+	}
+	for _, pbRule := range feed {
+		if pbRule.Data == nil {
+			logger.Warn("FeedToJSON: pbRule has no content")
+			continue
+		}
+		result.Contents = append(result.Contents, contentToJSON(pbRule, userId))
+	}
+	return json.Marshal(result)
+}
+
+// contentToJSON converts a *pbApi.ContentRule into a ContentJSON. It takes the
+// links from the page level OverviewRenderer of the content, so that they are
+// the same as the ones in the HTML representation.
+func contentToJSON(pbRule *pbApi.ContentRule, userId string) ContentJSON {
+	author := pbRule.Data.Author
+	content := pbRule.Data.Content
+	metadata := pbRule.Data.Metadata
+
+	c := ContentJSON{
+		ThreadId:  metadata.Id,
+		Status:    pbRule.Status,
+		Title:     content.Title,
+		Content:   content.Content,
+		Thumbnail: content.FtFile,
+		Permalink: metadata.Permalink,
+		Upvotes:   metadata.Upvotes,
+		Replies:   metadata.Replies,
+		Section: SectionJSON{
+			Id:   metadata.SectionId,
+			Name: metadata.Section,
+		},
+		Author: AuthorJSON{
+			Id:       author.Id,
+			Alias:    author.Alias,
+			Username: author.Username,
+		},
+	}
+	if content.PublishDate != nil {
+		c.PublishDate = content.PublishDate.Seconds
+	}
+
+	switch ovw := contentToPageOverviewRenderer(pbRule, userId).(type) {
+	case *Thread:
+		c.Kind = "thread"
+		c.Id = metadata.Id
+		c.Saved = ovw.Saved
+		c.Links = basicLinks(ovw.BasicContent)
+		c.Links.Reply = ovw.ReplyLink
+		if ovw.ShowSaveOption {
+			c.Links.Save = ovw.SaveLink
+			c.Links.UndoSave = ovw.UndoSaveLink
+		}
+		c.Upvoted = ovw.Upvoted
+	case *CommentContent:
+		c.Kind = "comment"
+		c.Id = ovw.Id
+		c.Links = basicLinks(ovw.BasicContent)
+		c.Links.Reply = ovw.ReplyLink
+		c.Upvoted = ovw.Upvoted
+	case *SubcommentView:
+		c.Kind = "subcomment"
+		c.Id = ovw.Id
+		c.CommentId = ovw.CommentId
+		// Subcomments have no replies of their own.
+		c.Replies = 0
+		c.Links = basicLinks(ovw.BasicContent)
+		c.Upvoted = ovw.Upvoted
+	}
+	return c
+}
+
+func basicLinks(bc *BasicContent) LinksJSON {
+	return LinksJSON{
+		Thread:     bc.ThreadLink,
+		Section:    bc.SectionLink,
+		Upvote:     bc.UpvoteLink,
+		UndoUpvote: bc.UndoUpvoteLink,
+	}
+}
@@ -15,7 +15,6 @@ package templates
 import (
 	"fmt"
 	"html/template"
-	"log"
 	"net/url"
 	"os"
 	"path"
@@ -23,12 +22,16 @@ import (
 	"strings"
 
 	pbApi "github.com/luisguve/cheroproto-go/cheroapi"
+	"github.com/luisguve/cherosite/internal/pkg/logging"
 	pag "github.com/luisguve/cherosite/internal/pkg/pagination"
 )
 
 var baseURL *url.URL
 var tpl *template.Template
 
+// logger is the logger of the package, set up in Setup.
+var logger = logging.Default()
+
 func mustParseTemplates(dir string) *template.Template {
 	templ := template.New("")
 	filepath.Walk(dir, func(path string, _ os.FileInfo, err error) error {
@@ -51,7 +54,7 @@ func mustParseTemplates(dir string) *template.Template {
 func absURL(in string) string {
 	url, err := url.Parse(in)
 	if err != nil {
-		log.Printf("Could not parse %s: %v\n", in, err)
+		logger.Warn("Could not parse URL", "url", in, "err", err)
 		return in
 	}
 	if url.IsAbs() || strings.HasPrefix(in, "//") {
@@ -101,12 +104,15 @@ func makePermalink(host, plink string) *url.URL {
 	return base
 }
 
-func Setup(port, internalTplDir, publicTplDir string) *template.Template {
+func Setup(port, internalTplDir, publicTplDir string, lg *logging.Logger) *template.Template {
+	if lg != nil {
+		logger = lg
+	}
 	stringBaseURL := "http://localhost" + port + "/"
 	var err error
 	baseURL, err = url.Parse(stringBaseURL)
 	if err != nil {
-		log.Printf("Could not parse baseURL (%s): %v\n", stringBaseURL, err)
+		logger.Error("Could not parse baseURL", "url", stringBaseURL, "err", err)
 	}
 	tpl = mustParseTemplates(internalTplDir).Funcs(template.FuncMap{"absURL": absURL})
 	publicTpl := mustParseTemplates(publicTplDir).Funcs(template.FuncMap{"absURL": absURL})
@@ -44,6 +44,18 @@ type HeaderData struct {
 	// but profile pages contains only user activity.
 	// RecycleTypes holds the possible content types a user can select to recycle.
 	RecycleTypes []RecycleType
+	// CSRFToken is the token that the scripts of the page must send in the
+	// header X-CSRF-Token of the requests that change the state of the site.
+	// It is empty if the session has none, e.g. no user ever logged in it.
+	CSRFToken string
+}
+
+// LoginView holds information to render the login page.
+type LoginView struct {
+	// CSRFToken is the token that the login and signin forms must send in the
+	// header X-CSRF-Token. It is issued to the anonymous session that gets the
+	// page.
+	CSRFToken string
 }
 
 type ProfileView struct {
@@ -0,0 +1,10 @@
+// csrfToken returns the token of the session that must be sent in the header
+// X-CSRF-Token of the requests that change the state of the site, such as
+// posting, upvoting, saving, following, logging in or out.
+function csrfToken() {
+	let elem = document.querySelector("[data-csrf-token]");
+	if (elem == null) {
+		return "";
+	}
+	return elem.dataset["csrfToken"];
+}
@@ -29,6 +29,7 @@ function setupFollow() {
 		}
 		let req = new XMLHttpRequest();
 		req.open("POST", link, true);
+		req.setRequestHeader("X-CSRF-Token", csrfToken());
 		req.onreadystatechange = function() {
 			if (this.readyState == 4) {
 				if (this.status == 200) {
@@ -47,6 +48,7 @@ function setupFollow() {
 /*
 var req = new XMLHttpRequest();
 req.open("POST", "/follow?username=arodseth");
+req.setRequestHeader("X-CSRF-Token", csrfToken());
 req.onreadystatechange = function() {
 	if (this.readyState == 4) {
 		if (this.status == 200) {
@@ -80,6 +82,7 @@ var usernames = [
 for (var i = 0; i < usernames.length; i++) {
 	var req = new XMLHttpRequest();
 	req.open("POST", "/follow?username=" + usernames[i]);
+	req.setRequestHeader("X-CSRF-Token", csrfToken());
 	req.onreadystatechange = function() {
 		if (this.readyState == 4) {
 			if (this.status == 200) {
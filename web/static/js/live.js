@@ -0,0 +1,89 @@
+// setupLive subscribes to the events of the given topics, such as the new
+// comments and the counters of the thread being viewed, and keeps the page up
+// to date with them.
+function setupLive(topics) {
+	if (typeof EventSource == "undefined") {
+		return;
+	}
+	let query = topics.map(function(topic) {
+		return "topic=" + encodeURIComponent(topic);
+	}).join("&");
+	let source = new EventSource("/livenotifs/stream?" + query);
+	source.addEventListener("event", function(e) {
+		let msg = JSON.parse(e.data);
+		switch (msg.event) {
+		case "comment":
+			addComment(msg.data);
+			break;
+		case "counters":
+			updateCounters(msg.data);
+			break;
+		}
+	});
+}
+
+// threadTopic and sectionTopic return the topics of the thread and the section
+// of the given path, e.g. "/{section}/{thread}".
+function threadTopic(path) {
+	let ids = path.split("/");
+	return "thread:" + ids[1] + "/" + ids[2];
+}
+
+function sectionTopic(path) {
+	return "section:" + path.split("/")[1];
+}
+
+// addComment inserts a new comment at the top of the comments of the thread,
+// unless it is there already.
+function addComment(comment) {
+	let contentArea = document.querySelector(".thread-comments .content-area");
+	if (contentArea == null || comment.html == undefined) {
+		return;
+	}
+	if (document.getElementById("c_id=" + comment.comment) != null) {
+		return;
+	}
+	contentArea.insertAdjacentHTML("afterbegin", comment.html);
+	let noContent = document.querySelector(".thread-comments .no-content-area");
+	if (noContent != null) {
+		noContent.remove();
+	}
+	setupUpvotes();
+	setupReplyComs();
+	setupViewSubcomments();
+}
+
+// updateCounters adds the deltas of the counters to the thread, comment or
+// subcomment they are for, found by its upvote link.
+function updateCounters(counters) {
+	let link = "/" + counters.section + "/" + counters.thread + "/upvote/";
+	if (counters.comment != undefined) {
+		link += "?c_id=" + counters.comment;
+		if (counters.subcomment != undefined) {
+			link += "&sc_id=" + counters.subcomment;
+		}
+	}
+	let posts = document.querySelectorAll("article[data-upvote-link]");
+	for (let i = 0; i < posts.length; i++) {
+		if (posts[i].dataset["upvoteLink"] != link) {
+			continue;
+		}
+		if (counters.upvotes_delta != undefined) {
+			addToCounter(posts[i].querySelector(".upvotes > button"),
+				counters.upvotes_delta, "Upvotes");
+		}
+		if (counters.replies_delta != undefined) {
+			let replies = posts[i].querySelector(".replies button, .replies a") ||
+				posts[i].querySelector(".replies");
+			addToCounter(replies, counters.replies_delta, "Replies");
+		}
+	}
+}
+
+function addToCounter(elem, delta, label) {
+	if (elem == null) {
+		return;
+	}
+	let n = parseInt(elem.textContent) + delta;
+	elem.textContent = n + " " + label;
+}
@@ -4,6 +4,7 @@ submitBtn.addEventListener("click", function() {
 	let fData = new FormData(signinForm);
 	let req = new XMLHttpRequest();
 	req.open("POST", signinForm.dataset["action"], true);
+	req.setRequestHeader("X-CSRF-Token", csrfToken());
 	req.onreadystatechange = function() {
 		if (this.readyState == 4) {
 			if (this.status == 200) {
@@ -21,6 +22,7 @@ loginForm.addEventListener("submit", function(e) {
 	let fData = new FormData(loginForm);
 	let req = new XMLHttpRequest();
 	req.open("POST", loginForm.dataset["action"], true);
+	req.setRequestHeader("X-CSRF-Token", csrfToken());
 	req.onreadystatechange = function() {
 		if (this.readyState == 4) {
 			if (this.status == 200) {
@@ -1,8 +1,9 @@
-logoutBtn = document.querySelector(".user-options button");
-if (logoutBtn != undefined) {
+logoutBtns = document.querySelectorAll(".user-options button");
+logoutBtns.forEach(function(logoutBtn) {
 	logoutBtn.addEventListener("click", function() {
 		let req = new XMLHttpRequest();
-		req.open("GET", logoutBtn.dataset["href"], true);
+		req.open("POST", logoutBtn.dataset["href"], true);
+		req.setRequestHeader("X-CSRF-Token", csrfToken());
 		req.onreadystatechange = function () {
 			if (this.readyState == 4) {
 				if (this.status == 200) {
@@ -14,4 +15,4 @@ if (logoutBtn != undefined) {
 		};
 		req.send();
 	});
-}
+});
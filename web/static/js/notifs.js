@@ -0,0 +1,17 @@
+// The notifications of the user are marked as read when they are opened, and
+// deleted with the clear button. The rest of the connections of the user get
+// the acks of both through the live notifications.
+notifsBtns = document.querySelectorAll(".notifs button[data-href]");
+notifsBtns.forEach(function(notifsBtn) {
+	notifsBtn.addEventListener("click", function() {
+		let req = new XMLHttpRequest();
+		req.open("POST", notifsBtn.dataset["href"], true);
+		req.setRequestHeader("X-CSRF-Token", csrfToken());
+		req.onreadystatechange = function () {
+			if (this.readyState == 4 && this.status != 200) {
+				console.log(this.responseText);
+			}
+		};
+		req.send();
+	});
+});
@@ -3,6 +3,7 @@ postForm.addEventListener("submit", function() {
 	let fData = new FormData(postForm);
 	let req = new XMLHttpRequest();
 	req.open("POST", postForm.dataset["action"], true);
+	req.setRequestHeader("X-CSRF-Token", csrfToken());
 	req.onreadystatechange = function() {
 		if (this.readyState == 4) {
 			if (this.status == 200) {
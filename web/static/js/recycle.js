@@ -9,7 +9,13 @@ function Section(prev, next, contentArea, noContentArea) {
 	this.content = contentArea;
 	this.noContent = noContentArea;
 
-	this.addPage = function(page) {
+	this.addPage = function(page, reset) {
+		if (page == "EXHAUSTED") {
+			if (reset && confirm("You have seen all the contents. Start over?")) {
+				resetPagination(reset);
+			}
+			return;
+		}
 		if (page == "") {
 			alert("There is no new content. Check back later.");
 			return;
@@ -42,3 +48,36 @@ function Section(prev, next, contentArea, noContentArea) {
 		section.content.innerHTML = section.pages[section.currentPage];
 	};
 }
+
+// resetLink returns the link to reset the pagination given in the Link header
+// of the response to a recycle request, or undefined if there is none.
+function resetLink(req) {
+	var link = req.getResponseHeader("Link");
+	if (link == null) {
+		return undefined;
+	}
+	var match = link.match(/<([^>]+)>;\s*rel="reset"/);
+	if (match == null) {
+		return undefined;
+	}
+	return match[1];
+}
+
+// resetPagination requests the server to forget the contents already seen, so
+// that the next recycle starts over.
+function resetPagination(link) {
+	var req = new XMLHttpRequest();
+	req.open("POST", link, true);
+	req.setRequestHeader("X-CSRF-Token", csrfToken());
+	req.setRequestHeader("X-Requested-With", "XMLHttpRequest");
+	req.onreadystatechange = function() {
+		if (this.readyState == 4) {
+			if (this.status == 200) {
+				alert("Done. Recycle to see the contents again.");
+			} else {
+				console.log(this.responseText);
+			}
+		}
+	};
+	req.send();
+}
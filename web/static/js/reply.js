@@ -8,6 +8,7 @@ replyButton.onclick = function() {
 	var fData = new FormData(replyForm);
 	var req = new XMLHttpRequest();
 	req.open("POST", replyLink);
+	req.setRequestHeader("X-CSRF-Token", csrfToken());
 	req.onreadystatechange = function() {
 		if (this.readyState == 4) {
 			console.log(this.responseText);
@@ -30,6 +31,7 @@ function setupReplyComs() {
 				var fData = new FormData(replyForm);
 				var req = new XMLHttpRequest();
 				req.open("POST", replyLink);
+				req.setRequestHeader("X-CSRF-Token", csrfToken());
 				req.onreadystatechange = function() {
 					if (this.readyState == 4) {
 						console.log(this.responseText);
@@ -81,6 +83,7 @@ function setupViewSubcomments() {
 // Script to delete comment.
 var req = new XMLHttpRequest();
 req.open("DELETE", "/mylife/example-post-16-2e1c906bc96c/comment/delete?c_id=5");
+req.setRequestHeader("X-CSRF-Token", csrfToken());
 req.onreadystatechange = function() {
 	if (this.readyState == 4) {
 		console.log(this.responseText);
@@ -38,6 +38,7 @@ function setupSave() {
 				}
 			};
 			req.open("POST", link, true);
+			req.setRequestHeader("X-CSRF-Token", csrfToken());
 			req.send();
 		};
 	}
@@ -28,6 +28,7 @@ function setupUpvotes() {
 
 			let req = new XMLHttpRequest();
 			req.open("POST", link, true);
+			req.setRequestHeader("X-CSRF-Token", csrfToken());
 			req.onreadystatechange = function() {
 				if (this.readyState == 4) {
 					if (this.status == 200) {